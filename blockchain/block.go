@@ -1,76 +1,92 @@
 package blockchain
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
+	"context"
+	"fmt"
 	"log"
 	"time"
 )
 
 func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, ChainParams.InitialBits())
 }
 
 type Block struct {
-	Timestamp    int64
+	BlockHeader
 	Hash    []byte
 	Transactions    []*Transaction
-	PrevHash []byte
-	Nonce int
-	Height int
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
-
-	block.Hash = hash[:]
-	block.Nonce = nonce
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, bits uint32) *Block {
+	block, err := newBlock(context.Background(), txs, prevHash, height, bits, time.Now().Unix())
+	if err != nil {
+		log.Panic(err)
+	}
 
 	return block
 }
-/*
-这个函数会做的事情：
 
-遍历区块里的每一笔交易
+func newBlock(ctx context.Context, txs []*Transaction, prevHash []byte, height int, bits uint32, timestamp int64) (*Block, error) {
+	block := &Block{Hash: []byte{}, Transactions: txs}
+	block.BlockHeader = BlockHeader{Timestamp: timestamp, PrevHash: prevHash, Height: height, Bits: bits}
+	block.MerkleRoot = block.HashTransactions()
+	pow := NewProof(&block.BlockHeader)
+	nonce, hash, err := pow.Mine(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	block.Hash = hash[:]
+	block.Nonce = nonce
+
+	fmt.Printf("Mined block %x at height %d: %d hashes in %s (%.2f kH/s)\n",
+		block.Hash, height, pow.Hashes, pow.Elapsed.Round(time.Millisecond), pow.Hashrate()/1000)
 
-序列化交易内容成字节（Bytes）
+	return block, nil
+}
 
-将所有交易字节拼接在一起
+// HashTransactions 用区块中所有交易的 FullHash（包括解锁脚本）构建默克尔树，返回树根。
+// 默克尔根代表整个区块中所有交易的唯一“指纹”，同时轻客户端可以用 MerkleProof
+// 证明某笔交易在区块中，而不需要下载整个区块。
+func (b *Block) HashTransactions() []byte {
+	tree := NewMerkleTree(b.txHashes())
 
-对拼接后的字节数组做一次 哈希运算（比如 SHA-256）
+	return tree.RootNode.Data
+}
 
-得到的哈希值就代表 整个区块中所有交易的唯一“指纹”。
-*/
-// HashTransactions:作用是把区块里 所有交易组合起来，生成一个唯一表示。
-func (b *Block)HashTransactions() []byte{
-	var txHashes [][]byte
-	var txHash [32]byte
-	for _, tx := range b.Transactions{
-		txHashes = append(txHashes, tx.ID)
+func (b *Block) txHashes() [][]byte {
+	var hashes [][]byte
+	for _, tx := range b.Transactions {
+		hashes = append(hashes, tx.FullHash())
 	}
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
-	return txHash[:]
+
+	return hashes
 }
 
+// Serialize 返回区块的规范二进制编码（见 encoding.go）
 func (b *Block) Serialize() []byte{
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-	err := encoder.Encode(b)
+	var e encoder
+	b.encode(&e)
+
+	return e.buf
+}
+
+// Deserialize 解码区块并重新计算区块哈希
+func Deserialize(data []byte) *Block{
+	block, err := DecodeBlock(data)
 	if err != nil {
 		log.Panic(err)
 	}
-	return res.Bytes()
+	return block
 }
 
-func Deserialize(data []byte) *Block{
+// DecodeBlock 与 Deserialize 相同，但数据格式错误时返回 ErrBadEncoding，用于解码其他节点发送的区块
+func DecodeBlock(data []byte) (*Block, error) {
 	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&block)
-	if err != nil {
-		log.Panic(err)
+	d := decoder{data: data}
+	block.decode(&d)
+	if err := d.finish(); err != nil {
+		return nil, err
 	}
-	return &block
-}
\ No newline at end of file
+	return &block, nil
+}
@@ -3,178 +3,473 @@ package blockchain
 import (
 	"blockchain_go/common"
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
 )
+
 const (
-	dbPath = "./tmp/blocks"
-	dbFile = "./tmp/blocks/MANIFEST"
 	genesisData = "First Transaction from Genesis"
 )
 
-type BlockChain struct{
-	LastHash []byte
+// chainWorkPrefix 用于存储每个区块的累计工作量，fork choice 依据它选择主链
+var chainWorkPrefix = []byte("cw-")
+
+var (
+	ErrAnchorNotFound   = errors.New("anchored data not found in the main chain")
+	ErrNoBlockChain     = errors.New("no existing blockchain found, create one")
+	ErrBlockChainExists = errors.New("blockchain already exists")
+)
+
+type BlockChain struct {
+	LastHash []byte // 主链 tip，其他 goroutine 可能同时修改，通过 Tip 读取
 	Database *badger.DB
+
+	mu      sync.Mutex
+	orphans orphanPool // 父区块尚未收到的孤块（见 orphan.go）
+
+	tipMu sync.RWMutex // 保护 LastHash
 }
 
+// Tip 返回主链 tip 的哈希，可以在多个 goroutine 中调用
+func (chain *BlockChain) Tip() []byte {
+	chain.tipMu.RLock()
+	defer chain.tipMu.RUnlock()
+
+	return chain.LastHash
+}
 
+func (chain *BlockChain) setTip(hash []byte) {
+	chain.tipMu.Lock()
+	defer chain.tipMu.Unlock()
+
+	chain.LastHash = hash
+}
 
 func DBexists(path string) bool {
-	if _, err := os.Stat(path + "/MANIFEST"); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(path, "MANIFEST")); os.IsNotExist(err) {
 		return false
 	}
 
 	return true
 }
 
-
-func (chain *BlockChain) Iterator() *BlockChainIterator{
+func (chain *BlockChain) Iterator() *BlockChainIterator {
 	iter := &BlockChainIterator{
-		chain.LastHash, chain.Database,
+		chain.Tip(), chain.Database,
 	}
 	return iter
 }
 
-func (chain *BlockChain) AddBlock(block *Block) error {
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		var lastHash []byte
-		if _, err := txn.Get(block.Hash); err == nil {
+// AddBlock 把收到的区块加入区块链，并在需要时切换主链（fork choice）。
+//
+// 流程说明：
+// 1. 区块已存在则直接返回。
+// 2. 调用 ValidateBlock 检查共识规则；父区块未知（孤块）则暂存在内存里，等父区块到达后再处理。
+// 3. 保存区块，并记录从创世块到该区块的累计工作量（chain work）。
+// 4. 如果该区块所在分支的累计工作量大于当前主链，则进行链重组：
+//   - 从当前 tip 回退到公共祖先，逐个 disconnect 区块并回滚 UTXOSet
+//   - 从公共祖先开始逐个检查并 connect 新分支的区块，更新 UTXOSet
+//   - 任何一步失败都恢复原来的主链（abortReorganize）
+//
+// 5. 处理等待该区块作为父区块的孤块。
+//
+// 返回主链的变化：attached 是新连接到主链的区块，detached 是从主链上断开的区块，都按高度从低到高排列。
+// 一次调用可能连接多个区块（链重组、孤块），内存池用它们删除已经打包的交易并放回被断开区块中的交易。
+// 出错时主链已经恢复，但处理孤块时仍然可能有区块连接到主链，所以 attached 和 detached 也总是有效的
+func (chain *BlockChain) AddBlock(block *Block) (attached, detached []*Block, err error) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	oldTip := chain.Tip()
+	err = chain.addBlock(block)
+
+	if newTip := chain.Tip(); !bytes.Equal(oldTip, newTip) {
+		var changeErr error
+		if attached, detached, changeErr = chain.tipChange(oldTip, newTip); changeErr != nil && err == nil {
+			err = changeErr
+		}
+	}
+
+	return attached, detached, err
+}
+
+// tipChange 返回主链 tip 从 oldTip 变成 newTip 时断开和连接的区块，都按高度从低到高排列
+func (chain *BlockChain) tipChange(oldTip, newTip []byte) (attached, detached []*Block, err error) {
+	_, detachHashes, attachHashes, err := chain.findFork(oldTip, newTip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if detached, err = chain.getBlocks(detachHashes); err != nil {
+		return nil, nil, err
+	}
+	if attached, err = chain.getBlocks(attachHashes); err != nil {
+		return nil, nil, err
+	}
+	reverseBlocks(detached)
+	reverseBlocks(attached)
+
+	return attached, detached, nil
+}
+
+func reverseBlocks(blocks []*Block) {
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+}
+
+func (chain *BlockChain) addBlock(block *Block) error {
+	if chain.HasBlock(block.Hash) {
+		return nil
+	}
+
+	if err := chain.ValidateBlock(block); err != nil {
+		if errors.Is(err, ErrOrphanBlock) {
+			chain.addOrphan(block)
+			fmt.Printf("Orphan block %x, waiting for parent %x\n", block.Hash, block.PrevHash)
 			return nil
 		}
+		return err
+	}
 
-		blockData := block.Serialize()
-		if err := txn.Set(block.Hash, blockData); err != nil{
+	// 区块直接接在 tip 后面并且累计工作量更大时（正常出块和同步），在保存区块的同一个事务中连接它
+	var work, tipWork *big.Int
+	extended := false
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		var err error
+		if tipWork, err = getChainWork(txn, chain.Tip()); err != nil {
 			return err
 		}
 
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
+		// headers-first 同步时区块头可能已经保存过了
+		if _, err := txn.Get(headerKey(block.Hash)); err == nil {
+			work, err = getChainWork(txn, block.Hash)
+			if err != nil {
+				return err
+			}
+		} else if work, err = putHeader(txn, block.Hash, &block.BlockHeader); err != nil {
 			return err
 		}
-		if err:= item.Value(func(val []byte) error {
-			lastHash = append(lastHash, val...)
-			return nil
-		}); err != nil{
-			return err
+
+		if work.Cmp(tipWork) > 0 && bytes.Equal(block.PrevHash, chain.Tip()) {
+			extended = true
+			return connectBlock(txn, block)
 		}
+		return txn.Set(block.Hash, block.Serialize())
+	})
+	if err != nil {
+		return err
+	}
 
-		item, err = txn.Get(lastHash)
-		if err != nil {
+	if extended {
+		chain.setTip(block.Hash)
+	} else if work.Cmp(tipWork) > 0 {
+		if err := chain.reorganize(block); err != nil {
 			return err
 		}
-		var lastBlockData []byte
-		if err := item.Value(func(val []byte) error {
-			lastBlockData = append(lastBlockData, val...)
-			return nil
-		}); err != nil{
-			return err
+	}
+
+	for _, orphan := range chain.takeOrphans(block.Hash) {
+		if err := chain.addBlock(orphan); err != nil {
+			fmt.Printf("Failed to add orphan block %x: %s\n", orphan.Hash, err)
 		}
+	}
 
-		lastBlock := Deserialize(lastBlockData)
+	return nil
+}
 
-		if block.Height > lastBlock.Height {
-			if err = txn.Set([]byte("lh"), block.Hash); err != nil{
-				return err
+// reorganize 把主链切换到以 newTip 结尾的分支。
+// newTip 直接接在当前 tip 后面时，detach 为空，相当于普通的区块追加。
+// 寻找公共祖先只需要读取区块头，只有需要 disconnect/connect 的区块才会完整读取。
+func (chain *BlockChain) reorganize(newTip *Block) error {
+	oldHash, detachHashes, attachHashes, err := chain.findFork(chain.Tip(), newTip.Hash)
+	if err != nil {
+		return err
+	}
+
+	detach, err := chain.getBlocks(detachHashes)
+	if err != nil {
+		return err
+	}
+	attach, err := chain.getBlocks(attachHashes)
+	if err != nil {
+		return err
+	}
+
+	if len(detach) > 0 {
+		fmt.Printf("Reorganize at %x: disconnecting %d blocks, connecting %d blocks\n",
+			oldHash, len(detach), len(attach))
+	}
+
+	// 任何一步失败都恢复原来的主链，不会停在两条分支中间
+	var detached, connected []*Block
+	for _, block := range detach {
+		if err := chain.DisconnectBlock(block); err != nil {
+			return chain.abortReorganize(connected, detached, nil, err)
+		}
+		detached = append(detached, block)
+	}
+
+	for i := len(attach) - 1; i >= 0; i-- {
+		// 侧链上的区块在这里才第一次针对 UTXO 集合检查交易
+		if err := chain.checkBlockTransactions(attach[i]); err != nil {
+			var invalid []*Block
+			if IsRuleError(err) {
+				invalid = attach[:i+1]
 			}
-			chain.LastHash = block.Hash
+			return chain.abortReorganize(connected, detached, invalid, err)
+		}
+
+		if err := chain.ConnectBlock(attach[i]); err != nil {
+			return chain.abortReorganize(connected, detached, nil, err)
+		}
+		connected = append(connected, attach[i])
+	}
+
+	return nil
+}
+
+// findFork 从区块 oldHash 和 newHash 沿区块头向前查找公共祖先 fork，
+// detach 是从 oldHash 到 fork（不含）的区块，attach 是从 newHash 到 fork（不含）的区块，都从高到低排列
+func (chain *BlockChain) findFork(oldHash, newHash []byte) (fork []byte, detach, attach [][]byte, err error) {
+	oldHeader, err := chain.GetHeader(oldHash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	newHeader, err := chain.GetHeader(newHash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for oldHeader.Height > newHeader.Height {
+		detach = append(detach, oldHash)
+		if oldHash, oldHeader, err = chain.parentHeader(oldHeader); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for newHeader.Height > oldHeader.Height {
+		attach = append(attach, newHash)
+		if newHash, newHeader, err = chain.parentHeader(newHeader); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for !bytes.Equal(oldHash, newHash) {
+		detach = append(detach, oldHash)
+		attach = append(attach, newHash)
+		if oldHash, oldHeader, err = chain.parentHeader(oldHeader); err != nil {
+			return nil, nil, nil, err
+		}
+		if newHash, newHeader, err = chain.parentHeader(newHeader); err != nil {
+			return nil, nil, nil, err
 		}
+	}
+
+	return oldHash, detach, attach, nil
+}
 
+// abortReorganize 在链重组失败时恢复原来的主链：按相反的顺序撤销已经连接的区块（connected 按高度从低到高），
+// 重新连接之前断开的区块（detached 按高度从高到低），并删除无效区块 invalid 及其后代。
+// 返回导致重组失败的 reason，恢复也失败时一起返回恢复的错误
+func (chain *BlockChain) abortReorganize(connected, detached, invalid []*Block, reason error) error {
+	for i := len(connected) - 1; i >= 0; i-- {
+		if err := chain.DisconnectBlock(connected[i]); err != nil {
+			return fmt.Errorf("%w (restoring the main chain failed: %v)", reason, err)
+		}
+	}
+	for i := len(detached) - 1; i >= 0; i-- {
+		if err := chain.ConnectBlock(detached[i]); err != nil {
+			return fmt.Errorf("%w (restoring the main chain failed: %v)", reason, err)
+		}
+	}
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		for _, block := range invalid {
+			for _, key := range [][]byte{block.Hash, headerKey(block.Hash), chainWorkKey(block.Hash)} {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
 		return nil
 	})
-	return err
+	if err != nil {
+		return fmt.Errorf("%w (deleting invalid blocks failed: %v)", reason, err)
+	}
+
+	return reason
 }
 
+// ConnectBlock 把 block 连接到主链 tip 后面。区块、UTXO 集合的变化、撤销数据、索引和新的 tip
+// 在同一个 Badger 事务中写入，进程在任何时候退出都不会让 UTXO 集合与 tip 不一致。
+// 调用前 block 的交易必须已经针对当前 UTXO 集合检查过
+func (chain *BlockChain) ConnectBlock(block *Block) error {
+	if tip := chain.Tip(); !bytes.Equal(block.PrevHash, tip) {
+		return fmt.Errorf("%w: block %x does not extend tip %x", ErrBadPrevHash, block.Hash, tip)
+	}
 
-func (chain *BlockChain) GetBestHeight() (int, error) {
-	var lastBlock Block
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return connectBlock(txn, block)
+	})
+	if err != nil {
+		return err
+	}
+	chain.setTip(block.Hash)
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		if err != nil{
+	return nil
+}
+
+// DisconnectBlock 是 ConnectBlock 的逆操作：在同一个事务中用撤销数据回滚 UTXO 集合和索引，并把 tip 退回到父区块
+func (chain *BlockChain) DisconnectBlock(block *Block) error {
+	if tip := chain.Tip(); !bytes.Equal(block.Hash, tip) {
+		return fmt.Errorf("block %x is not the tip %x", block.Hash, tip)
+	}
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		if err := undoUTXO(txn, block); err != nil {
 			return err
 		}
-		var lastHash []byte
-		var lastBlockData []byte
-		if err := item.Value(func(val []byte) error {
-			lastHash = append(lastHash, val...)
-			return nil
-		}); err != nil{
+		if err := txn.Delete(heightKey(block.Height)); err != nil {
 			return err
 		}
+		return txn.Set([]byte("lh"), block.PrevHash)
+	})
+	if err != nil {
+		return err
+	}
+	chain.setTip(block.PrevHash)
 
-		item, err = txn.Get(lastHash)
-		if err != nil{
-			return err
-		}
-		if err:= item.Value(func(val []byte) error {
-			lastBlockData = append(lastBlockData, val...)
-			return nil
-		}); err != nil{
-			return err
+	return nil
+}
+
+// connectBlock 在事务 txn 中保存 block、更新 UTXO 集合并把 block 设为主链 tip
+func connectBlock(txn *badger.Txn, block *Block) error {
+	if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
+	if err := connectUTXO(txn, block); err != nil {
+		return err
+	}
+	if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+	return txn.Set([]byte("lh"), block.Hash)
+}
+
+func (chain *BlockChain) parentHeader(header *BlockHeader) ([]byte, *BlockHeader, error) {
+	if len(header.PrevHash) == 0 {
+		return nil, nil, errors.New("Reached genesis block without finding a common ancestor")
+	}
+	parent, err := chain.GetHeader(header.PrevHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header.PrevHash, parent, nil
+}
+
+func (chain *BlockChain) getBlocks(hashes [][]byte) ([]*Block, error) {
+	var blocks []*Block
+	for _, hash := range hashes {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return nil, err
 		}
+		blocks = append(blocks, &block)
+	}
+
+	return blocks, nil
+}
+
+func (chain *BlockChain) HasBlock(hash []byte) bool {
+	if len(hash) == 0 {
+		return false
+	}
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(hash)
+		return err
+	})
 
-		lastBlock = *Deserialize(lastBlockData)
+	return err == nil
+}
+
+func chainWorkKey(hash []byte) []byte {
+	return append(append([]byte{}, chainWorkPrefix...), hash...)
+}
+
+// getChainWork 读取从创世块到 hash 对应区块的累计工作量
+func getChainWork(txn *badger.Txn, hash []byte) (*big.Int, error) {
+	item, err := txn.Get(chainWorkKey(hash))
+	if err != nil {
+		return nil, fmt.Errorf("chain work of block %x: %w", hash, err)
+	}
+	work := new(big.Int)
+	err = item.Value(func(val []byte) error {
+		work.SetBytes(val)
 		return nil
 	})
-	if err != nil{
+
+	return work, err
+}
+
+func (chain *BlockChain) GetBestHeight() (int, error) {
+	header, err := chain.GetHeader(chain.Tip())
+	if err != nil {
 		return 0, err
 	}
 
-	return lastBlock.Height, nil
+	return header.Height, nil
 }
 
 // InitBlockChain, 创建全新区块链
-func InitBlockChain(address, nodeId string) (*BlockChain, error) {
-	path := fmt.Sprintf(dbPath, nodeId)
+// InitBlockChain 在目录 path 中创建新的区块链数据库，创世块奖励发送给 address
+func InitBlockChain(address, path string) (*BlockChain, error) {
 	if DBexists(path) {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+		return nil, fmt.Errorf("%w: %s", ErrBlockChainExists, path)
 	}
 	var lastHash []byte
 	opts := badger.DefaultOptions(path)
 
 	db, err := openDB(path, opts)
-	if err != nil{
+	if err != nil {
 		return nil, err
 	}
 
 	if err := db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
+		cbtx := CoinbaseTx(address, genesisData, 0, ChainParams.BlockSubsidy(0))
 		genesis := Genesis(cbtx)
 		fmt.Println("Genesis created")
-		if err = txn.Set(genesis.Hash, genesis.Serialize()); err != nil {
+		if _, err = putHeader(txn, genesis.Hash, &genesis.BlockHeader); err != nil {
 			return err
 		}
-		err = txn.Set([]byte("lh"), genesis.Hash)
-
 		lastHash = genesis.Hash
 
-		return err
+		return connectBlock(txn, genesis)
 
-	}); err != nil{
+	}); err != nil {
 		return nil, err
 	}
 
-	blockchain := BlockChain{lastHash, db}
+	blockchain := BlockChain{LastHash: lastHash, Database: db}
 	return &blockchain, nil
 }
 
-
 // 打开已有区块链
-func ContinueBlockChain(nodeId string) (*BlockChain,error) {
-	path := fmt.Sprintf(dbPath, nodeId)
-	if DBexists(path) == false {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
+// ContinueBlockChain 打开目录 path 中已有的区块链数据库
+func ContinueBlockChain(path string) (*BlockChain, error) {
+	if !DBexists(path) {
+		return nil, fmt.Errorf("%w: %s", ErrNoBlockChain, path)
 	}
 
 	var lastHash []byte
@@ -185,38 +480,65 @@ func ContinueBlockChain(nodeId string) (*BlockChain,error) {
 	if err != nil {
 		return nil, err
 	}
-	
 
 	if err = db.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
-		if err != nil{
+		if err != nil {
 			return err
 		}
 		err = item.Value(func(val []byte) error {
 			lastHash = append(lastHash, val...)
-			return badger.ErrNilCallback
+			return nil
 		})
 
 		return err
-	}); err != nil{
+	}); err != nil {
 		return nil, err
 	}
 
-
-	chain := BlockChain{lastHash, db}
+	chain := BlockChain{LastHash: lastHash, Database: db}
+	if err := chain.repairUTXOSet(); err != nil {
+		return nil, err
+	}
 
 	return &chain, nil
 }
 
-
+// FindTransaction 通过交易索引（见 txindex.go）在主链上查找交易
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := bc.Iterator()
+	tx, _, err := bc.findTransactionHeight(ID)
 
+	return tx, err
+}
+
+// findTransactionHeight 在主链上查找交易，同时返回交易所在区块的高度
+func (bc *BlockChain) findTransactionHeight(ID []byte) (Transaction, int, error) {
+	var tx Transaction
+	var height int
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		tx, height, err = getIndexedTransaction(txn, ID)
+		return err
+	})
+
+	return tx, height, err
+}
+
+// FindAnchor 在主链上查找数据输出中包含 data 的交易（见 NewDataTransaction），
+// 返回最早包含它的区块和交易的默克尔证明，用来证明 data 在区块时间戳之前已经存在
+func (chain *BlockChain) FindAnchor(data []byte) (*Block, *MerkleProof, error) {
+	var found *Block
+	var foundTx []byte
+
+	iter := chain.Iterator()
 	for {
 		block := iter.Next()
 		for _, tx := range block.Transactions {
-			if bytes.Equal(tx.ID, ID)  {
-				return *tx, nil
+			for _, out := range tx.Outputs {
+				if anchored, ok := extractNullData(out.ScriptPubKey); ok && len(data) > 0 && bytes.Equal(anchored, data) {
+					found, foundTx = block, tx.ID
+				}
 			}
 		}
 
@@ -225,7 +547,15 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction does not exist")
+	if found == nil {
+		return nil, nil, ErrAnchorNotFound
+	}
+	proof, err := found.MerkleProof(foundTx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return found, proof, nil
 }
 
 func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
@@ -239,11 +569,15 @@ func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 			if err := item.Value(func(val []byte) error {
 				blockData = append(blockData, val...)
 				return nil
-			}); err != nil{
+			}); err != nil {
 				return err
 			}
 
-			block = *Deserialize(blockData)
+			decoded, err := DecodeBlock(blockData)
+			if err != nil {
+				return fmt.Errorf("block %x: %w", blockHash, err)
+			}
+			block = *decoded
 		}
 		return nil
 	})
@@ -253,71 +587,73 @@ func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 
 	return block, nil
 }
-func (chain *BlockChain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
-
-	iter := chain.Iterator()
-
-	for {
-		block := iter.Next()
 
-		blocks = append(blocks, block.Hash)
+// GetBlockHashes 返回主链上所有区块的哈希（从 tip 到创世块），只需要读取区块头
+func (chain *BlockChain) GetBlockHashes() ([][]byte, error) {
+	var blocks [][]byte
 
-		if len(block.PrevHash) == 0 {
-			break
+	hash := chain.Tip()
+	for len(hash) > 0 {
+		header, err := chain.GetHeader(hash)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	return blocks
-}
-func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
-	var lastBlockData[]byte
-	for _, tx := range transactions {
-		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
-		}
+		blocks = append(blocks, hash)
+		hash = header.PrevHash
 	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		common.HandlerError(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = append(lastHash, val...)
-			return nil
-		})
-
-		item, err = txn.Get(lastHash)
-		common.HandlerError(err)
-		
-		err = item.Value(func(val []byte) error {
-			lastBlockData = append(lastBlockData, val...)
-			return nil
-		})
-
-		lastBlock := Deserialize(lastBlockData)
+	return blocks, nil
+}
 
-		lastHeight = lastBlock.Height
+// MineBlock 在当前 tip 上打包交易并挖出新区块，区块经过 ValidateBlock 检查后才会保存。
+// transactions 按手续费率从高到低选入区块，无效的交易会被跳过；
+// coinbase 交易由 MineBlock 创建，把区块奖励和所有手续费支付给 minerAddress。
+// ctx 被取消时停止挖矿并返回 ctx.Err()，例如网络上已经收到了新的 tip。
+func (chain *BlockChain) MineBlock(ctx context.Context, minerAddress string, transactions []*Transaction) (*Block, error) {
+	tip := chain.Tip()
+	lastHeader, err := chain.GetHeader(tip)
+	if err != nil {
+		return nil, err
+	}
+	medianTime, err := chain.medianTimePast(lastHeader)
+	if err != nil {
+		return nil, err
+	}
 
-		return err
-	})
-	common.HandlerError(err)
+	// 时间戳必须大于 median time past，连续快速出块时需要往后调整
+	timestamp := time.Now().Unix()
+	if timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
 
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	bits, err := chain.nextWorkRequired(lastHeader)
+	if err != nil {
+		return nil, err
+	}
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		common.HandlerError(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+	selected, fees := chain.selectTransactions(transactions, lastHeader.Height+1, medianTime)
+	if len(transactions) > 0 && len(selected) == 0 {
+		return nil, fmt.Errorf("%w: none of %d transactions can be included", ErrNoTransactions, len(transactions))
+	}
+	reward, ok := addMoney(ChainParams.BlockSubsidy(lastHeader.Height+1), fees)
+	if !ok {
+		reward = MaxMoney
+	}
+	cbTx := CoinbaseTx(minerAddress, "", lastHeader.Height+1, reward)
+	transactions = append([]*Transaction{cbTx}, selected...)
 
-		chain.LastHash = newBlock.Hash
+	newBlock, err := newBlock(ctx, transactions, tip, lastHeader.Height+1, bits, timestamp)
+	if err != nil {
+		return nil, err
+	}
 
-		return err
-	})
-	common.HandlerError(err)
+	// AddBlock 负责验证、保存区块、移动 tip 并更新 UTXOSet
+	if _, _, err := chain.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
 
-	return newBlock
+	return newBlock, nil
 }
 func (bc *BlockChain) SignTransaction(tx *Transaction, privKey *ecdsa.PrivateKey) {
 	prevTXs := make(map[string]Transaction)
@@ -331,7 +667,21 @@ func (bc *BlockChain) SignTransaction(tx *Transaction, privKey *ecdsa.PrivateKey
 	tx.Sign(privKey, prevTXs)
 }
 
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs{
+// SignTransactionInput 用 hashType 只签名交易的第 inIdx 个输入，多方合作构建交易时每一方分别签名自己的输入
+func (bc *BlockChain) SignTransactionInput(tx *Transaction, inIdx int, privKey *ecdsa.PrivateKey, hashType SigHashType) error {
+	if inIdx < 0 || inIdx >= len(tx.Inputs) {
+		return fmt.Errorf("input %d out of range", inIdx)
+	}
+
+	prevTX, err := bc.FindTransaction(tx.Inputs[inIdx].ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.SignInput(privKey, inIdx, prevTX, hashType)
+}
+
+func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 	UTXO := make(map[string]TxOutputs)
 	spentTXOs := make(map[string][]int)
 
@@ -340,11 +690,16 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs{
 	for {
 		block := iter.Next()
 
-		for _, tx := range block.Transactions {
+		// 倒序遍历，保证同一区块内后面的交易花费前面交易的输出时也能被正确标记
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
 			for outIdx, out := range tx.Outputs {
+				if IsUnspendable(out.ScriptPubKey) {
+					continue
+				}
 				if spentTXOs[txID] != nil {
 					for _, spentOut := range spentTXOs[txID] {
 						if spentOut == outIdx {
@@ -352,11 +707,14 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs{
 						}
 					}
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = TxOutputs{make(map[int]TxOutput), block.Height, tx.IsCoinbase()}
+				}
+				outs.Outputs[outIdx] = out
 				UTXO[txID] = outs
 			}
-			if !tx.IsCoinBase() {
+			if !tx.IsCoinbase() {
 				for _, in := range tx.Inputs {
 					inTxID := hex.EncodeToString(in.ID)
 					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
@@ -371,19 +729,44 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs{
 	return UTXO
 }
 
-func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+// VerifyTransaction 检查交易的签名和锁定时间，并且不能花费还没有成熟的 coinbase 输出。
+// 交易无效时返回说明原因的错误（IsRuleError），找不到输入引用的交易或者读取数据库失败时也返回错误
+func (bc *BlockChain) VerifyTransaction(tx *Transaction) error {
 	if tx.IsCoinbase() {
-		return true
+		return nil
+	}
+	if err := bc.CheckFinalTx(tx); err != nil {
+		return err
 	}
 	prevTXs := make(map[string]Transaction)
 
+	bestHeight, err := bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	UTXOSet := UTXOSet{bc}
+
 	for _, in := range tx.Inputs {
 		prevTX, err := bc.FindTransaction(in.ID)
-		common.HandlerError(err)
+		if err != nil {
+			return err
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+
+		outs, ok, err := UTXOSet.FindOutputs(in.ID)
+		if err != nil {
+			return err
+		}
+		if ok && !outs.IsMature(bestHeight+1) {
+			return fmt.Errorf("%w: %x:%d from height %d", ErrImmatureSpend, in.ID, in.Out, outs.Height)
+		}
+	}
+
+	if err := tx.VerifyScripts(prevTXs); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
 	}
 
-	return tx.Verify(prevTXs)
+	return nil
 }
 
 func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
@@ -410,4 +793,4 @@ func openDB(dir string, opts badger.Options) (*badger.DB, error) {
 	} else {
 		return db, nil
 	}
-}
\ No newline at end of file
+}
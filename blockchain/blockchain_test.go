@@ -0,0 +1,262 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"blockchain_go/wallet"
+
+	"github.com/dgraph-io/badger"
+)
+
+// utxoStatePrefixes 是 ConnectBlock/DisconnectBlock 维护、Reindex 可以从主链重新生成的数据
+var utxoStatePrefixes = [][]byte{utxoPrefix, addrUTXOPrefix, txIndexPrefix, historyPrefix}
+
+// chainState 读取数据库中 prefixes 下的所有键值，用来比较两个时刻的链状态
+func chainState(t *testing.T, chain *BlockChain, prefixes ...[]byte) map[string]string {
+	t.Helper()
+
+	state := make(map[string]string)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for _, prefix := range prefixes {
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				value, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				state[string(it.Item().KeyCopy(nil))] = string(value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return state
+}
+
+// mainChainState 返回 UTXO 集合、索引和主链高度索引
+func mainChainState(t *testing.T, chain *BlockChain) map[string]string {
+	t.Helper()
+
+	return chainState(t, chain, append(utxoStatePrefixes, heightPrefix)...)
+}
+
+func compareState(t *testing.T, name string, got, want map[string]string) {
+	t.Helper()
+
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s: key %q differs", name, key)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("%s: unexpected key %q", name, key)
+		}
+	}
+}
+
+// checkReindex 检查增量维护的 UTXO 集合和索引与从主链重新生成的结果相同
+func checkReindex(t *testing.T, chain *BlockChain) {
+	t.Helper()
+
+	before := chainState(t, chain, utxoStatePrefixes...)
+	if err := (UTXOSet{chain}).Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	compareState(t, "reindex", before, chainState(t, chain, utxoStatePrefixes...))
+}
+
+// reorgTestChain 创建关闭难度调整的测试链（每个区块的工作量相同，分支的工作量只取决于区块个数），
+// 返回链、钱包和一个已经成熟、可以花费的 coinbase 交易
+func reorgTestChain(t *testing.T) (*BlockChain, *wallet.Wallet, *Transaction) {
+	chain, w := newTestChain(t)
+	ChainParams.RetargetInterval = 0
+
+	coin := mineBlocks(t, chain, string(w.Address()), 1).Transactions[0]
+	mineBlocks(t, chain, string(w.Address()), ChainParams.CoinbaseMaturity)
+
+	return chain, w, coin
+}
+
+func addTestBlock(t *testing.T, chain *BlockChain, block *Block) (attached, detached []*Block) {
+	t.Helper()
+
+	attached, detached, err := chain.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return attached, detached
+}
+
+func blockHashes(blocks []*Block) [][]byte {
+	var hashes [][]byte
+	for _, block := range blocks {
+		hashes = append(hashes, block.Hash)
+	}
+
+	return hashes
+}
+
+func equalHashes(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestReorganizeAndUndo(t *testing.T) {
+	chain, w, coin := reorgTestChain(t)
+	address := string(w.Address())
+	utxo := UTXOSet{chain}
+	script := coin.Outputs[0].ScriptPubKey
+	value := coin.Outputs[0].Value
+
+	forkState := mainChainState(t, chain)
+	fork := chain.Tip()
+
+	// 两条分支用不同的交易花费同一个输出
+	mainTx := spendTx(t, chain, w, []TxInput{{ID: coin.ID, Out: 0}}, []TxOutput{{value - 1, script}})
+	sideTx := spendTx(t, chain, w, []TxInput{{ID: coin.ID, Out: 0}}, []TxOutput{{value - 2, script}})
+
+	m1, err := chain.MineBlock(context.Background(), address, []*Transaction{mainTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainState := mainChainState(t, chain)
+
+	// step 添加 block 后检查主链的变化，以及 UTXO 集合和交易索引中只有 unspent 所在分支的交易
+	step := func(name string, block *Block, tip *Block, attached, detached []*Block, spent, unspent *Transaction) {
+		t.Helper()
+
+		gotAttached, gotDetached := addTestBlock(t, chain, block)
+		if !bytes.Equal(chain.Tip(), tip.Hash) {
+			t.Fatalf("%s: tip is %x, want %x", name, chain.Tip(), tip.Hash)
+		}
+		if !equalHashes(blockHashes(gotAttached), blockHashes(attached)) || !equalHashes(blockHashes(gotDetached), blockHashes(detached)) {
+			t.Errorf("%s: attached %d and detached %d blocks, want %d and %d",
+				name, len(gotAttached), len(gotDetached), len(attached), len(detached))
+		}
+
+		if _, ok, _ := utxo.FindOutputs(unspent.ID); !ok {
+			t.Errorf("%s: outputs of %x are missing from the UTXO set", name, unspent.ID)
+		}
+		if _, ok, _ := utxo.FindOutputs(spent.ID); ok {
+			t.Errorf("%s: outputs of %x from the disconnected branch are in the UTXO set", name, spent.ID)
+		}
+		if _, err := chain.FindTransaction(spent.ID); err == nil {
+			t.Errorf("%s: transaction %x from the disconnected branch is still indexed", name, spent.ID)
+		}
+		if _, ok, _ := utxo.FindOutput(coin.ID, 0); ok {
+			t.Errorf("%s: output spent in both branches is unspent", name)
+		}
+		checkReindex(t, chain)
+	}
+
+	s1 := testBlock(t, chain, fork, address, sideTx)
+	step("side block with equal work", s1, m1, nil, nil, sideTx, mainTx)
+	s2 := testBlock(t, chain, s1.Hash, address)
+	step("switch to side branch", s2, s2, []*Block{s1, s2}, []*Block{m1}, mainTx, sideTx)
+	m2 := testBlock(t, chain, m1.Hash, address)
+	step("main block with equal work", m2, s2, nil, nil, mainTx, sideTx)
+	m3 := testBlock(t, chain, m2.Hash, address)
+	step("switch back to main branch", m3, m3, []*Block{m1, m2, m3}, []*Block{s1, s2}, sideTx, mainTx)
+
+	// 逐个断开区块回到分叉点，再连接第一个区块，状态与当时完全相同
+	for !bytes.Equal(chain.Tip(), fork) {
+		block, err := chain.GetBlock(chain.Tip())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chain.DisconnectBlock(&block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compareState(t, "disconnect to fork", mainChainState(t, chain), forkState)
+
+	if err := chain.ConnectBlock(m1); err != nil {
+		t.Fatal(err)
+	}
+	compareState(t, "reconnect", mainChainState(t, chain), mainState)
+}
+
+// 侧链在连接到主链时才针对 UTXO 集合检查交易。分支中的无效区块让链重组失败：
+// 主链和 UTXO 集合恢复原状，无效区块和它之后的区块被删除，之前的有效区块保留
+func TestReorganizeAcrossInvalidBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		invalid int // 侧链中无效区块的位置
+	}{
+		{"first block", 0},
+		{"middle block", 1},
+		{"new tip", 2},
+	}
+
+	for _, tt := range tests {
+		chain, w, _ := reorgTestChain(t)
+		address := string(w.Address())
+		fork := chain.Tip()
+		mineBlocks(t, chain, address, 2)
+		tip := chain.Tip()
+		state := mainChainState(t, chain)
+
+		// 三个区块的侧链比两个区块的主链工作量大，第三个区块触发链重组
+		var side []*Block
+		prev := fork
+		for i := 0; i < 3; i++ {
+			block := testBlock(t, chain, prev, address)
+			if i == tt.invalid {
+				// coinbase 超过区块奖励只有在连接区块时才能发现
+				block.Transactions[0] = CoinbaseTx(address, "", block.Height, ChainParams.BlockSubsidy(block.Height)+1)
+				block.MerkleRoot = block.HashTransactions()
+				nonce, hash, err := NewProof(&block.BlockHeader).Mine(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				block.Nonce, block.Hash = nonce, hash
+			}
+			side = append(side, block)
+			prev = block.Hash
+			if i < 2 {
+				addTestBlock(t, chain, block)
+			}
+		}
+
+		attached, detached, err := chain.AddBlock(side[2])
+		if !errors.Is(err, ErrBadCoinbaseValue) {
+			t.Errorf("%s: got %v, want ErrBadCoinbaseValue", tt.name, err)
+		}
+		if len(attached) != 0 || len(detached) != 0 {
+			t.Errorf("%s: failed reorganization reported %d attached and %d detached blocks", tt.name, len(attached), len(detached))
+		}
+
+		if !bytes.Equal(chain.Tip(), tip) {
+			t.Errorf("%s: tip is %x, want the old tip %x", tt.name, chain.Tip(), tip)
+		}
+		compareState(t, tt.name, mainChainState(t, chain), state)
+		for i, block := range side {
+			if stored := chain.HasBlock(block.Hash) && chain.HasHeader(block.Hash); stored != (i < tt.invalid) {
+				t.Errorf("%s: side block %d stored = %v, want %v", tt.name, i, stored, i < tt.invalid)
+			}
+		}
+		checkReindex(t, chain)
+
+		// 主链可以继续增长
+		if _, err := chain.MineBlock(context.Background(), address, nil); err != nil {
+			t.Errorf("%s: mining after the failed reorganization: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"blockchain_go/wallet"
+)
+
+/*
+交易构建器。
+一笔交易可以同时向多个地址付款（批量付款），输入可以来自多个钱包（包括多签地址）：
+  builder := NewTxBuilder(&UTXOSet)
+  builder.AddSource(WalletSource(w1))
+  builder.AddSource(WalletSource(w2))
+  builder.AddPayment("地址1", 10)
+  builder.AddPayment("地址2", 20)
+  builder.SetChangeAddress("找零地址")
+  builder.SetFeePolicy(FeePerKB(10))
+  tx, err := builder.Build()
+
+Build 把所有来源可以花费的输出放在一起，用选币方法（默认 DefaultCoinSelector，见 coinselect.go）选择输入；
+找零地址默认是第一个来源的地址，找零为 0 时不创建找零输出。
+手续费由 FeePolicy 根据签名后交易的字节数计算，签名大小事先不知道，所以 Build 会重复
+选择输出、签名，直到手续费不少于签名后交易需要的手续费。
+*/
+
+var (
+	ErrNoSources         = errors.New("transaction has no funding sources")
+	ErrInsufficientFunds = errors.New("not enough funds")
+	ErrBadPayment        = errors.New("payment is invalid")
+)
+
+// maxFeeRounds 是 Build 重新计算手续费的最大次数
+const maxFeeRounds = 10
+
+// FeePolicy 根据签名后交易的字节数返回需要支付的手续费
+type FeePolicy func(size int) int
+
+// FixedFee 不管交易大小都支付 fee
+func FixedFee(fee int) FeePolicy {
+	return func(int) int { return fee }
+}
+
+// FeePerKB 每 1000 字节支付 rate，不足 1000 字节的部分按比例向上取整
+func FeePerKB(rate int) FeePolicy {
+	return func(size int) int { return (size*rate + 999) / 1000 }
+}
+
+// Payment 是一笔付款：向 Address 支付 Amount
+type Payment struct {
+	Address string
+	Amount  int
+}
+
+// Source 是交易输入的来源：锁定脚本为 lockScript 的输出，sign 签名花费这些输出的输入
+type Source struct {
+	Address    string
+	lockScript []byte
+	sign       func(tx *Transaction, inIdx int) error
+}
+
+// WalletSource 花费钱包 w 的 P2PKH 输出
+func WalletSource(w *wallet.Wallet) Source {
+	lockScript := P2PKHScript(wallet.PublicKeyHash(w.PublicKey))
+	return Source{
+		Address:    string(w.Address()),
+		lockScript: lockScript,
+		sign: func(tx *Transaction, inIdx int) error {
+			return tx.signP2PKHInput(&w.PrivateKey, inIdx, lockScript, SigHashAll)
+		},
+	}
+}
+
+// MultisigSource 花费多签赎回脚本 redeemScript 的 P2SH 输出，privKeys 中至少要有 m 个对应的私钥
+func MultisigSource(redeemScript []byte, privKeys []*ecdsa.PrivateKey) Source {
+	return Source{
+		Address:    string(wallet.ScriptAddress(redeemScript)),
+		lockScript: P2SHScript(wallet.PublicKeyHash(redeemScript)),
+		sign: func(tx *Transaction, inIdx int) error {
+			return tx.SignMultisigInput(privKeys, inIdx, redeemScript, SigHashAll)
+		},
+	}
+}
+
+// TxBuilder 构建并签名一笔交易
+type TxBuilder struct {
+	UTXO *UTXOSet
+
+	sources  []Source
+	outputs  []TxOutput
+	change   string
+	fee      FeePolicy
+	selector CoinSelector
+	lockTime uint32
+	err      error
+}
+
+// NewTxBuilder 创建花费 UTXO 中输出的交易构建器，默认不支付手续费
+func NewTxBuilder(UTXO *UTXOSet) *TxBuilder {
+	return &TxBuilder{UTXO: UTXO, fee: FixedFee(0), selector: DefaultCoinSelector}
+}
+
+// AddSource 添加一个输入来源
+func (b *TxBuilder) AddSource(source Source) *TxBuilder {
+	b.sources = append(b.sources, source)
+	return b
+}
+
+// AddPayment 添加一个付款输出，amount 必须大于 0
+func (b *TxBuilder) AddPayment(address string, amount int) *TxBuilder {
+	if amount <= 0 {
+		b.setErr(fmt.Errorf("%w: amount %d to %s", ErrBadPayment, amount, address))
+		return b
+	}
+	script, err := LockScript(address)
+	if err != nil {
+		b.setErr(fmt.Errorf("%w: %v", ErrBadPayment, err))
+		return b
+	}
+	b.outputs = append(b.outputs, TxOutput{amount, script})
+	return b
+}
+
+// AddPayments 按顺序添加多个付款输出
+func (b *TxBuilder) AddPayments(payments []Payment) *TxBuilder {
+	for _, p := range payments {
+		b.AddPayment(p.Address, p.Amount)
+	}
+	return b
+}
+
+// AddData 添加一个数据输出（OP_RETURN，见 script.go）
+func (b *TxBuilder) AddData(data []byte) *TxBuilder {
+	script, err := NullDataScript(data)
+	if err != nil {
+		b.setErr(err)
+		return b
+	}
+	b.outputs = append(b.outputs, TxOutput{0, script})
+	return b
+}
+
+// SetChangeAddress 设置找零地址
+func (b *TxBuilder) SetChangeAddress(address string) *TxBuilder {
+	b.change = address
+	return b
+}
+
+// SetFeePolicy 设置手续费策略
+func (b *TxBuilder) SetFeePolicy(policy FeePolicy) *TxBuilder {
+	b.fee = policy
+	return b
+}
+
+// SetCoinSelector 设置选币方法
+func (b *TxBuilder) SetCoinSelector(selector CoinSelector) *TxBuilder {
+	b.selector = selector
+	return b
+}
+
+// SetLockTime 设置交易的绝对锁定时间（见 locktime.go）
+func (b *TxBuilder) SetLockTime(lockTime uint32) *TxBuilder {
+	b.lockTime = lockTime
+	return b
+}
+
+func (b *TxBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build 选择输入、添加找零、签名，返回签名后的交易
+func (b *TxBuilder) Build() (*Transaction, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.sources) == 0 {
+		return nil, ErrNoSources
+	}
+
+	change := b.change
+	if change == "" {
+		change = b.sources[0].Address
+	}
+	changeScript, err := LockScript(change)
+	if err != nil {
+		return nil, fmt.Errorf("change address: %w", err)
+	}
+
+	// 同一个输出只属于一个锁定脚本，按 交易 ID:索引 记录它的来源，签名时使用
+	var coins []UnspentOutput
+	sources := make(map[string]Source)
+	for _, source := range b.sources {
+		for _, coin := range b.UTXO.SpendableCoins(source.lockScript) {
+			key := coinKey(coin.TxID, coin.Out)
+			if _, ok := sources[key]; ok {
+				continue
+			}
+			coins = append(coins, coin)
+			sources[key] = source
+		}
+	}
+
+	fee := b.fee(0)
+	for round := 0; round < maxFeeRounds; round++ {
+		if fee < 0 {
+			return nil, fmt.Errorf("%w: negative fee %d", ErrBadPayment, fee)
+		}
+
+		tx, err := b.build(coins, sources, changeScript, fee)
+		if err != nil {
+			return nil, err
+		}
+
+		required := b.fee(len(tx.Serialize()))
+		if fee >= required {
+			return tx, nil
+		}
+		fee = required
+	}
+
+	return nil, fmt.Errorf("fee did not converge after %d rounds", maxFeeRounds)
+}
+
+func coinKey(txID []byte, outIdx int) string {
+	return fmt.Sprintf("%x:%d", txID, outIdx)
+}
+
+// build 用手续费 fee 从 coins 中选择输入并签名
+func (b *TxBuilder) build(coins []UnspentOutput, sources map[string]Source, changeScript []byte, fee int) (*Transaction, error) {
+	amount := 0
+	for _, out := range b.outputs {
+		amount += out.Value
+	}
+	target := amount + fee
+
+	// 所有输入的 Sequence 都是 SequenceFinal 时 LockTime 不生效
+	sequence := uint32(SequenceFinal)
+	if b.lockTime != 0 {
+		sequence = SequenceFinal - 1
+	}
+
+	// 交易至少需要一个输入，没有转账金额和手续费时也要花费一个输出
+	selected, err := b.selector(coins, max(target, 1))
+	if err != nil {
+		return nil, err
+	}
+	acc := sumCoins(selected)
+	if acc < target || len(selected) == 0 {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, acc, target)
+	}
+
+	var inputs []TxInput
+	for _, coin := range selected {
+		inputs = append(inputs, TxInput{coin.TxID, coin.Out, nil, sequence})
+	}
+
+	outputs := append([]TxOutput{}, b.outputs...)
+	if acc > target {
+		outputs = append(outputs, TxOutput{acc - target, changeScript})
+	}
+
+	tx := Transaction{nil, inputs, outputs, b.lockTime}
+	tx.ID = tx.Hash()
+
+	for inIdx, in := range tx.Inputs {
+		if err := sources[coinKey(in.ID, in.Out)].sign(&tx, inIdx); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tx, nil
+}
@@ -0,0 +1,269 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+/*
+选币（coin selection）：从一个地址的未花费输出中选出总额不少于目标金额的一组输出。
+选法影响找零和粉尘（很小的输出）：
+  largest   从大到小选，输入最少，但小额输出会一直留下
+  bnb       分支定界（branch and bound）查找总额正好等于目标金额的组合，不需要找零，找不到时失败
+  knapsack  比特币 Core 的近似背包算法：随机多次尝试，选出总额最接近目标金额的组合
+  random    随机顺序选择，不暴露输出之间的关联，保护隐私
+  auto      先用 bnb，找不到正好相等的组合时使用 knapsack（默认）
+*/
+
+// maxBnBTries 是分支定界最多搜索的节点数
+const maxBnBTries = 100000
+
+// knapsackIterations 是近似背包算法的随机尝试次数
+const knapsackIterations = 1000
+
+var ErrNoExactMatch = errors.New("no combination of outputs matches the amount exactly")
+
+// UnspentOutput 是 UTXO 集合中的一个输出及其位置
+type UnspentOutput struct {
+	TxID       []byte
+	Out        int
+	Value      int
+	Height     int
+	IsCoinbase bool
+}
+
+// CoinSelector 从 coins 中选出总额不少于 target 的输出
+type CoinSelector func(coins []UnspentOutput, target int) ([]UnspentOutput, error)
+
+// CoinSelectors 是命令行可以使用的选币方法
+var CoinSelectors = map[string]CoinSelector{
+	"largest":  SelectLargestFirst,
+	"bnb":      SelectBranchAndBound,
+	"knapsack": SelectKnapsack,
+	"random":   SelectRandom,
+	"auto":     SelectAuto,
+}
+
+// DefaultCoinSelector 是没有指定选币方法时使用的方法
+var DefaultCoinSelector CoinSelector = SelectAuto
+
+// CoinSelectorNames 返回 CoinSelectors 中的名字，用于命令行帮助
+func CoinSelectorNames() string {
+	var names []string
+	for name := range CoinSelectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+func sumCoins(coins []UnspentOutput) int {
+	total := 0
+	for _, c := range coins {
+		total += c.Value
+	}
+	return total
+}
+
+func checkFunds(coins []UnspentOutput, target int) error {
+	if total := sumCoins(coins); total < target {
+		return fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, total, target)
+	}
+	return nil
+}
+
+// sortedByValue 返回按金额从大到小排序的副本
+func sortedByValue(coins []UnspentOutput) []UnspentOutput {
+	sorted := append([]UnspentOutput{}, coins...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+	return sorted
+}
+
+// accumulate 按顺序选择输出，直到总额达到 target
+func accumulate(coins []UnspentOutput, target int) []UnspentOutput {
+	var selected []UnspentOutput
+	acc := 0
+	for _, c := range coins {
+		if acc >= target {
+			break
+		}
+		selected = append(selected, c)
+		acc += c.Value
+	}
+	return selected
+}
+
+// SelectLargestFirst 从金额最大的输出开始选择
+func SelectLargestFirst(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	if err := checkFunds(coins, target); err != nil {
+		return nil, err
+	}
+	return accumulate(sortedByValue(coins), target), nil
+}
+
+// SelectRandom 按随机顺序选择
+func SelectRandom(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	if err := checkFunds(coins, target); err != nil {
+		return nil, err
+	}
+	shuffled := append([]UnspentOutput{}, coins...)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+	return accumulate(shuffled, target), nil
+}
+
+// SelectBranchAndBound 深度优先搜索总额正好等于 target 的组合，找不到时返回 ErrNoExactMatch
+func SelectBranchAndBound(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	if err := checkFunds(coins, target); err != nil {
+		return nil, err
+	}
+	sorted := sortedByValue(coins)
+
+	// remaining[i] 是 sorted[i:] 的总额，剩下的输出全部选上也达不到 target 时剪枝
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Value
+	}
+
+	var selected []int
+	tries := 0
+	var search func(i, sum int) bool
+	search = func(i, sum int) bool {
+		tries++
+		if sum == target {
+			return true
+		}
+		if tries > maxBnBTries || sum > target || i == len(sorted) || sum+remaining[i] < target {
+			return false
+		}
+
+		selected = append(selected, i)
+		if search(i+1, sum+sorted[i].Value) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+
+		// 不选 sorted[i] 时跳过金额相同的输出，它们得到的组合是一样的
+		j := i + 1
+		for j < len(sorted) && sorted[j].Value == sorted[i].Value {
+			j++
+		}
+		return search(j, sum)
+	}
+
+	if !search(0, 0) {
+		return nil, fmt.Errorf("%w: %d", ErrNoExactMatch, target)
+	}
+
+	result := make([]UnspentOutput, 0, len(selected))
+	for _, i := range selected {
+		result = append(result, sorted[i])
+	}
+	return result, nil
+}
+
+// SelectKnapsack 是比特币 Core 的近似背包选币：
+// 有金额正好等于 target 的输出时直接使用；小于 target 的输出总额正好等于 target 时全部使用；
+// 否则随机尝试选出总额不少于 target 且尽量小的组合，与大于 target 的最小输出比较，取总额较小的
+func SelectKnapsack(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	if err := checkFunds(coins, target); err != nil {
+		return nil, err
+	}
+
+	var smaller []UnspentOutput
+	var lowestLarger *UnspentOutput
+	smallerTotal := 0
+	for i, c := range coins {
+		switch {
+		case c.Value == target:
+			return []UnspentOutput{c}, nil
+		case c.Value < target:
+			smaller = append(smaller, c)
+			smallerTotal += c.Value
+		case lowestLarger == nil || c.Value < lowestLarger.Value:
+			lowestLarger = &coins[i]
+		}
+	}
+
+	if smallerTotal == target {
+		return smaller, nil
+	}
+	if smallerTotal < target {
+		return []UnspentOutput{*lowestLarger}, nil
+	}
+
+	smaller = sortedByValue(smaller)
+	best, bestSum := approximateBestSubset(smaller, smallerTotal, target)
+	if lowestLarger != nil && bestSum != target && lowestLarger.Value <= bestSum {
+		return []UnspentOutput{*lowestLarger}, nil
+	}
+
+	var result []UnspentOutput
+	for i, included := range best {
+		if included {
+			result = append(result, smaller[i])
+		}
+	}
+	return result, nil
+}
+
+// approximateBestSubset 随机尝试 knapsackIterations 次，返回总额不少于 target 且最小的组合
+func approximateBestSubset(coins []UnspentOutput, total, target int) ([]bool, int) {
+	best := make([]bool, len(coins))
+	for i := range best {
+		best[i] = true
+	}
+	bestSum := total
+
+	included := make([]bool, len(coins))
+	for rep := 0; rep < knapsackIterations && bestSum != target; rep++ {
+		for i := range included {
+			included[i] = false
+		}
+		sum := 0
+		reached := false
+
+		// 第一遍随机选择，第二遍补上没有选的输出
+		for pass := 0; pass < 2 && !reached; pass++ {
+			for i, c := range coins {
+				var include bool
+				if pass == 0 {
+					include = rand.Intn(2) == 0
+				} else {
+					include = !included[i]
+				}
+				if !include {
+					continue
+				}
+
+				sum += c.Value
+				included[i] = true
+				if sum >= target {
+					reached = true
+					if sum < bestSum {
+						bestSum = sum
+						copy(best, included)
+					}
+					// 去掉这个输出继续尝试更小的组合
+					sum -= c.Value
+					included[i] = false
+				}
+			}
+		}
+	}
+
+	return best, bestSum
+}
+
+// SelectAuto 先查找不需要找零的组合，找不到时使用近似背包算法
+func SelectAuto(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	selected, err := SelectBranchAndBound(coins, target)
+	if errors.Is(err, ErrNoExactMatch) {
+		return SelectKnapsack(coins, target)
+	}
+	return selected, err
+}
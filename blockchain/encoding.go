@@ -0,0 +1,322 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+共识数据（区块、区块头、交易、UTXO 条目）的规范二进制编码。
+
+gob 的输出依赖 Go 的实现细节，其他语言的工具无法重现，所以需要哈希或签名的数据都使用下面固定的格式，
+字段按顺序依次写入，没有字段名和类型信息。每个值只有一种合法的编码，解码时拒绝其他写法，保证解码后重新编码得到相同的字节：
+  uvarint   无符号变长整数（encoding/binary 的 Uvarint，LEB128），最后一个字节不能是 0（必须是最短编码）
+  varint    有符号变长整数（zigzag 编码后按 uvarint 写入）
+  bytes     uvarint 长度 + 原始字节
+  uint32    4 字节大端整数
+
+每个对象以 uvarint 格式版本号开头（当前为 1）：
+  区块头：    version, varint Timestamp, bytes PrevHash, bytes MerkleRoot, varint Height, uint32 Bits, varint Nonce
+  交易：      version, uvarint 输入个数, 每个输入 {bytes ID, varint Out, bytes ScriptSig, uint32 Sequence},
+             uvarint 输出个数, 每个输出 {varint Value, bytes ScriptPubKey}, uint32 LockTime
+  区块：      区块头编码, uvarint 交易个数, 依次是每笔交易的编码
+  UTXO 条目： version, varint Height, 1 字节 IsCoinbase, uvarint 输出个数, 按索引升序每个输出 {uvarint 索引, varint Value, bytes ScriptPubKey}
+
+区块哈希是区块头编码的 SHA-256；交易 ID 是把所有 ScriptSig 置空后交易编码的 SHA-256，
+所以签名前后交易 ID 不变。coinbase 交易的 ScriptSig 是任意数据，计算交易 ID 时保留，保证每个 coinbase 的 ID 不同。区块哈希和交易 ID 不写入编码，解码时重新计算。
+区块的默克尔根由交易的完整编码（包括 ScriptSig）的 SHA-256（FullHash）构建，所以区块哈希同时承诺了交易内容和签名。
+*/
+
+const encodingVersion = 1
+
+var ErrBadEncoding = errors.New("invalid encoding")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// decoder 依次读取字段，遇到第一个错误后后面的读取都返回零值，最后由 finish 返回错误
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad uvarint")
+		return 0
+	}
+	if n > 1 && d.data[n-1] == 0 {
+		d.fail("non-minimal uvarint")
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	if n > 1 && d.data[n-1] == 0 {
+		d.fail("non-minimal varint")
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return v
+}
+
+func (d *decoder) int() int {
+	v := d.varint()
+	if int64(int(v)) != v {
+		d.fail("integer %d out of range", v)
+		return 0
+	}
+
+	return int(v)
+}
+
+// count 读取元素个数，每个元素至少占一个字节，个数不能超过剩余的字节数
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("count %d exceeds remaining %d bytes", n, len(d.data))
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)) {
+		d.fail("length %d exceeds remaining %d bytes", n, len(d.data))
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := append([]byte{}, d.data[:n]...)
+	d.data = d.data[n:]
+
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) < 4 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+
+	return v
+}
+
+func (d *decoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.data) < 1 || d.data[0] > 1 {
+		d.fail("bad bool")
+		return false
+	}
+	v := d.data[0] == 1
+	d.data = d.data[1:]
+
+	return v
+}
+
+func (d *decoder) version() {
+	if v := d.uvarint(); d.err == nil && v != encodingVersion {
+		d.fail("unsupported version %d", v)
+	}
+}
+
+// finish 返回解码过程中的错误，数据没有被完全读取也是错误
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d trailing bytes", len(d.data))
+	}
+
+	return d.err
+}
+
+func (h *BlockHeader) encode(e *encoder) {
+	e.uvarint(encodingVersion)
+	e.varint(h.Timestamp)
+	e.bytes(h.PrevHash)
+	e.bytes(h.MerkleRoot)
+	e.varint(int64(h.Height))
+	e.uint32(h.Bits)
+	e.varint(int64(h.Nonce))
+}
+
+func (h *BlockHeader) decode(d *decoder) {
+	d.version()
+	h.Timestamp = d.varint()
+	h.PrevHash = d.bytes()
+	h.MerkleRoot = d.bytes()
+	h.Height = d.int()
+	h.Bits = d.uint32()
+	h.Nonce = d.int()
+}
+
+// encode 写入交易，withScriptSigs 为 false 时除 coinbase 外所有 ScriptSig 按空值写入（用于计算交易 ID 和签名摘要）
+func (tx *Transaction) encode(e *encoder, withScriptSigs bool) {
+	e.uvarint(encodingVersion)
+
+	withScriptSigs = withScriptSigs || tx.IsCoinbase()
+	e.uvarint(uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		e.bytes(in.ID)
+		e.varint(int64(in.Out))
+		if withScriptSigs {
+			e.bytes(in.ScriptSig)
+		} else {
+			e.bytes(nil)
+		}
+		e.uint32(in.Sequence)
+	}
+
+	e.uvarint(uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		e.varint(int64(out.Value))
+		e.bytes(out.ScriptPubKey)
+	}
+
+	e.uint32(tx.LockTime)
+}
+
+// decode 读取交易并重新计算交易 ID
+func (tx *Transaction) decode(d *decoder) {
+	d.version()
+
+	tx.Inputs = make([]TxInput, d.count())
+	for i := range tx.Inputs {
+		tx.Inputs[i] = TxInput{d.bytes(), d.int(), d.bytes(), d.uint32()}
+	}
+
+	tx.Outputs = make([]TxOutput, d.count())
+	for i := range tx.Outputs {
+		tx.Outputs[i] = TxOutput{d.int(), d.bytes()}
+	}
+
+	tx.LockTime = d.uint32()
+
+	if d.err == nil {
+		tx.ID = tx.Hash()
+	}
+}
+
+func (b *Block) encode(e *encoder) {
+	b.BlockHeader.encode(e)
+
+	e.uvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		tx.encode(e, true)
+	}
+}
+
+// decode 读取区块并重新计算区块哈希
+func (b *Block) decode(d *decoder) {
+	b.BlockHeader.decode(d)
+
+	b.Transactions = make([]*Transaction, d.count())
+	for i := range b.Transactions {
+		b.Transactions[i] = &Transaction{}
+		b.Transactions[i].decode(d)
+	}
+
+	if d.err == nil {
+		b.Hash = b.ComputeHash()
+	}
+}
+
+func (outs *TxOutputs) encode(e *encoder) {
+	e.uvarint(encodingVersion)
+	e.varint(int64(outs.Height))
+	e.bool(outs.IsCoinbase)
+
+	indexes := make([]int, 0, len(outs.Outputs))
+	for idx := range outs.Outputs {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	e.uvarint(uint64(len(indexes)))
+	for _, idx := range indexes {
+		e.uvarint(uint64(idx))
+		e.varint(int64(outs.Outputs[idx].Value))
+		e.bytes(outs.Outputs[idx].ScriptPubKey)
+	}
+}
+
+func (outs *TxOutputs) decode(d *decoder) {
+	d.version()
+	outs.Height = d.int()
+	outs.IsCoinbase = d.bool()
+
+	n := d.count()
+	outs.Outputs = make(map[int]TxOutput, n)
+	prev := -1
+	for i := 0; i < n; i++ {
+		idx := d.uvarint()
+		if d.err == nil && (idx > math.MaxInt32 || int(idx) <= prev) {
+			d.fail("output index %d is not after %d", idx, prev)
+		}
+		prev = int(idx)
+		outs.Outputs[prev] = TxOutput{d.int(), d.bytes()}
+	}
+}
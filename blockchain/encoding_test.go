@@ -0,0 +1,199 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestDecoderVarints(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		signed bool
+		want   int64
+		ok     bool
+	}{
+		{"zero", []byte{0x00}, false, 0, true},
+		{"one byte", []byte{0x7f}, false, 127, true},
+		{"two bytes", []byte{0x80, 0x01}, false, 128, true},
+		{"max uint64", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, false, -1, true},
+		{"non-minimal zero", []byte{0x80, 0x00}, false, 0, false},
+		{"non-minimal one", []byte{0x81, 0x80, 0x00}, false, 0, false},
+		{"overflow", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}, false, 0, false},
+		{"truncated", []byte{0x80}, false, 0, false},
+		{"empty", nil, false, 0, false},
+		{"signed minus one", []byte{0x01}, true, -1, true},
+		{"signed min int64", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, true, math.MinInt64, true},
+		{"signed non-minimal", []byte{0x82, 0x00}, true, 0, false},
+	}
+
+	for _, tt := range tests {
+		d := decoder{data: tt.data}
+		var got int64
+		if tt.signed {
+			got = d.varint()
+		} else {
+			got = int64(d.uvarint())
+		}
+		err := d.finish()
+
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("%s: got %d, %v, want %d", tt.name, got, err, tt.want)
+		} else if !tt.ok && !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%s: got %d, %v, want ErrBadEncoding", tt.name, got, err)
+		}
+	}
+}
+
+func testEncodingBlock() *Block {
+	tx := &Transaction{
+		Inputs: []TxInput{
+			{bytes.Repeat([]byte{1}, 32), 0, []byte("signature"), SequenceFinal},
+			{bytes.Repeat([]byte{2}, 32), 300, nil, 10},
+		},
+		Outputs:  []TxOutput{{0, P2PKHScript(make([]byte, 20))}, {MaxMoney, P2SHScript(make([]byte, 20))}},
+		LockTime: 500,
+	}
+	tx.ID = tx.Hash()
+	coinbase := &Transaction{
+		Inputs:  []TxInput{{nil, -1, []byte("coinbase"), SequenceFinal}},
+		Outputs: []TxOutput{{50, P2PKHScript(make([]byte, 20))}},
+	}
+	coinbase.ID = coinbase.Hash()
+
+	block := &Block{
+		BlockHeader:  BlockHeader{Timestamp: -1, PrevHash: bytes.Repeat([]byte{3}, 32), Height: 7, Bits: 0x1d00ffff, Nonce: 1 << 40},
+		Transactions: []*Transaction{coinbase, tx},
+	}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.ComputeHash()
+
+	return block
+}
+
+// 每种对象解码后重新编码必须得到相同的字节，解码时重新计算的区块哈希和交易 ID 与原来相同
+func TestEncodingRoundTrip(t *testing.T) {
+	block := testEncodingBlock()
+	tx := block.Transactions[1]
+	outs := TxOutputs{Outputs: map[int]TxOutput{0: tx.Outputs[0], 5: tx.Outputs[1], 200: {1, nil}}, Height: 9, IsCoinbase: true}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		decode func(data []byte) ([]byte, error)
+	}{
+		{"header", block.BlockHeader.Serialize(), func(data []byte) ([]byte, error) {
+			h, err := DecodeHeader(data)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(h.ComputeHash(), block.Hash) {
+				t.Error("header: decoded hash differs")
+			}
+			return h.Serialize(), nil
+		}},
+		{"transaction", tx.Serialize(), func(data []byte) ([]byte, error) {
+			decoded, err := DecodeTransaction(data)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(decoded.ID, tx.ID) {
+				t.Error("transaction: decoded ID differs")
+			}
+			return decoded.Serialize(), nil
+		}},
+		{"block", block.Serialize(), func(data []byte) ([]byte, error) {
+			decoded, err := DecodeBlock(data)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(decoded.Hash, block.Hash) || !bytes.Equal(decoded.HashTransactions(), block.MerkleRoot) {
+				t.Error("block: decoded hash or merkle root differs")
+			}
+			return decoded.Serialize(), nil
+		}},
+		{"outputs", outs.Serialize(), func(data []byte) ([]byte, error) {
+			decoded, err := DecodeOutputs(data)
+			if err != nil {
+				return nil, err
+			}
+			return decoded.Serialize(), nil
+		}},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.decode(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !bytes.Equal(got, tt.data) {
+			t.Errorf("%s: re-encoded as %x, want %x", tt.name, got, tt.data)
+		}
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	block := testEncodingBlock()
+	header := block.BlockHeader.Serialize()
+	tx := block.Transactions[1].Serialize()
+	blockData := block.Serialize()
+
+	encode := func(f func(e *encoder)) []byte {
+		var e encoder
+		f(&e)
+		return e.buf
+	}
+	outputs := func(indexes ...uint64) []byte {
+		return encode(func(e *encoder) {
+			e.uvarint(encodingVersion)
+			e.varint(1)
+			e.bool(false)
+			e.uvarint(uint64(len(indexes)))
+			for _, idx := range indexes {
+				e.uvarint(idx)
+				e.varint(1)
+				e.bytes(nil)
+			}
+		})
+	}
+	// nonMinimal 把 data 开头的版本号 1 改写成两个字节的编码
+	nonMinimal := func(data []byte) []byte {
+		return append([]byte{0x81, 0x00}, data[1:]...)
+	}
+
+	decodeHeader := func(data []byte) error { _, err := DecodeHeader(data); return err }
+	decodeTx := func(data []byte) error { _, err := DecodeTransaction(data); return err }
+	decodeBlock := func(data []byte) error { _, err := DecodeBlock(data); return err }
+	decodeOutputs := func(data []byte) error { _, err := DecodeOutputs(data); return err }
+
+	tests := []struct {
+		name   string
+		data   []byte
+		decode func(data []byte) error
+	}{
+		{"header non-minimal version", nonMinimal(header), decodeHeader},
+		{"header non-minimal timestamp", append(append([]byte{0x01}, 0x81, 0x00), header[2:]...), decodeHeader},
+		{"header unsupported version", append([]byte{0x02}, header[1:]...), decodeHeader},
+		{"header truncated", header[:len(header)-1], decodeHeader},
+		{"header trailing bytes", append(append([]byte{}, header...), 0), decodeHeader},
+		{"transaction non-minimal version", nonMinimal(tx), decodeTx},
+		{"transaction truncated", tx[:len(tx)-1], decodeTx},
+		{"transaction trailing bytes", append(append([]byte{}, tx...), 0), decodeTx},
+		{"transaction input count too large", append([]byte{0x01, 0xff, 0x7f}, tx[2:]...), decodeTx},
+		{"block truncated", blockData[:len(blockData)-1], decodeBlock},
+		{"block trailing bytes", append(append([]byte{}, blockData...), 0), decodeBlock},
+		{"block without transaction count", header, decodeBlock},
+		{"outputs unsorted indexes", outputs(2, 1), decodeOutputs},
+		{"outputs duplicate index", outputs(1, 1), decodeOutputs},
+		{"outputs bad bool", append(append([]byte{0x01, 0x02}, 2), outputs()[3:]...), decodeOutputs},
+		{"outputs non-minimal index", append(outputs()[:3], 0x01, 0x80, 0x00, 0x02, 0x00), decodeOutputs},
+		{"empty", nil, decodeTx},
+	}
+
+	for _, tt := range tests {
+		if err := tt.decode(tt.data); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%s: got %v, want ErrBadEncoding", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+交易手续费。
+交易的手续费 = 输入总额 - 输出总额，矿工通过 coinbase 交易领取区块中所有交易的手续费。
+矿工打包交易时按手续费率（手续费 / 交易字节数）从高到低选择，区块大小不超过 MaxBlockSize。
+*/
+
+const (
+	// MaxBlockSize 是区块编码后的最大字节数（共识规则，见 CheckBlock）
+	MaxBlockSize = 1 << 20
+	// blockReservedSize 是选择交易时为区块头、交易个数和 coinbase 交易预留的字节数
+	blockReservedSize = 1000
+)
+
+// selectTransactions 按手续费率从高到低选择可以打包进下一个区块的交易，返回选中的交易和手续费总额。
+// 花费内存池中其他交易输出的交易要等父交易选中后才能被选中，
+// 引用不存在、已花费或未成熟的输出，锁定时间没有到期，签名无效、手续费为负的交易会被跳过。
+// medianTime 是父区块的 median time past，用来检查锁定时间。
+// 每笔交易的输入只完整检查一次（checkInputs），之后每一轮只检查它花费的输出有没有被选中的交易花费。
+func (chain *BlockChain) selectTransactions(txs []*Transaction, height int, medianTime int64) ([]*Transaction, int) {
+	type candidate struct {
+		tx   *Transaction
+		fee  int
+		size int
+	}
+
+	view := chain.newBlockView(height)
+	ready := make(map[*Transaction]*candidate)
+	pending := append([]*Transaction{}, txs...)
+
+	var selected []*Transaction
+	fees, size := 0, blockReservedSize
+
+	for {
+		var best *candidate
+		bestIdx := -1
+		var remaining []*Transaction
+
+		for _, tx := range pending {
+			if tx.IsCoinbase() {
+				continue
+			}
+
+			var err error
+			c := ready[tx]
+			if c != nil {
+				err = view.checkUnspent(tx)
+			} else {
+				var fee int
+				var isReady bool
+				if fee, isReady, err = chain.candidateFee(view, tx, medianTime); isReady {
+					c = &candidate{tx, fee, len(tx.Serialize())}
+					ready[tx] = c
+				}
+			}
+			if err != nil {
+				fmt.Printf("Skipping transaction %x: %s\n", tx.ID, err)
+				continue
+			}
+
+			remaining = append(remaining, tx)
+			if c == nil || size+c.size > MaxBlockSize {
+				continue
+			}
+			if _, ok := addMoney(fees, c.fee); !ok {
+				continue
+			}
+
+			// fee/size 比较改写为交叉相乘，避免浮点数
+			if best == nil || c.fee*best.size > best.fee*c.size {
+				best = c
+				bestIdx = len(remaining) - 1
+			}
+		}
+
+		if best == nil {
+			break
+		}
+
+		view.add(best.tx)
+		selected = append(selected, best.tx)
+		fees += best.fee
+		size += best.size
+
+		pending = append(remaining[:bestIdx], remaining[bestIdx+1:]...)
+	}
+
+	return selected, fees
+}
+
+// candidateFee 用 checkInputs 检查待打包的交易并计算手续费。输入花费的输出还不在 view 中时 ready 为 false，
+// 可能花费的是内存池中还没有被选中的交易；交易无法打包时返回错误。
+func (chain *BlockChain) candidateFee(view *blockView, tx *Transaction, medianTime int64) (int, bool, error) {
+	if err := checkTransactionSanity(tx); err != nil {
+		return 0, false, err
+	}
+
+	fee, coinHeights, err := checkInputs(tx, view.height, view.lookup)
+	if errors.Is(err, ErrMissingInput) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	if err := chain.checkLockTimes(tx, coinHeights, view.height, medianTime); err != nil {
+		return 0, false, err
+	}
+
+	return fee, true, nil
+}
+
+// checkUnspent 检查 tx 花费的输出没有被已经加入 view 的交易花费
+func (v *blockView) checkUnspent(tx *Transaction) error {
+	for _, in := range tx.Inputs {
+		if outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out); v.spent[outpoint] {
+			return fmt.Errorf("%w: %s", ErrDoubleSpend, outpoint)
+		}
+	}
+
+	return nil
+}
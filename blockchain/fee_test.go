@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestSelectTransactions(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+
+	var coinbases []*Transaction
+	for i := 0; i < 3; i++ {
+		coinbases = append(coinbases, mineBlocks(t, chain, address, 1).Transactions[0])
+	}
+	mineBlocks(t, chain, address, ChainParams.CoinbaseMaturity)
+
+	script := coinbases[0].Outputs[0].ScriptPubKey
+	value := coinbases[0].Outputs[0].Value
+	spend := func(prev *Transaction, fee int) *Transaction {
+		return spendTx(t, chain, w, []TxInput{{ID: prev.ID, Out: 0}}, []TxOutput{{prev.Outputs[0].Value - fee, script}})
+	}
+
+	low := spend(coinbases[0], 1)
+	high := spend(coinbases[1], 5)
+	conflict := spend(coinbases[1], 3) // 与 high 花费同一个输出，手续费更低
+	// child 花费还没有打包的 low 的输出，SignTransaction 在交易索引中找不到 low，所以直接用 SignInput 签名
+	child := &Transaction{Inputs: []TxInput{{low.ID, 0, nil, SequenceFinal}}, Outputs: []TxOutput{{value - 3, script}}}
+	child.ID = child.Hash()
+	if err := child.SignInput(&w.PrivateKey, 0, *low, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	overflow := spendTx(t, chain, w, []TxInput{{ID: coinbases[2].ID, Out: 0}}, []TxOutput{{MaxMoney + 1, script}})
+
+	tip, err := chain.GetHeader(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	medianTime, err := chain.medianTimePast(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// child 排在 low 前面，要等 low 被选中之后才能选中
+	selected, fees := chain.selectTransactions([]*Transaction{child, overflow, conflict, low, high}, tip.Height+1, medianTime)
+
+	want := []*Transaction{high, low, child}
+	if len(selected) != len(want) {
+		t.Fatalf("selected %d transactions, want %d", len(selected), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(selected[i].ID, want[i].ID) {
+			t.Errorf("selected[%d] = %x, want %x", i, selected[i].ID, want[i].ID)
+		}
+	}
+	if fees != 5+1+2 {
+		t.Errorf("fees = %d, want 8", fees)
+	}
+
+	block, err := chain.MineBlock(context.Background(), address, []*Transaction{child, conflict, low, high})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := totalOutput(block.Transactions[0]); got != ChainParams.BlockSubsidy(block.Height)+fees {
+		t.Errorf("coinbase pays %d, want subsidy plus %d fees", got, fees)
+	}
+}
@@ -0,0 +1,251 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+区块头包含所有共识字段，工作量证明只对区块头做哈希，交易通过 MerkleRoot 间接被承诺。
+区块头单独存储在 hdr- 前缀下，查询高度、tip 和祖先关系时不需要反序列化整个区块；
+节点同步时也可以先用 getheaders 下载区块头，再下载区块内容。
+*/
+
+const (
+	// MaxHeadersPerMsg 是一条 headers 消息最多包含的区块头数量
+	MaxHeadersPerMsg = 2000
+	// MaxLocatorHashes 是 locator 最多包含的区块哈希数量，BlockLocator 返回的 locator 远远少于这个数量
+	MaxLocatorHashes = 101
+)
+
+var (
+	headerPrefix = []byte("hdr-") // hdr-<hash> -> 区块头
+	heightPrefix = []byte("hgt-") // hgt-<height> -> 主链上该高度的区块哈希
+)
+
+type BlockHeader struct {
+	Timestamp  int64
+	PrevHash   []byte
+	MerkleRoot []byte // 区块中所有交易构成的默克尔树的根
+	Height     int
+	Bits       uint32 // 压缩格式的工作量证明目标值
+	Nonce      int
+}
+
+// ComputeHash 计算区块头的哈希，也就是区块哈希：区块头规范编码的 SHA-256
+func (h *BlockHeader) ComputeHash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+
+	return hash[:]
+}
+
+// Serialize 返回区块头的规范二进制编码（见 encoding.go），工作量证明对它做哈希
+func (h *BlockHeader) Serialize() []byte {
+	var e encoder
+	h.encode(&e)
+
+	return e.buf
+}
+
+func DeserializeHeader(data []byte) *BlockHeader {
+	header, err := DecodeHeader(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return header
+}
+
+// DecodeHeader 与 DeserializeHeader 相同，但数据格式错误时返回 ErrBadEncoding
+func DecodeHeader(data []byte) (*BlockHeader, error) {
+	var header BlockHeader
+	d := decoder{data: data}
+	header.decode(&d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerPrefix...), hash...)
+}
+
+func heightKey(height int) []byte {
+	key := append([]byte{}, heightPrefix...)
+	return binary.BigEndian.AppendUint64(key, uint64(height))
+}
+
+func getHeader(txn *badger.Txn, hash []byte) (*BlockHeader, error) {
+	item, err := txn.Get(headerKey(hash))
+	if err != nil {
+		return nil, fmt.Errorf("header of block %x: %w", hash, err)
+	}
+	var header *BlockHeader
+	err = item.Value(func(val []byte) error {
+		header, err = DecodeHeader(val)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("header of block %x: %w", hash, err)
+	}
+
+	return header, nil
+}
+
+// putHeader 保存区块头和累计工作量，父区块头必须已经存在（创世块除外）
+func putHeader(txn *badger.Txn, hash []byte, header *BlockHeader) (*big.Int, error) {
+	work := BlockWork(header)
+	if len(header.PrevHash) > 0 {
+		parentWork, err := getChainWork(txn, header.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, parentWork)
+	}
+
+	if err := txn.Set(headerKey(hash), header.Serialize()); err != nil {
+		return nil, err
+	}
+	if err := txn.Set(chainWorkKey(hash), work.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return work, nil
+}
+
+func getMainChainHash(txn *badger.Txn, height int) ([]byte, error) {
+	item, err := txn.Get(heightKey(height))
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func (chain *BlockChain) GetHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		header, err = getHeader(txn, hash)
+		return err
+	})
+
+	return header, err
+}
+
+func (chain *BlockChain) HasHeader(hash []byte) bool {
+	if len(hash) == 0 {
+		return false
+	}
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(headerKey(hash))
+		return err
+	})
+
+	return err == nil
+}
+
+// AddHeader 验证并保存一个区块头（headers-first 同步），区块内容稍后通过 getdata 下载
+func (chain *BlockChain) AddHeader(header *BlockHeader) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	hash := header.ComputeHash()
+	if chain.HasHeader(hash) {
+		return nil
+	}
+	if err := chain.ValidateHeader(header, hash); err != nil {
+		return err
+	}
+
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		_, err := putHeader(txn, hash, header)
+		return err
+	})
+}
+
+// BlockLocator 返回主链上从 tip 开始、间隔逐渐加倍的区块哈希列表，最后一个总是创世块。
+// 对方根据 locator 找到双方共同的最近区块，再把之后的区块头发送过来。
+func (chain *BlockChain) BlockLocator() ([][]byte, error) {
+	var locator [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		tip, err := getHeader(txn, chain.Tip())
+		if err != nil {
+			return err
+		}
+
+		step := 1
+		for height := tip.Height; height > 0; height -= step {
+			hash, err := getMainChainHash(txn, height)
+			if err != nil {
+				return err
+			}
+			locator = append(locator, hash)
+			if len(locator) >= 10 {
+				step *= 2
+			}
+		}
+
+		genesis, err := getMainChainHash(txn, 0)
+		if err != nil {
+			return err
+		}
+		locator = append(locator, genesis)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("block locator: %w", err)
+	}
+
+	return locator, nil
+}
+
+// HeadersAfter 找到 locator 中第一个位于本地主链上的区块，返回它之后最多 2000 个主链区块头
+func (chain *BlockChain) HeadersAfter(locator [][]byte) ([]*BlockHeader, error) {
+	var headers []*BlockHeader
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		start := 0
+		for _, hash := range locator {
+			header, err := getHeader(txn, hash)
+			if err != nil {
+				continue
+			}
+			mainHash, err := getMainChainHash(txn, header.Height)
+			if err == nil && bytes.Equal(mainHash, hash) {
+				start = header.Height + 1
+				break
+			}
+		}
+
+		for height := start; len(headers) < MaxHeadersPerMsg; height++ {
+			hash, err := getMainChainHash(txn, height)
+			if err == badger.ErrKeyNotFound {
+				break
+			} else if err != nil {
+				return err
+			}
+			header, err := getHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("headers after locator: %w", err)
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+交易的锁定时间。
+
+绝对锁定时间 Transaction.LockTime：
+  0 表示不锁定；小于 LockTimeThreshold 时是区块高度，否则是 Unix 时间戳。
+  交易只能被打包进高度大于 LockTime 的区块，或者父区块的 median time past 大于 LockTime 的区块
+  （使用 median time past 而不是区块时间戳，矿工不能通过修改时间戳提前打包交易）。
+  所有输入的 Sequence 都是 SequenceFinal 时不检查 LockTime。
+
+相对锁定时间 TxInput.Sequence：
+  编码和计算方法与比特币 BIP68 相同，但交易没有版本号，这里对所有非 coinbase 交易的每个输入都检查，
+  比特币只检查版本号不小于 2 的交易。SequenceLockTimeDisabled 位为 1 时不锁定，否则低 16 位是锁定的值：
+  - SequenceLockTimeIsSeconds 位为 0 时单位是区块：区块高度 >= 被花费输出所在区块的高度 + 值
+  - SequenceLockTimeIsSeconds 位为 1 时单位是 512 秒：
+    父区块的 median time past >= 被花费输出所在区块的父区块的 median time past + 值 * 512
+  Sequence 为 0 的输入锁定 0 个区块，被花费的输出一旦在主链上就可以花费。
+
+脚本中的 OP_CHECKLOCKTIMEVERIFY 和 OP_CHECKSEQUENCEVERIFY 分别要求 LockTime 和 Sequence 不小于脚本中的值（见 script.go），
+这两个字段都被签名覆盖，所以签名后不能修改。
+*/
+
+const (
+	// LockTimeThreshold 以下的 LockTime 是区块高度，以上是 Unix 时间戳
+	LockTimeThreshold = 500000000
+
+	SequenceFinal               = 0xffffffff
+	SequenceLockTimeDisabled    = 1 << 31
+	SequenceLockTimeIsSeconds   = 1 << 22
+	SequenceLockTimeMask        = 0x0000ffff
+	SequenceLockTimeGranularity = 9
+)
+
+var (
+	ErrNonFinalTx   = errors.New("transaction lock time has not been reached")
+	ErrSequenceLock = errors.New("transaction input relative lock time has not been reached")
+)
+
+// IsFinal 判断交易能否打包进高度为 height、父区块 median time past 为 medianTime 的区块
+func (tx *Transaction) IsFinal(height int, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	cutoff := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		cutoff = medianTime
+	}
+	if int64(tx.LockTime) < cutoff {
+		return true
+	}
+
+	for _, in := range tx.Inputs {
+		if in.Sequence != SequenceFinal {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkLockTimes 检查交易能否打包进高度为 height、父区块 median time past 为 medianTime 的区块，
+// coinHeights[i] 是第 i 个输入花费的输出所在区块的高度，调用时这些区块必须在主链上
+func (chain *BlockChain) checkLockTimes(tx *Transaction, coinHeights []int, height int, medianTime int64) error {
+	if !tx.IsFinal(height, medianTime) {
+		return fmt.Errorf("%w: lock time %d at height %d, median time %d", ErrNonFinalTx, tx.LockTime, height, medianTime)
+	}
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for i, in := range tx.Inputs {
+		if in.Sequence&SequenceLockTimeDisabled != 0 {
+			continue
+		}
+		value := int64(in.Sequence & SequenceLockTimeMask)
+
+		if in.Sequence&SequenceLockTimeIsSeconds == 0 {
+			if int64(height) < int64(coinHeights[i])+value {
+				return fmt.Errorf("%w: input %d spends output from height %d, locked for %d blocks", ErrSequenceLock, i, coinHeights[i], value)
+			}
+			continue
+		}
+
+		coinTime, err := chain.mainChainMedianTime(coinHeights[i] - 1)
+		if err != nil {
+			return err
+		}
+		if medianTime < coinTime+value<<SequenceLockTimeGranularity {
+			return fmt.Errorf("%w: input %d locked until median time %d", ErrSequenceLock, i, coinTime+value<<SequenceLockTimeGranularity)
+		}
+	}
+
+	return nil
+}
+
+// CheckFinalTx 检查交易的绝对和相对锁定时间是否允许它进入下一个区块，内存池接收交易时使用。
+// 输入花费的输出不在 UTXO 集合中时（例如花费内存池中的交易）按下一个区块中的输出处理
+func (chain *BlockChain) CheckFinalTx(tx *Transaction) error {
+	tip, err := chain.GetHeader(chain.Tip())
+	if err != nil {
+		return err
+	}
+	medianTime, err := chain.medianTimePast(tip)
+	if err != nil {
+		return err
+	}
+
+	UTXOSet := UTXOSet{chain}
+	coinHeights := make([]int, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		coinHeights[i] = tip.Height + 1
+		outs, ok, err := UTXOSet.FindOutputs(in.ID)
+		if err != nil {
+			return err
+		}
+		if ok && !tx.IsCoinbase() {
+			coinHeights[i] = outs.Height
+		}
+	}
+
+	return chain.checkLockTimes(tx, coinHeights, tip.Height+1, medianTime)
+}
+
+// mainChainMedianTime 返回主链上高度为 height 的区块的 median time past，height 小于 0 时使用创世块
+func (chain *BlockChain) mainChainMedianTime(height int) (int64, error) {
+	if height < 0 {
+		height = 0
+	}
+
+	var header *BlockHeader
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		hash, err := getMainChainHash(txn, height)
+		if err != nil {
+			return fmt.Errorf("main chain block at height %d: %w", height, err)
+		}
+		header, err = getHeader(txn, hash)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return chain.medianTimePast(header)
+}
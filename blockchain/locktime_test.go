@@ -0,0 +1,64 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// 交易没有版本号，相对锁定时间对每个输入都检查；Sequence 为 0 表示锁定 0 个区块，不影响花费
+func TestCheckLockTimesSequence(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+	coin := mineBlocks(t, chain, address, 1).Transactions[0]
+	mineBlocks(t, chain, address, ChainParams.CoinbaseMaturity)
+	out := coin.Outputs[0]
+
+	tests := []struct {
+		name     string
+		sequence uint32
+		want     error
+	}{
+		{"zero", 0, nil},
+		{"final", SequenceFinal, nil},
+		{"disabled", SequenceLockTimeDisabled | 100, nil},
+		{"blocks already passed", uint32(ChainParams.CoinbaseMaturity), nil},
+		{"blocks not passed", 100, ErrSequenceLock},
+		{"zero seconds", SequenceLockTimeIsSeconds, nil},
+		{"seconds not passed", SequenceLockTimeIsSeconds | 100, ErrSequenceLock},
+	}
+
+	for _, tt := range tests {
+		tx := &Transaction{
+			Inputs:  []TxInput{{coin.ID, 0, nil, tt.sequence}},
+			Outputs: []TxOutput{{out.Value - 1, out.ScriptPubKey}},
+		}
+		tx.ID = tx.Hash()
+		chain.SignTransaction(tx, &w.PrivateKey)
+
+		err := chain.CheckFinalTx(tx)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Sequence 为 0 的交易可以进入内存池并打包进下一个区块
+	tx := &Transaction{
+		Inputs:  []TxInput{{coin.ID, 0, nil, 0}},
+		Outputs: []TxOutput{{out.Value - 1, out.ScriptPubKey}},
+	}
+	tx.ID = tx.Hash()
+	chain.SignTransaction(tx, &w.PrivateKey)
+	if _, err := chain.CheckTransaction(tx, noPoolTx); err != nil {
+		t.Fatalf("CheckTransaction: %v", err)
+	}
+	block, err := chain.MineBlock(context.Background(), address, []*Transaction{tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 {
+		t.Errorf("mined block has %d transactions, want the coinbase and the spend with sequence 0", len(block.Transactions))
+	}
+}
@@ -1,6 +1,10 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
@@ -12,6 +16,16 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// MerkleProof 证明某笔交易包含在区块中：
+// TxHash 是交易的 FullHash（默克尔树的叶子），Hashes 是从叶子到根路径上每一层兄弟节点的哈希，Index 是交易在区块中的位置，
+// Index 的第 i 位表示第 i 层当前节点是左孩子（0）还是右孩子（1）。
+type MerkleProof struct {
+	TxID   []byte
+	TxHash []byte
+	Index  int
+	Hashes [][]byte
+}
+
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
 
@@ -19,7 +33,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 		hash := sha256.Sum256(data)
 		node.Data = hash[:]
 	} else {
-		prevHashes := append(left.Data, right.Data...)
+		prevHashes := append(append([]byte{}, left.Data...), right.Data...)
 		hash := sha256.Sum256(prevHashes)
 		node.Data = hash[:]
 	}
@@ -30,30 +44,92 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
+// NewMerkleTree 自底向上构建默克尔树，每一层节点数为奇数时复制最后一个节点补齐
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
-
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	if len(data) == 0 {
+		return &MerkleTree{NewMerkleNode(nil, nil, nil)}
 	}
 
+	var nodes []*MerkleNode
+
 	for _, dat := range data {
-		node := NewMerkleNode(nil, nil, dat)
-		nodes = append(nodes, *node)
+		nodes = append(nodes, NewMerkleNode(nil, nil, dat))
 	}
 
-	for i := 0; i < len(data)/2; i++ {
-		var level []MerkleNode
+	for len(nodes) > 1 {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
 
+		var level []*MerkleNode
 		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			level = append(level, *node)
+			level = append(level, NewMerkleNode(nodes[j], nodes[j+1], nil))
 		}
 
 		nodes = level
 	}
 
-	tree := MerkleTree{&nodes[0]}
+	return &MerkleTree{nodes[0]}
+}
+
+// Proof 生成第 index 个叶子的包含证明。
+// 因为每一层都补齐成偶数，树的每条路径长度相同，可以直接按 index 的二进制位从根走到叶子。
+func (t *MerkleTree) Proof(index int) [][]byte {
+	depth := 0
+	for node := t.RootNode; node.Left != nil; node = node.Left {
+		depth++
+	}
+
+	hashes := make([][]byte, depth)
+	node := t.RootNode
+	for level := depth - 1; level >= 0; level-- {
+		if (index>>level)&1 == 0 {
+			hashes[level] = node.Right.Data
+			node = node.Left
+		} else {
+			hashes[level] = node.Left.Data
+			node = node.Right
+		}
+	}
 
-	return &tree
-}
\ No newline at end of file
+	return hashes
+}
+
+// MerkleProof 为区块中的交易 txID 生成包含证明
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			tree := NewMerkleTree(b.txHashes())
+			return &MerkleProof{txID, tx.FullHash(), i, tree.Proof(i)}, nil
+		}
+	}
+
+	return nil, errors.New("Transaction is not in block")
+}
+
+// Verify 检查证明能否从交易的 FullHash 推导出区块头中的默克尔根。
+// 所有哈希都必须是 32 字节，否则 64 字节的 TxHash 可以是内部节点两个孩子的拼接，把内部节点冒充成叶子
+func (p *MerkleProof) Verify(merkleRoot []byte) bool {
+	if len(p.TxHash) != sha256.Size {
+		return false
+	}
+	for _, sibling := range p.Hashes {
+		if len(sibling) != sha256.Size {
+			return false
+		}
+	}
+
+	hash := sha256.Sum256(p.TxHash)
+	current := hash[:]
+
+	for level, sibling := range p.Hashes {
+		if (p.Index>>level)&1 == 0 {
+			hash = sha256.Sum256(append(append([]byte{}, current...), sibling...))
+		} else {
+			hash = sha256.Sum256(append(append([]byte{}, sibling...), current...))
+		}
+		current = hash[:]
+	}
+
+	return bytes.Equal(current, merkleRoot)
+}
@@ -0,0 +1,147 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// merkleLeaves 返回 n 个 32 字节的叶子，与区块中交易的 FullHash 长度相同
+func merkleLeaves(n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		leaf := sha256.Sum256([]byte(fmt.Sprintf("leaf %d", i)))
+		leaves = append(leaves, leaf[:])
+	}
+
+	return leaves
+}
+
+// sanityTx 创建一笔能通过 checkTransactionSanity 的交易，n 用来区分不同的交易
+func sanityTx(n int) *Transaction {
+	prev := sha256.Sum256([]byte{byte(n)})
+	tx := &Transaction{
+		Inputs:  []TxInput{{prev[:], 0, nil, SequenceFinal}},
+		Outputs: []TxOutput{{1, P2PKHScript(make([]byte, 20))}},
+	}
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+func TestMerkleProof(t *testing.T) {
+	// 包括每一层节点数为奇数、需要复制最后一个节点的情况
+	for n := 1; n <= 9; n++ {
+		leaves := merkleLeaves(n)
+		tree := NewMerkleTree(leaves)
+
+		for i := range leaves {
+			proof := MerkleProof{TxHash: leaves[i], Index: i, Hashes: tree.Proof(i)}
+			if !proof.Verify(tree.RootNode.Data) {
+				t.Errorf("%d leaves: proof for leaf %d does not verify", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofMutations(t *testing.T) {
+	leaves := merkleLeaves(5)
+	tree := NewMerkleTree(leaves)
+	root := tree.RootNode.Data
+
+	mutatedLeaves := merkleLeaves(5)
+	mutatedLeaves[3] = mutatedLeaves[4]
+	mutatedRoot := NewMerkleTree(mutatedLeaves).RootNode.Data
+
+	tests := []struct {
+		name   string
+		mutate func(p *MerkleProof)
+		root   []byte
+	}{
+		{"wrong leaf", func(p *MerkleProof) { p.TxHash = leaves[1] }, root},
+		{"wrong index", func(p *MerkleProof) { p.Index = 3 }, root},
+		{"flipped sibling hash", func(p *MerkleProof) {
+			p.Hashes[1] = append([]byte{}, p.Hashes[1]...)
+			p.Hashes[1][0] ^= 1
+		}, root},
+		{"missing level", func(p *MerkleProof) { p.Hashes = p.Hashes[:len(p.Hashes)-1] }, root},
+		{"extra level", func(p *MerkleProof) { p.Hashes = append(p.Hashes, root) }, root},
+		{"mutated tree", func(p *MerkleProof) {}, mutatedRoot},
+		// 叶子 2 和 3 的父节点冒充成叶子：TxHash 是两个孩子的拼接，路径从上一层开始
+		{"inner node as leaf", func(p *MerkleProof) {
+			inner := tree.RootNode.Left.Right
+			p.TxHash = append(append([]byte{}, inner.Left.Data...), inner.Right.Data...)
+			p.Index = 1
+			p.Hashes = p.Hashes[1:]
+		}, root},
+		{"short sibling hash", func(p *MerkleProof) { p.Hashes[0] = p.Hashes[0][:31] }, root},
+	}
+
+	for _, tt := range tests {
+		proof := MerkleProof{TxHash: leaves[2], Index: 2, Hashes: tree.Proof(2)}
+		tt.mutate(&proof)
+		if proof.Verify(tt.root) {
+			t.Errorf("%s: proof verifies", tt.name)
+		}
+	}
+}
+
+func TestBlockMerkleProof(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+
+	txs := []*Transaction{sanityTx(1), sanityTx(2), sanityTx(3)}
+	block := testBlock(t, chain, chain.Tip(), address, txs...)
+
+	for _, tx := range block.Transactions {
+		proof, err := block.MerkleProof(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proof.Verify(block.MerkleRoot) {
+			t.Errorf("proof for %x does not verify", tx.ID)
+		}
+	}
+
+	if _, err := block.MerkleProof(sanityTx(4).ID); err == nil {
+		t.Error("MerkleProof succeeded for a transaction that is not in the block")
+	}
+
+	// 默克尔树的叶子是 FullHash，修改解锁脚本不改变交易 ID，但证明不再有效
+	proof, err := block.MerkleProof(txs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := *txs[0]
+	signed.Inputs = []TxInput{{txs[0].Inputs[0].ID, 0, []byte{1}, SequenceFinal}}
+	if !bytes.Equal(signed.Hash(), txs[0].ID) {
+		t.Fatal("changing the unlocking script changed the transaction ID")
+	}
+	proof.TxHash = signed.FullHash()
+	if proof.Verify(block.MerkleRoot) {
+		t.Error("proof verifies after the unlocking script changed")
+	}
+}
+
+// 复制最后一笔交易后默克尔根不变（每一层补齐时本来就会复制最后一个节点），区块头和工作量证明仍然有效，
+// 这样的区块必须因为重复交易被拒绝，不能让节点把原区块当作无效区块
+func TestCheckBlockDuplicatedLastTransaction(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+
+	block := testBlock(t, chain, chain.Tip(), address, sanityTx(1), sanityTx(2))
+	if err := CheckBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	mutated := *block
+	mutated.Transactions = append(append([]*Transaction{}, block.Transactions...), block.Transactions[2])
+	if !bytes.Equal(mutated.HashTransactions(), block.MerkleRoot) {
+		t.Fatal("duplicating the last transaction changed the merkle root")
+	}
+	if err := CheckBlock(&mutated); !errors.Is(err, ErrDuplicateTx) {
+		t.Errorf("CheckBlock: got %v, want ErrDuplicateTx", err)
+	}
+}
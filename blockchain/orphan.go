@@ -0,0 +1,108 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"time"
+)
+
+/*
+孤块：父区块还没有收到的区块。
+孤块通过了与上下文无关的检查（包括工作量证明），先保存在内存中，父区块加入区块链后（AddBlock）再处理。
+孤块池最多保存 maxOrphanBlocks 个、总共 maxOrphanBytes 字节的区块，满了时删除最早收到的孤块；
+超过 orphanBlockExpiry 的孤块也会被删除，节点会通过 getheaders 重新下载需要的区块。
+*/
+
+const (
+	maxOrphanBlocks   = 100
+	maxOrphanBytes    = 16 << 20
+	orphanBlockExpiry = time.Hour
+)
+
+type orphanBlock struct {
+	block   *Block
+	size    int
+	expires time.Time
+}
+
+// orphanPool 保存孤块，由 BlockChain.mu 保护
+type orphanPool struct {
+	byPrev map[string][]*orphanBlock // key 为父区块哈希
+	order  []*orphanBlock            // 按收到的顺序
+	bytes  int
+}
+
+// remove 从孤块池中删除 o
+func (pool *orphanPool) remove(o *orphanBlock) {
+	prevHash := hex.EncodeToString(o.block.PrevHash)
+	siblings := pool.byPrev[prevHash]
+	for i, sibling := range siblings {
+		if sibling == o {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(pool.byPrev, prevHash)
+	} else {
+		pool.byPrev[prevHash] = siblings
+	}
+
+	for i, other := range pool.order {
+		if other == o {
+			pool.order = append(pool.order[:i], pool.order[i+1:]...)
+			break
+		}
+	}
+	pool.bytes -= o.size
+}
+
+// expire 删除过期的孤块
+func (pool *orphanPool) expire(now time.Time) {
+	for len(pool.order) > 0 && now.After(pool.order[0].expires) {
+		pool.remove(pool.order[0])
+	}
+}
+
+// addOrphan 保存孤块，超过 maxOrphanBytes 的区块不保存
+func (chain *BlockChain) addOrphan(block *Block) {
+	pool := &chain.orphans
+	if pool.byPrev == nil {
+		pool.byPrev = make(map[string][]*orphanBlock)
+	}
+
+	prevHash := hex.EncodeToString(block.PrevHash)
+	for _, o := range pool.byPrev[prevHash] {
+		if string(o.block.Hash) == string(block.Hash) {
+			return
+		}
+	}
+	size := len(block.Serialize())
+	if size > maxOrphanBytes {
+		return
+	}
+
+	now := time.Now()
+	pool.expire(now)
+	for len(pool.order) >= maxOrphanBlocks || pool.bytes+size > maxOrphanBytes {
+		pool.remove(pool.order[0])
+	}
+
+	o := &orphanBlock{block, size, now.Add(orphanBlockExpiry)}
+	pool.byPrev[prevHash] = append(pool.byPrev[prevHash], o)
+	pool.order = append(pool.order, o)
+	pool.bytes += size
+}
+
+// takeOrphans 取出父区块是 parentHash 并且没有过期的孤块
+func (chain *BlockChain) takeOrphans(parentHash []byte) []*Block {
+	pool := &chain.orphans
+	pool.expire(time.Now())
+
+	var blocks []*Block
+	for _, o := range append([]*orphanBlock{}, pool.byPrev[hex.EncodeToString(parentHash)]...) {
+		blocks = append(blocks, o.block)
+		pool.remove(o)
+	}
+
+	return blocks
+}
@@ -0,0 +1,62 @@
+package blockchain
+
+import "math/big"
+
+// MaxMoney 是任何金额的上限：单个输出、交易的输入和输出总额、区块的手续费总额和 coinbase 输出总额都不能超过它。
+// 参与求和的金额都不超过 MaxMoney，所以相加不会溢出
+const MaxMoney = 21000000 * 100000000
+
+// Params 是可以调整的共识参数，所有节点必须使用相同的参数
+type Params struct {
+	PowLimitBits      uint  `json:"pow_limit_bits"`     // 最低难度：目标值至少有多少个前导零位
+	InitialDifficulty uint  `json:"initial_difficulty"` // 创世块目标值的前导零位数
+	RetargetInterval  int   `json:"retarget_interval"`  // 每隔多少个区块调整一次难度
+	TargetSpacing     int64 `json:"target_spacing"`     // 期望的出块间隔（秒）
+
+	InitialSubsidy         int `json:"initial_subsidy"`          // 创世块开始每个区块的奖励
+	SubsidyHalvingInterval int `json:"subsidy_halving_interval"` // 每隔多少个区块奖励减半
+	CoinbaseMaturity       int `json:"coinbase_maturity"`        // coinbase 输出至少要经过多少个区块才能花费
+}
+
+// ChainParams 是当前使用的共识参数，节点启动时可以由配置文件覆盖
+var ChainParams = Params{
+	PowLimitBits:      8,
+	InitialDifficulty: 12,
+	RetargetInterval:  10,
+	TargetSpacing:     10,
+
+	InitialSubsidy:         20,
+	SubsidyHalvingInterval: 210,
+	CoinbaseMaturity:       5,
+}
+
+// PowLimit 返回允许的最大目标值（最低难度）
+func (p Params) PowLimit() *big.Int {
+	return maxTarget(p.PowLimitBits)
+}
+
+// InitialBits 返回创世块使用的压缩格式目标值。与 PowLimit 使用同样的形式，
+// InitialDifficulty 等于 PowLimitBits 时创世块的目标值正好是最低难度
+func (p Params) InitialBits() uint32 {
+	return BigToCompact(maxTarget(p.InitialDifficulty))
+}
+
+// maxTarget 返回至少有 zeroBits 个前导零位的最大目标值 2^(256-zeroBits)-1
+func maxTarget(zeroBits uint) *big.Int {
+	target := new(big.Int).Lsh(big.NewInt(1), 256-zeroBits)
+	return target.Sub(target, big.NewInt(1))
+}
+
+// BlockSubsidy 返回高度为 height 的区块可以新发行的奖励，每 SubsidyHalvingInterval 个区块减半
+func (p Params) BlockSubsidy(height int) int {
+	if p.SubsidyHalvingInterval <= 0 {
+		return p.InitialSubsidy
+	}
+
+	halvings := height / p.SubsidyHalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return p.InitialSubsidy >> uint(halvings)
+}
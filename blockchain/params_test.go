@@ -0,0 +1,46 @@
+package blockchain
+
+import "testing"
+
+// 创世块的目标值不能超过 PowLimit，否则创世块之后的区块都无法通过 CheckHeader
+func TestInitialBitsWithinPowLimit(t *testing.T) {
+	tests := []struct {
+		powLimitBits, initialDifficulty uint
+	}{
+		{8, 8},
+		{8, 12},
+		{1, 1},
+		{20, 20},
+		{16, 24},
+	}
+
+	for _, tt := range tests {
+		params := Params{PowLimitBits: tt.powLimitBits, InitialDifficulty: tt.initialDifficulty}
+		target := CompactToBig(params.InitialBits())
+		if target.Sign() <= 0 || target.Cmp(params.PowLimit()) > 0 {
+			t.Errorf("pow limit %d, initial difficulty %d: target %064x exceeds limit %064x",
+				tt.powLimitBits, tt.initialDifficulty, target, params.PowLimit())
+		}
+	}
+}
+
+func TestBlockSubsidy(t *testing.T) {
+	params := Params{InitialSubsidy: 20, SubsidyHalvingInterval: 10}
+	tests := []struct {
+		height, want int
+	}{
+		{0, 20},
+		{9, 20},
+		{10, 10},
+		{25, 5},
+		{40, 1},
+		{50, 0},
+		{10 * 64, 0},
+	}
+
+	for _, tt := range tests {
+		if got := params.BlockSubsidy(tt.height); got != tt.want {
+			t.Errorf("BlockSubsidy(%d) = %d, want %d", tt.height, got, tt.want)
+		}
+	}
+}
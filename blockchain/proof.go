@@ -1,13 +1,16 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
-	"encoding/binary"
-	"fmt"
+	"errors"
 	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Take the data from the block
@@ -21,62 +24,221 @@ import (
 // Requirements
 // The First few biytes must contain 0s
 
-const Difficulty = 12
+// 目标值（target）保存在每个区块头的 Bits 字段中（与比特币相同的压缩格式），
+// 难度每隔 ChainParams.RetargetInterval 个区块根据实际出块时间调整一次。
 
 type ProofOfWork struct {
-	Block *Block
+	Header *BlockHeader
 	Target *big.Int
+
+	Hashes  uint64        // 最近一次挖矿计算的哈希次数
+	Elapsed time.Duration // 最近一次挖矿的耗时
 }
 
-func NewProof(b *Block) *ProofOfWork{
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256 - Difficulty))
-	pow := &ProofOfWork{b, target}
+func NewProof(h *BlockHeader) *ProofOfWork{
+	target := CompactToBig(h.Bits)
+	pow := &ProofOfWork{Header: h, Target: target}
 	return pow
 } 
 
+// InitData 返回 nonce 为 nonce 时区块头的规范编码，作为工作量证明的哈希输入
 func (pow *ProofOfWork)InitData(nonce int) []byte {
-	data := bytes.Join([][]byte{
-		pow.Block.PrevHash, 
-		pow.Block.HashTransactions(),
-		ToHex(int64(nonce)),
-		ToHex(int64(Difficulty)),
-		}, []byte{})
-	return data
+	header := *pow.Header
+	header.Nonce = nonce
+
+	return header.Serialize()
 }
 
+// Run 挖矿直到找到满足目标值的 nonce，不能被中断
 func (pow *ProofOfWork)Run() (int, []byte){
-	var intHash big.Int
-	var hash [32]byte
-	nonce :=0
-	for nonce < math.MaxInt64{
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		}else {
-			nonce++
-		}
+	nonce, hash, err := pow.Mine(context.Background())
+	if err != nil {
+		log.Panic(err)
 	}
-	fmt.Println()
-	return nonce, hash[:]
+	return nonce, hash
+}
+
+// Mine 把 nonce 空间分给每个 CPU 核心上的 goroutine 并行搜索：
+// 第 i 个 goroutine 依次尝试 i, i+n, i+2n ...（n 为 goroutine 数量）。
+// 任意一个 goroutine 找到结果后其余的立即停止；ctx 被取消（例如收到了新的区块）时返回 ctx.Err()。
+// 挖矿结束后 Hashes 和 Elapsed 记录本次计算的哈希次数和耗时，用于统计算力。
+func (pow *ProofOfWork) Mine(ctx context.Context) (int, []byte, error) {
+	type result struct {
+		nonce int
+		hash  []byte
+	}
+
+	workers := runtime.NumCPU()
+	found := make(chan result, 1)
+	var hashes atomic.Uint64
+	var wg sync.WaitGroup
+
+	mineCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(nonce int) {
+			defer wg.Done()
+
+			var intHash big.Int
+			var count uint64
+			defer func() { hashes.Add(count) }()
+
+			for ; nonce <= math.MaxInt64-workers; nonce += workers {
+				if count%1024 == 0 && mineCtx.Err() != nil {
+					return
+				}
+
+				hash := sha256.Sum256(pow.InitData(nonce))
+				count++
+				intHash.SetBytes(hash[:])
+				if intHash.Cmp(pow.Target) == -1 {
+					select {
+					case found <- result{nonce, hash[:]}:
+					default:
+					}
+					cancel()
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	pow.Hashes = hashes.Load()
+	pow.Elapsed = time.Since(start)
+
+	select {
+	case res := <-found:
+		return res.nonce, res.hash, nil
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return 0, nil, errors.New("nonce space exhausted")
+}
+
+// Hashrate 返回最近一次挖矿每秒计算的哈希次数
+func (pow *ProofOfWork) Hashrate() float64 {
+	if pow.Elapsed <= 0 {
+		return 0
+	}
+	return float64(pow.Hashes) / pow.Elapsed.Seconds()
 }
 
 func (pow *ProofOfWork)Validate() bool {
 	 var intHash big.Int
-	 data := pow.InitData(pow.Block.Nonce)
+	 data := pow.InitData(pow.Header.Nonce)
 	 hash := sha256.Sum256(data)
 	 intHash.SetBytes(hash[:])
 	 return intHash.Cmp(pow.Target) == -1
 }
 
-func ToHex(num int64) []byte{
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
+// BlockWork 计算一个区块代表的工作量：2^256 / (target + 1)，
+// 累计工作量最大的分支就是主链。
+func BlockWork(h *BlockHeader) *big.Int {
+	pow := NewProof(h)
+	if pow.Target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(pow.Target, big.NewInt(1))
+
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// CompactToBig 把压缩格式的目标值转换为大整数。
+// 压缩格式：最高字节是指数（字节数），低 23 位是尾数，第 24 位是符号位。
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+
+	return bn
+}
+
+// BigToCompact 把大整数目标值转换为压缩格式，是 CompactToBig 的逆操作
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
 	}
-	return buff.Bytes()
-}
\ No newline at end of file
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(n).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Uint64())
+	}
+
+	// 尾数的最高位是符号位，被占用时把尾数右移一个字节
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// nextWorkRequired 计算 parent 之后下一个区块应该使用的目标值。
+// 在调整周期的边界上，用最近一个周期的实际耗时和期望耗时之比来调整目标值，
+// 每次调整幅度限制在 4 倍以内，并且不能低于最低难度。
+func (chain *BlockChain) nextWorkRequired(parent *BlockHeader) (uint32, error) {
+	params := ChainParams
+	height := parent.Height + 1
+
+	if params.RetargetInterval <= 0 || height%params.RetargetInterval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := parent
+	for i := 0; i < params.RetargetInterval-1 && len(first.PrevHash) > 0; i++ {
+		header, err := chain.GetHeader(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = header
+	}
+
+	expected := int64(params.RetargetInterval) * params.TargetSpacing
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if limit := params.PowLimit(); target.Cmp(limit) > 0 {
+		target = limit
+	}
+
+	return BigToCompact(target), nil
+}
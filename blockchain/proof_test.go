@@ -0,0 +1,165 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		compact uint32
+		target  *big.Int
+	}{
+		{0, big.NewInt(0)},
+		{0x03123456, big.NewInt(0x123456)},
+		{0x02008000, big.NewInt(0x80)},
+		{0x05009234, big.NewInt(0x92340000)},
+		{0x04923456, big.NewInt(-0x12345600)},
+		{0x1d00ffff, new(big.Int).Lsh(big.NewInt(0xffff), 8*(0x1d-3))},
+		{0x207fffff, new(big.Int).Lsh(big.NewInt(0x7fffff), 8*(0x20-3))},
+	}
+
+	for _, tt := range tests {
+		if got := CompactToBig(tt.compact); got.Cmp(tt.target) != 0 {
+			t.Errorf("CompactToBig(%08x) = %x, want %x", tt.compact, got, tt.target)
+		}
+		if got := BigToCompact(tt.target); got != tt.compact {
+			t.Errorf("BigToCompact(%x) = %08x, want %08x", tt.target, got, tt.compact)
+		}
+	}
+
+	// 压缩格式只保留 3 字节尾数，转换后的目标值不大于原值
+	for _, zeroBits := range []uint{4, 8, 12, 33, 200} {
+		target := maxTarget(zeroBits)
+		if got := CompactToBig(BigToCompact(target)); got.Cmp(target) > 0 || got.Sign() <= 0 {
+			t.Errorf("%d zero bits: compact target %x is not in (0, %x]", zeroBits, got, target)
+		}
+	}
+}
+
+// putTestHeaders 把 timestamps 对应的一串区块头直接写入数据库（不做验证），第一个区块头没有父区块，返回最后一个区块头
+func putTestHeaders(t *testing.T, chain *BlockChain, bits uint32, timestamps []int64) *BlockHeader {
+	t.Helper()
+
+	var header *BlockHeader
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		var prevHash []byte
+		for i, ts := range timestamps {
+			header = &BlockHeader{Timestamp: ts, PrevHash: prevHash, Height: i, Bits: bits}
+			prevHash = header.ComputeHash()
+			if _, err := putHeader(txn, prevHash, header); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return header
+}
+
+func TestNextWorkRequired(t *testing.T) {
+	chain, _ := newTestChain(t)
+	ChainParams.RetargetInterval = 4
+	ChainParams.TargetSpacing = 10
+	const expected = 4 * 10
+
+	bits := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 240))
+	target := CompactToBig(bits)
+	scaled := func(num, den int64) uint32 {
+		n := new(big.Int).Mul(target, big.NewInt(num))
+		return BigToCompact(n.Div(n, big.NewInt(den)))
+	}
+	limitBits := BigToCompact(ChainParams.PowLimit())
+
+	tests := []struct {
+		name     string
+		bits     uint32
+		interval int
+		actual   int64 // 调整周期第一个区块到父区块的时间
+		blocks   int   // 父区块之前（包括父区块）的区块个数
+		want     uint32
+	}{
+		{"not a retarget height", bits, 4, expected / 8, 3, bits},
+		{"retargeting disabled", bits, 0, expected / 8, 4, bits},
+		{"on schedule", bits, 4, expected, 4, bits},
+		{"twice as fast", bits, 4, expected / 2, 4, scaled(1, 2)},
+		{"twice as slow", bits, 4, expected * 2, 4, scaled(2, 1)},
+		{"clamped when too fast", bits, 4, expected / 10, 4, scaled(1, 4)},
+		{"clamped when too slow", bits, 4, expected * 10, 4, scaled(4, 1)},
+		{"time goes backwards", bits, 4, -expected, 4, scaled(1, 4)},
+		{"capped at pow limit", limitBits, 4, expected * 4, 4, limitBits},
+	}
+
+	for _, tt := range tests {
+		ChainParams.RetargetInterval = tt.interval
+
+		// 时间戳从 first 到 parent 均匀分布，只有两端影响结果
+		timestamps := make([]int64, tt.blocks)
+		for i := range timestamps {
+			timestamps[i] = 1000000 + tt.actual*int64(i)/int64(tt.blocks-1)
+		}
+		parent := putTestHeaders(t, chain, tt.bits, timestamps)
+
+		got, err := chain.nextWorkRequired(parent)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got %08x, want %08x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	chain, w := newTestChain(t)
+	block := testBlock(t, chain, chain.Tip(), string(w.Address()))
+	hardBits := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 200))
+
+	tests := []struct {
+		name   string
+		mutate func(h *BlockHeader, hash []byte) []byte
+		want   error
+	}{
+		{"valid", func(h *BlockHeader, hash []byte) []byte { return hash }, nil},
+		{"target above pow limit", func(h *BlockHeader, hash []byte) []byte {
+			h.Bits = BigToCompact(new(big.Int).Lsh(ChainParams.PowLimit(), 1))
+			return h.ComputeHash()
+		}, ErrBadDifficulty},
+		{"zero target", func(h *BlockHeader, hash []byte) []byte { h.Bits = 0; return h.ComputeHash() }, ErrBadDifficulty},
+		{"negative target", func(h *BlockHeader, hash []byte) []byte { h.Bits = 0x04923456; return h.ComputeHash() }, ErrBadDifficulty},
+		{"hash does not match", func(h *BlockHeader, hash []byte) []byte { h.Nonce++; return hash }, ErrBadBlockHash},
+		{"proof of work not met", func(h *BlockHeader, hash []byte) []byte { h.Bits = hardBits; return h.ComputeHash() }, ErrBadProofOfWork},
+	}
+
+	for _, tt := range tests {
+		header := block.BlockHeader
+		hash := tt.mutate(&header, block.Hash)
+		err := CheckHeader(&header, hash)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// 满足工作量证明但没有使用 nextWorkRequired 计算出的目标值
+	header := block.BlockHeader
+	header.Bits = BigToCompact(new(big.Int).Rsh(CompactToBig(block.Bits), 1))
+	nonce, hash, err := NewProof(&header).Mine(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Nonce = nonce
+	if err := chain.AddHeader(&header); !errors.Is(err, ErrBadDifficulty) {
+		t.Errorf("AddHeader with wrong bits: got %v, want ErrBadDifficulty", err)
+	}
+	if chain.HasHeader(hash) {
+		t.Error("header with wrong bits was stored")
+	}
+}
@@ -0,0 +1,92 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+启动时检查 UTXO 集合与主链 tip 是否一致。
+ConnectBlock 和 DisconnectBlock 在同一个事务中更新 UTXO 集合和 tip，UTXO 集合对应的区块记录在 utxoBestKey 中，
+正常情况下与 "lh" 相同。旧版本的数据库（区块和 UTXO 集合分两个事务写入）在两次写入之间退出时两者会不一致：
+  - 没有 utxoBestKey（旧数据库，或者 Reindex 删除旧数据时退出）：从主链重新生成 UTXO 集合
+  - utxoBestKey 与 "lh" 不同：用撤销数据把 UTXO 集合从它的区块回滚到两者的公共祖先，再连接到 tip；
+    缺少撤销数据等原因导致失败时从主链重新生成
+*/
+
+// utxoBestBlock 返回 UTXO 集合对应的区块，没有记录时返回 nil
+func (chain *BlockChain) utxoBestBlock() ([]byte, error) {
+	var best []byte
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoBestKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		best, err = item.ValueCopy(nil)
+		return err
+	})
+
+	return best, err
+}
+
+// repairUTXOSet 检查 UTXO 集合是否对应主链 tip，不一致时修复
+func (chain *BlockChain) repairUTXOSet() error {
+	best, err := chain.utxoBestBlock()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(best, chain.LastHash) {
+		return nil
+	}
+
+	UTXOSet := UTXOSet{chain}
+	if best == nil {
+		fmt.Println("UTXO set has no best block, rebuilding it from the chain")
+		return UTXOSet.Reindex()
+	}
+
+	fmt.Printf("UTXO set is at block %x but the tip is %x, repairing\n", best, chain.LastHash)
+	if err := chain.rollUTXOSet(best, chain.LastHash); err != nil {
+		fmt.Printf("Failed to repair UTXO set (%s), rebuilding it from the chain\n", err)
+		return UTXOSet.Reindex()
+	}
+
+	return nil
+}
+
+// rollUTXOSet 把 UTXO 集合从区块 from 移动到区块 to，不改变主链 tip，每个区块一个事务
+func (chain *BlockChain) rollUTXOSet(from, to []byte) error {
+	_, detachHashes, attachHashes, err := chain.findFork(from, to)
+	if err != nil {
+		return err
+	}
+	detach, err := chain.getBlocks(detachHashes)
+	if err != nil {
+		return err
+	}
+	attach, err := chain.getBlocks(attachHashes)
+	if err != nil {
+		return err
+	}
+
+	for _, block := range detach {
+		if err := chain.Database.Update(func(txn *badger.Txn) error {
+			return undoUTXO(txn, block)
+		}); err != nil {
+			return err
+		}
+	}
+	for i := len(attach) - 1; i >= 0; i-- {
+		if err := chain.Database.Update(func(txn *badger.Txn) error {
+			return connectUTXO(txn, attach[i])
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
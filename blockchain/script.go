@@ -0,0 +1,748 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"blockchain_go/wallet"
+)
+
+/*
+交易脚本。
+
+每个输出带有锁定脚本 ScriptPubKey，花费它的输入提供解锁脚本 ScriptSig。
+验证时先执行 ScriptSig，再用得到的栈执行 ScriptPubKey，执行结束后栈顶为真才算解锁成功。
+脚本是一串操作码，数据直接跟在压栈操作码后面：
+  0x00           OP_0，压入空字节串（表示假）
+  0x01-0x4b      后面 n 个字节作为数据压栈
+  OP_PUSHDATA1/2 后面是 1/2 字节（小端）的长度，然后是数据
+  OP_1-OP_16     压入数字 1-16
+数字按比特币的格式编码：小端、最短编码，最高字节的最高位是符号位。
+
+标准脚本：
+  P2PKH： OP_DUP OP_HASH160 <公钥哈希> OP_EQUALVERIFY OP_CHECKSIG
+          ScriptSig: <签名> <公钥>
+  多签：  OP_m <公钥1> ... <公钥n> OP_n OP_CHECKMULTISIG
+          ScriptSig: <签名1> ... <签名m>，签名的顺序必须与对应公钥的顺序相同
+  P2SH：  OP_HASH160 <赎回脚本哈希> OP_EQUAL
+          ScriptSig: <赎回脚本需要的数据> <赎回脚本>
+          ScriptPubKey 验证通过后，再用剩下的栈执行赎回脚本，地址的版本字节是 0x05
+  时间锁：<locktime> OP_CHECKLOCKTIMEVERIFY OP_DROP <其他条件>
+          交易的 LockTime 不小于 locktime 时才能花费（小于 LockTimeThreshold 表示高度，否则是时间戳）
+  相对时间锁：<sequence> OP_CHECKSEQUENCEVERIFY OP_DROP <其他条件>
+          输入的 Sequence 表示的相对锁定时间不小于 sequence 时才能花费（见 locktime.go）
+  数据：  OP_RETURN <最多 MaxDataCarrierSize 字节的数据>
+          执行到 OP_RETURN 脚本就失败，所以这种输出永远不能被花费，金额必须为 0，也不会进入 UTXO 集合
+
+与比特币不同，OP_CHECKMULTISIG 不会多弹出一个元素，ScriptSig 不需要以 OP_0 开头。
+ScriptSig 只能包含压栈操作。签名摘要中被签名输入的脚本是正在执行的脚本：
+普通输出是它的 ScriptPubKey，P2SH 输出是赎回脚本（见 sighash.go）。
+*/
+
+const (
+	Op0                   = 0x00
+	OpPushData1           = 0x4c
+	OpPushData2           = 0x4d
+	Op1                   = 0x51
+	Op16                  = 0x60
+	OpVerify              = 0x69
+	OpReturn              = 0x6a
+	OpDrop                = 0x75
+	OpDup                 = 0x76
+	OpEqual               = 0x87
+	OpEqualVerify         = 0x88
+	OpHash160             = 0xa9
+	OpCheckSig            = 0xac
+	OpCheckSigVerify      = 0xad
+	OpCheckMultiSig       = 0xae
+	OpCheckMultiSigVerify = 0xaf
+	OpCheckLockTimeVerify = 0xb1
+	OpCheckSequenceVerify = 0xb2
+)
+
+const (
+	maxScriptSize      = 10000
+	maxScriptElement   = 520
+	maxStackSize       = 1000
+	maxScriptOps       = 201
+	MaxMultisigPubKeys = 20
+	MaxDataCarrierSize = 80
+)
+
+var opNames = map[byte]string{
+	Op0:                   "OP_0",
+	OpPushData1:           "OP_PUSHDATA1",
+	OpPushData2:           "OP_PUSHDATA2",
+	OpVerify:              "OP_VERIFY",
+	OpReturn:              "OP_RETURN",
+	OpDrop:                "OP_DROP",
+	OpDup:                 "OP_DUP",
+	OpEqual:               "OP_EQUAL",
+	OpEqualVerify:         "OP_EQUALVERIFY",
+	OpHash160:             "OP_HASH160",
+	OpCheckSig:            "OP_CHECKSIG",
+	OpCheckSigVerify:      "OP_CHECKSIGVERIFY",
+	OpCheckMultiSig:       "OP_CHECKMULTISIG",
+	OpCheckMultiSigVerify: "OP_CHECKMULTISIGVERIFY",
+	OpCheckLockTimeVerify: "OP_CHECKLOCKTIMEVERIFY",
+	OpCheckSequenceVerify: "OP_CHECKSEQUENCEVERIFY",
+}
+
+var (
+	ErrBadScript           = errors.New("invalid script")
+	ErrScriptFailed        = errors.New("script evaluated to false")
+	ErrUnsatisfiedLockTime = errors.New("transaction lock time does not satisfy the script")
+)
+
+// pushData 把压栈 data 的操作追加到 script 后面，使用最短的压栈操作码
+func pushData(script, data []byte) []byte {
+	switch n := len(data); {
+	case n == 0:
+		return append(script, Op0)
+	case n == 1 && data[0] >= 1 && data[0] <= 16:
+		return append(script, Op1-1+data[0])
+	case n < OpPushData1:
+		script = append(script, byte(n))
+	case n <= 0xff:
+		script = append(script, OpPushData1, byte(n))
+	default:
+		script = append(script, OpPushData2)
+		script = binary.LittleEndian.AppendUint16(script, uint16(n))
+	}
+
+	return append(script, data...)
+}
+
+// readOp 读取 script 中从 pc 开始的一个操作，返回操作码、压栈的数据和下一个操作的位置
+func readOp(script []byte, pc int) (byte, []byte, int, error) {
+	op := script[pc]
+	pc++
+
+	var n int
+	switch {
+	case op > Op0 && op < OpPushData1:
+		n = int(op)
+	case op == OpPushData1:
+		if pc+1 > len(script) {
+			return 0, nil, 0, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrBadScript)
+		}
+		n = int(script[pc])
+		pc++
+	case op == OpPushData2:
+		if pc+2 > len(script) {
+			return 0, nil, 0, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrBadScript)
+		}
+		n = int(binary.LittleEndian.Uint16(script[pc:]))
+		pc += 2
+	default:
+		return op, nil, pc, nil
+	}
+
+	if pc+n > len(script) {
+		return 0, nil, 0, fmt.Errorf("%w: push of %d bytes past end of script", ErrBadScript, n)
+	}
+
+	return op, script[pc : pc+n], pc + n, nil
+}
+
+// scriptNumBytes 按脚本数字格式编码 n
+func scriptNumBytes(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	abs := n
+	if negative {
+		abs = -n
+	}
+
+	var b []byte
+	for abs > 0 {
+		b = append(b, byte(abs&0xff))
+		abs >>= 8
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		if negative {
+			b = append(b, 0x80)
+		} else {
+			b = append(b, 0x00)
+		}
+	} else if negative {
+		b[len(b)-1] |= 0x80
+	}
+
+	return b
+}
+
+// parseScriptNum 解析最长 maxLen 字节的脚本数字，必须是最短编码
+func parseScriptNum(b []byte, maxLen int) (int64, error) {
+	if len(b) > maxLen {
+		return 0, fmt.Errorf("%w: number of %d bytes exceeds %d", ErrBadScript, len(b), maxLen)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if b[len(b)-1]&0x7f == 0 && (len(b) == 1 || b[len(b)-2]&0x80 == 0) {
+		return 0, fmt.Errorf("%w: number %x is not minimally encoded", ErrBadScript, b)
+	}
+
+	var n int64
+	for i, v := range b {
+		n |= int64(v) << (8 * i)
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		n &^= int64(0x80) << (8 * (len(b) - 1))
+		n = -n
+	}
+
+	return n, nil
+}
+
+// asBool 把栈元素转换为布尔值：全 0（包括负 0）是假，其他都是真
+func asBool(b []byte) bool {
+	for i, v := range b {
+		if v != 0 {
+			return i != len(b)-1 || v != 0x80
+		}
+	}
+
+	return false
+}
+
+// scriptEngine 执行第 inIdx 个输入的脚本
+type scriptEngine struct {
+	tx     *Transaction
+	inIdx  int
+	stack  [][]byte
+	script []byte // 正在执行的脚本，用来计算签名摘要
+	ops    int
+}
+
+func (vm *scriptEngine) push(b []byte) {
+	vm.stack = append(vm.stack, b)
+}
+
+func (vm *scriptEngine) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", ErrBadScript)
+	}
+	top := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+
+	return top, nil
+}
+
+func (vm *scriptEngine) popInt(maxLen int) (int64, error) {
+	b, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return parseScriptNum(b, maxLen)
+}
+
+// success 判断脚本执行结束后栈顶是否为真
+func (vm *scriptEngine) success() bool {
+	return len(vm.stack) > 0 && asBool(vm.stack[len(vm.stack)-1])
+}
+
+func (vm *scriptEngine) execute(script []byte) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("%w: script of %d bytes is too large", ErrBadScript, len(script))
+	}
+	vm.script = script
+	vm.ops = 0
+
+	for pc := 0; pc < len(script); {
+		op, data, next, err := readOp(script, pc)
+		if err != nil {
+			return err
+		}
+		pc = next
+
+		if op > Op16 {
+			vm.ops++
+			if vm.ops > maxScriptOps {
+				return fmt.Errorf("%w: too many operations", ErrBadScript)
+			}
+		}
+
+		if err := vm.step(op, data); err != nil {
+			return err
+		}
+		if len(vm.stack) > maxStackSize {
+			return fmt.Errorf("%w: stack size exceeds %d", ErrBadScript, maxStackSize)
+		}
+	}
+
+	return nil
+}
+
+func (vm *scriptEngine) step(op byte, data []byte) error {
+	switch {
+	case op <= OpPushData2:
+		if len(data) > maxScriptElement {
+			return fmt.Errorf("%w: push of %d bytes exceeds %d", ErrBadScript, len(data), maxScriptElement)
+		}
+		vm.push(data)
+		return nil
+	case op >= Op1 && op <= Op16:
+		vm.push(scriptNumBytes(int64(op - Op1 + 1)))
+		return nil
+	}
+
+	switch op {
+	case OpVerify:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if !asBool(top) {
+			return fmt.Errorf("%w: OP_VERIFY", ErrScriptFailed)
+		}
+
+	case OpReturn:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+
+	case OpDrop:
+		if _, err := vm.pop(); err != nil {
+			return err
+		}
+
+	case OpDup:
+		if len(vm.stack) == 0 {
+			return fmt.Errorf("%w: stack underflow", ErrBadScript)
+		}
+		vm.push(vm.stack[len(vm.stack)-1])
+
+	case OpEqual, OpEqualVerify:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op == OpEqualVerify {
+			if !equal {
+				return fmt.Errorf("%w: OP_EQUALVERIFY", ErrScriptFailed)
+			}
+			return nil
+		}
+		vm.push(boolBytes(equal))
+
+	case OpHash160:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.push(wallet.PublicKeyHash(top))
+
+	case OpCheckSig, OpCheckSigVerify:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		valid := vm.checkSig(sig, pubKey)
+		if op == OpCheckSigVerify {
+			if !valid {
+				return fmt.Errorf("%w: OP_CHECKSIGVERIFY", ErrScriptFailed)
+			}
+			return nil
+		}
+		vm.push(boolBytes(valid))
+
+	case OpCheckMultiSig, OpCheckMultiSigVerify:
+		valid, err := vm.checkMultiSig()
+		if err != nil {
+			return err
+		}
+		if op == OpCheckMultiSigVerify {
+			if !valid {
+				return fmt.Errorf("%w: OP_CHECKMULTISIGVERIFY", ErrScriptFailed)
+			}
+			return nil
+		}
+		vm.push(boolBytes(valid))
+
+	case OpCheckLockTimeVerify:
+		return vm.checkLockTime()
+
+	case OpCheckSequenceVerify:
+		return vm.checkSequence()
+
+	default:
+		return fmt.Errorf("%w: unknown opcode %#x", ErrBadScript, op)
+	}
+
+	return nil
+}
+
+func boolBytes(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+
+	return nil
+}
+
+// checkSig 检查 sig（DER 签名 + 1 字节 hashType）是否是 pubKey 对当前输入的有效签名，
+// 编码错误的签名或公钥只是验证失败，不会让脚本出错
+func (vm *scriptEngine) checkSig(sig, pubKey []byte) bool {
+	if len(sig) == 0 {
+		return false
+	}
+	pub, err := wallet.ParsePublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+
+	hashType := SigHashType(sig[len(sig)-1])
+	hash, err := vm.tx.SignatureHash(vm.inIdx, vm.script, hashType)
+	if err != nil {
+		return false
+	}
+
+	return verifySignature(pub, hash, sig[:len(sig)-1])
+}
+
+// checkMultiSig 执行 OP_CHECKMULTISIG：栈上依次是 m 个签名、m、n 个公钥、n。
+// 签名按顺序与公钥匹配，每个公钥最多匹配一个签名，所有签名都匹配成功才为真
+func (vm *scriptEngine) checkMultiSig() (bool, error) {
+	n, err := vm.popInt(4)
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > MaxMultisigPubKeys {
+		return false, fmt.Errorf("%w: %d public keys", ErrBadScript, n)
+	}
+	vm.ops += int(n)
+	if vm.ops > maxScriptOps {
+		return false, fmt.Errorf("%w: too many operations", ErrBadScript)
+	}
+	if len(vm.stack) < int(n) {
+		return false, fmt.Errorf("%w: stack underflow", ErrBadScript)
+	}
+	pubKeys := vm.stack[len(vm.stack)-int(n):]
+	vm.stack = vm.stack[:len(vm.stack)-int(n)]
+
+	m, err := vm.popInt(4)
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("%w: %d of %d signatures", ErrBadScript, m, n)
+	}
+	if len(vm.stack) < int(m) {
+		return false, fmt.Errorf("%w: stack underflow", ErrBadScript)
+	}
+	sigs := vm.stack[len(vm.stack)-int(m):]
+	vm.stack = vm.stack[:len(vm.stack)-int(m)]
+
+	k := 0
+	for _, sig := range sigs {
+		for k < len(pubKeys) && !vm.checkSig(sig, pubKeys[k]) {
+			k++
+		}
+		if k == len(pubKeys) {
+			return false, nil
+		}
+		k++
+	}
+
+	return true, nil
+}
+
+// checkLockTime 执行 OP_CHECKLOCKTIMEVERIFY：栈顶的 locktime 与交易的 LockTime 必须是同一种（高度或时间戳），
+// 并且不大于交易的 LockTime，输入的 Sequence 不能是 SequenceFinal（否则 LockTime 不生效）。栈顶元素不会被弹出
+func (vm *scriptEngine) checkLockTime() error {
+	if len(vm.stack) == 0 {
+		return fmt.Errorf("%w: stack underflow", ErrBadScript)
+	}
+	lockTime, err := parseScriptNum(vm.stack[len(vm.stack)-1], 5)
+	if err != nil {
+		return err
+	}
+	if lockTime < 0 {
+		return fmt.Errorf("%w: negative lock time %d", ErrBadScript, lockTime)
+	}
+
+	txLockTime := int64(vm.tx.LockTime)
+	if (lockTime < LockTimeThreshold) != (txLockTime < LockTimeThreshold) {
+		return fmt.Errorf("%w: lock time %d and transaction lock time %d are of different kinds", ErrUnsatisfiedLockTime, lockTime, txLockTime)
+	}
+	if lockTime > txLockTime {
+		return fmt.Errorf("%w: requires %d, transaction has %d", ErrUnsatisfiedLockTime, lockTime, txLockTime)
+	}
+	if vm.tx.Inputs[vm.inIdx].Sequence == SequenceFinal {
+		return fmt.Errorf("%w: input sequence is final", ErrUnsatisfiedLockTime)
+	}
+
+	return nil
+}
+
+// checkSequence 执行 OP_CHECKSEQUENCEVERIFY：栈顶的 sequence 设置了 SequenceLockTimeDisabled 时什么也不做，
+// 否则输入的 Sequence 必须启用了相对锁定时间，单位相同，并且锁定的值不小于 sequence 的值。栈顶元素不会被弹出
+func (vm *scriptEngine) checkSequence() error {
+	if len(vm.stack) == 0 {
+		return fmt.Errorf("%w: stack underflow", ErrBadScript)
+	}
+	sequence, err := parseScriptNum(vm.stack[len(vm.stack)-1], 5)
+	if err != nil {
+		return err
+	}
+	if sequence < 0 {
+		return fmt.Errorf("%w: negative sequence %d", ErrBadScript, sequence)
+	}
+	if sequence&SequenceLockTimeDisabled != 0 {
+		return nil
+	}
+
+	txSequence := int64(vm.tx.Inputs[vm.inIdx].Sequence)
+	if txSequence&SequenceLockTimeDisabled != 0 {
+		return fmt.Errorf("%w: input has no relative lock time", ErrUnsatisfiedLockTime)
+	}
+	if sequence&SequenceLockTimeIsSeconds != txSequence&SequenceLockTimeIsSeconds {
+		return fmt.Errorf("%w: relative lock time %#x and input sequence %#x are of different kinds", ErrUnsatisfiedLockTime, sequence, txSequence)
+	}
+	if sequence&SequenceLockTimeMask > txSequence&SequenceLockTimeMask {
+		return fmt.Errorf("%w: requires relative lock %d, input has %d", ErrUnsatisfiedLockTime, sequence&SequenceLockTimeMask, txSequence&SequenceLockTimeMask)
+	}
+
+	return nil
+}
+
+// isPushOnly 判断脚本是否只包含压栈操作
+func isPushOnly(script []byte) bool {
+	for pc := 0; pc < len(script); {
+		op, _, next, err := readOp(script, pc)
+		if err != nil || op > Op16 || (op > OpPushData2 && op < Op1) {
+			return false
+		}
+		pc = next
+	}
+
+	return true
+}
+
+// VerifyScript 检查 tx 的第 inIdx 个输入的 scriptSig 能否解锁 scriptPubKey
+func VerifyScript(scriptSig, scriptPubKey []byte, tx *Transaction, inIdx int) error {
+	if !isPushOnly(scriptSig) {
+		return fmt.Errorf("%w: scriptSig is not push only", ErrBadScript)
+	}
+
+	vm := scriptEngine{tx: tx, inIdx: inIdx}
+	if err := vm.execute(scriptSig); err != nil {
+		return err
+	}
+	sigStack := append([][]byte{}, vm.stack...)
+
+	if err := vm.execute(scriptPubKey); err != nil {
+		return err
+	}
+	if !vm.success() {
+		return ErrScriptFailed
+	}
+
+	if !IsP2SH(scriptPubKey) {
+		return nil
+	}
+
+	// P2SH：ScriptSig 的最后一个元素是赎回脚本，用剩下的元素执行它
+	if len(sigStack) == 0 {
+		return fmt.Errorf("%w: missing redeem script", ErrBadScript)
+	}
+	redeemScript := sigStack[len(sigStack)-1]
+	vm.stack = sigStack[:len(sigStack)-1]
+	if err := vm.execute(redeemScript); err != nil {
+		return err
+	}
+	if !vm.success() {
+		return fmt.Errorf("%w: redeem script", ErrScriptFailed)
+	}
+
+	return nil
+}
+
+// P2PKHScript 返回锁定到公钥哈希的脚本
+func P2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OpDup, OpHash160}
+	script = pushData(script, pubKeyHash)
+
+	return append(script, OpEqualVerify, OpCheckSig)
+}
+
+// P2SHScript 返回锁定到赎回脚本哈希的脚本
+func P2SHScript(scriptHash []byte) []byte {
+	script := []byte{OpHash160}
+	script = pushData(script, scriptHash)
+
+	return append(script, OpEqual)
+}
+
+// MultisigScript 返回需要 pubKeys 中任意 m 个签名的 m-of-n 多签脚本
+func MultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if n == 0 || n > 16 || m < 1 || m > n {
+		return nil, fmt.Errorf("%w: %d of %d multisig", ErrBadScript, m, n)
+	}
+
+	script := []byte{byte(Op1 - 1 + m)}
+	for _, pubKey := range pubKeys {
+		if _, err := wallet.ParsePublicKey(pubKey); err != nil {
+			return nil, err
+		}
+		script = pushData(script, pubKey)
+	}
+
+	return append(script, byte(Op1-1+n), OpCheckMultiSig), nil
+}
+
+// parseMultisigScript 解析 MultisigScript 生成的多签脚本
+func parseMultisigScript(script []byte) (int, [][]byte, error) {
+	var ops []byte
+	var pushes [][]byte
+	for pc := 0; pc < len(script); {
+		op, data, next, err := readOp(script, pc)
+		if err != nil {
+			return 0, nil, err
+		}
+		ops = append(ops, op)
+		pushes = append(pushes, data)
+		pc = next
+	}
+
+	if len(ops) < 4 || ops[len(ops)-1] != OpCheckMultiSig {
+		return 0, nil, fmt.Errorf("%w: not a multisig script", ErrBadScript)
+	}
+	mOp, nOp := ops[0], ops[len(ops)-2]
+	if mOp < Op1 || mOp > Op16 || nOp < Op1 || nOp > Op16 {
+		return 0, nil, fmt.Errorf("%w: not a multisig script", ErrBadScript)
+	}
+	m, n := int(mOp-Op1+1), int(nOp-Op1+1)
+	pubKeys := pushes[1 : len(pushes)-2]
+	if len(pubKeys) != n || m > n {
+		return 0, nil, fmt.Errorf("%w: not a multisig script", ErrBadScript)
+	}
+	for i, pubKey := range pubKeys {
+		if ops[i+1] > OpPushData2 || len(pubKey) == 0 {
+			return 0, nil, fmt.Errorf("%w: not a multisig script", ErrBadScript)
+		}
+	}
+
+	return m, pubKeys, nil
+}
+
+// NullDataScript 返回携带 data 的数据输出脚本 OP_RETURN <data>
+func NullDataScript(data []byte) ([]byte, error) {
+	if len(data) > MaxDataCarrierSize {
+		return nil, fmt.Errorf("%w: %d bytes of data exceeds %d", ErrBadScript, len(data), MaxDataCarrierSize)
+	}
+
+	return pushData([]byte{OpReturn}, data), nil
+}
+
+// extractNullData 返回数据输出脚本中的数据，不是 NullDataScript 格式的脚本时返回 false
+func extractNullData(script []byte) ([]byte, bool) {
+	if len(script) == 0 || script[0] != OpReturn {
+		return nil, false
+	}
+	if len(script) == 1 {
+		return nil, true
+	}
+
+	op, data, next, err := readOp(script, 1)
+	if err != nil || next != len(script) || op > Op16 || (op > OpPushData2 && op < Op1) {
+		return nil, false
+	}
+	if op >= Op1 {
+		data = scriptNumBytes(int64(op - Op1 + 1))
+	}
+	if len(data) > MaxDataCarrierSize {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// IsUnspendable 判断锁定脚本是否不可能被解锁：以 OP_RETURN 开头，或者超过脚本的最大长度
+func IsUnspendable(script []byte) bool {
+	return (len(script) > 0 && script[0] == OpReturn) || len(script) > maxScriptSize
+}
+
+// isP2PKH 判断脚本是否是标准的 P2PKH 脚本
+func isP2PKH(script []byte) bool {
+	return len(script) == 25 && script[0] == OpDup && script[1] == OpHash160 && script[2] == 20 &&
+		script[23] == OpEqualVerify && script[24] == OpCheckSig
+}
+
+// IsP2SH 判断脚本是否是标准的 P2SH 脚本
+func IsP2SH(script []byte) bool {
+	return len(script) == 23 && script[0] == OpHash160 && script[1] == 20 && script[22] == OpEqual
+}
+
+// LockScript 返回发送到 address 的输出使用的锁定脚本：版本 0x00 的地址是 P2PKH，0x05 的地址是 P2SH
+func LockScript(address string) ([]byte, error) {
+	version, hash, err := wallet.DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case wallet.PubKeyHashVersion:
+		return P2PKHScript(hash), nil
+	case wallet.ScriptHashVersion:
+		return P2SHScript(hash), nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown version %#x", wallet.ErrBadAddress, version)
+}
+
+// ExtractAddress 返回标准脚本对应的地址，不是 P2PKH 或 P2SH 脚本时返回 false
+func ExtractAddress(script []byte) (string, bool) {
+	switch {
+	case isP2PKH(script):
+		return string(wallet.EncodeAddress(wallet.PubKeyHashVersion, script[3:23])), true
+	case IsP2SH(script):
+		return string(wallet.EncodeAddress(wallet.ScriptHashVersion, script[2:22])), true
+	}
+
+	return "", false
+}
+
+// DisasmScript 返回脚本的可读形式，数据按十六进制显示
+func DisasmScript(script []byte) string {
+	var parts []string
+	for pc := 0; pc < len(script); {
+		op, data, next, err := readOp(script, pc)
+		if err != nil {
+			parts = append(parts, "[error]")
+			break
+		}
+		pc = next
+
+		switch {
+		case op > Op0 && op <= OpPushData2:
+			parts = append(parts, hex.EncodeToString(data))
+		case op >= Op1 && op <= Op16:
+			parts = append(parts, fmt.Sprintf("OP_%d", op-Op1+1))
+		case opNames[op] != "":
+			parts = append(parts, opNames[op])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN_%#x", op))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
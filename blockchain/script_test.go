@@ -0,0 +1,319 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"testing"
+
+	"blockchain_go/wallet"
+)
+
+func TestScriptNum(t *testing.T) {
+	tests := []struct {
+		n       int64
+		encoded []byte
+	}{
+		{0, nil},
+		{1, []byte{0x01}},
+		{-1, []byte{0x81}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x00}},
+		{-128, []byte{0x80, 0x80}},
+		{255, []byte{0xff, 0x00}},
+		{256, []byte{0x00, 0x01}},
+		{-256, []byte{0x00, 0x81}},
+		{1 << 31, []byte{0x00, 0x00, 0x00, 0x80, 0x00}},
+	}
+
+	for _, tt := range tests {
+		if got := scriptNumBytes(tt.n); !bytes.Equal(got, tt.encoded) {
+			t.Errorf("scriptNumBytes(%d) = %x, want %x", tt.n, got, tt.encoded)
+		}
+		if got, err := parseScriptNum(tt.encoded, 5); err != nil || got != tt.n {
+			t.Errorf("parseScriptNum(%x) = %d, %v, want %d", tt.encoded, got, err, tt.n)
+		}
+	}
+
+	bad := []struct {
+		name    string
+		encoded []byte
+		maxLen  int
+	}{
+		{"zero byte", []byte{0x00}, 4},
+		{"negative zero", []byte{0x80}, 4},
+		{"padded positive", []byte{0x01, 0x00}, 4},
+		{"padded negative", []byte{0x01, 0x80}, 4},
+		{"too long", []byte{0x01, 0x02, 0x03, 0x04, 0x05}, 4},
+	}
+	for _, tt := range bad {
+		if _, err := parseScriptNum(tt.encoded, tt.maxLen); !errors.Is(err, ErrBadScript) {
+			t.Errorf("%s: got %v, want ErrBadScript", tt.name, err)
+		}
+	}
+}
+
+// scriptTestTx 返回一笔只有一个输入的交易，用来验证这个输入的解锁脚本
+func scriptTestTx(lockTime, sequence uint32) *Transaction {
+	tx := &Transaction{
+		Inputs:   []TxInput{{bytes.Repeat([]byte{1}, 32), 0, nil, sequence}},
+		Outputs:  []TxOutput{{1, P2PKHScript(make([]byte, 20))}},
+		LockTime: lockTime,
+	}
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+func scriptTestSig(t *testing.T, tx *Transaction, privKey *ecdsa.PrivateKey, scriptCode []byte) []byte {
+	t.Helper()
+
+	sig, err := tx.RawSignature(privKey, 0, scriptCode, SigHashAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sig
+}
+
+func TestVerifyScript(t *testing.T) {
+	tx := scriptTestTx(0, SequenceFinal)
+	w, other := wallet.MakeWallet(), wallet.MakeWallet()
+	keys := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+
+	p2pkh := P2PKHScript(wallet.PublicKeyHash(w.PublicKey))
+	p2pkhSig := scriptTestSig(t, tx, &w.PrivateKey, p2pkh)
+	otherSig := scriptTestSig(t, tx, &other.PrivateKey, p2pkh)
+
+	// 2-of-3 多签，既直接作为锁定脚本，也作为 P2SH 的赎回脚本；两种情况下签名摘要都使用多签脚本
+	multisig, err := MultisigScript(2, [][]byte{keys[0].PublicKey, keys[1].PublicKey, keys[2].PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2sh := P2SHScript(wallet.PublicKeyHash(multisig))
+	sigs := make([][]byte, len(keys))
+	for i, k := range keys {
+		sigs[i] = scriptTestSig(t, tx, &k.PrivateKey, multisig)
+	}
+	outsiderSig := scriptTestSig(t, tx, &other.PrivateKey, multisig)
+	pushes := func(items ...[]byte) []byte {
+		var script []byte
+		for _, item := range items {
+			script = pushData(script, item)
+		}
+		return script
+	}
+
+	// P2SH 包装的 P2PKH，签名摘要使用赎回脚本，所以与直接花费 P2PKH 输出的签名相同
+	p2shP2PKH := P2SHScript(wallet.PublicKeyHash(p2pkh))
+	falseRedeem := []byte{Op0}
+
+	tests := []struct {
+		name         string
+		scriptSig    []byte
+		scriptPubKey []byte
+		want         error
+	}{
+		{"p2pkh", pushes(p2pkhSig, w.PublicKey), p2pkh, nil},
+		{"p2pkh other public key", pushes(otherSig, other.PublicKey), p2pkh, ErrScriptFailed},
+		{"p2pkh signature from other key", pushes(otherSig, w.PublicKey), p2pkh, ErrScriptFailed},
+		{"p2pkh signature for other script", pushes(scriptTestSig(t, tx, &w.PrivateKey, multisig), w.PublicKey), p2pkh, ErrScriptFailed},
+		{"p2pkh missing public key", pushes(p2pkhSig), p2pkh, ErrScriptFailed},
+		{"p2pkh empty script sig", nil, p2pkh, ErrBadScript},
+		{"p2pkh script sig not push only", append(pushes(p2pkhSig, w.PublicKey), OpDup), p2pkh, ErrBadScript},
+
+		{"bare multisig keys 0 1", pushes(sigs[0], sigs[1]), multisig, nil},
+		{"bare multisig keys 1 2", pushes(sigs[1], sigs[2]), multisig, nil},
+		{"p2sh multisig keys 0 2", pushes(sigs[0], sigs[2], multisig), p2sh, nil},
+		{"p2sh multisig three signatures", pushes(sigs[0], sigs[1], sigs[2], multisig), p2sh, nil},
+		{"p2sh multisig wrong order", pushes(sigs[2], sigs[0], multisig), p2sh, ErrScriptFailed},
+		{"p2sh multisig same signature twice", pushes(sigs[0], sigs[0], multisig), p2sh, ErrScriptFailed},
+		{"p2sh multisig outsider signature", pushes(sigs[0], outsiderSig, multisig), p2sh, ErrScriptFailed},
+		{"p2sh multisig one signature", pushes(sigs[0], multisig), p2sh, ErrBadScript},
+		{"p2sh multisig empty signature", pushes(sigs[0], nil, multisig), p2sh, ErrScriptFailed},
+		{"p2sh wrong redeem script", pushes(sigs[0], sigs[1], p2pkh), p2sh, ErrScriptFailed},
+		{"p2sh missing redeem script", nil, p2sh, ErrBadScript},
+
+		{"p2sh p2pkh", pushes(p2pkhSig, w.PublicKey, p2pkh), p2shP2PKH, nil},
+		{"p2sh p2pkh signature over p2sh script", pushes(scriptTestSig(t, tx, &w.PrivateKey, p2shP2PKH), w.PublicKey, p2pkh), p2shP2PKH, ErrScriptFailed},
+		{"p2sh redeem script is false", pushes(falseRedeem), P2SHScript(wallet.PublicKeyHash(falseRedeem)), ErrScriptFailed},
+
+		{"op_return", nil, []byte{OpReturn}, ErrScriptFailed},
+		{"unknown opcode", nil, []byte{0xff}, ErrBadScript},
+		{"truncated push", nil, []byte{0x05, 0x01}, ErrBadScript},
+	}
+
+	for _, tt := range tests {
+		err := VerifyScript(tt.scriptSig, tt.scriptPubKey, tx, 0)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSignMultisigInput(t *testing.T) {
+	keys := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+	multisig, err := MultisigScript(2, [][]byte{keys[0].PublicKey, keys[1].PublicKey, keys[2].PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2sh := P2SHScript(wallet.PublicKeyHash(multisig))
+
+	tests := []struct {
+		name string
+		keys []int
+		want error
+	}{
+		{"keys 0 1", []int{0, 1}, nil},
+		{"keys 2 0", []int{2, 0}, nil},
+		{"all keys", []int{0, 1, 2}, nil},
+		{"one key", []int{1}, ErrNotEnoughKeys},
+		{"same key twice", []int{1, 1}, ErrNotEnoughKeys},
+		{"outside key", []int{0, -1}, ErrNotEnoughKeys},
+	}
+
+	for _, tt := range tests {
+		var privKeys []*ecdsa.PrivateKey
+		for _, k := range tt.keys {
+			if k < 0 {
+				privKeys = append(privKeys, &wallet.MakeWallet().PrivateKey)
+			} else {
+				privKeys = append(privKeys, &keys[k].PrivateKey)
+			}
+		}
+
+		tx := scriptTestTx(0, SequenceFinal)
+		err := tx.SignMultisigInput(privKeys, 0, multisig, SigHashAll)
+		if tt.want != nil {
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if err := VerifyScript(tx.Inputs[0].ScriptSig, p2sh, tx, 0); err != nil {
+			t.Errorf("%s: signed input does not verify: %v", tt.name, err)
+		}
+	}
+}
+
+func TestMultisigScript(t *testing.T) {
+	var pubKeys [][]byte
+	for i := 0; i < 17; i++ {
+		pubKeys = append(pubKeys, wallet.MakeWallet().PublicKey)
+	}
+
+	tests := []struct {
+		name    string
+		m       int
+		pubKeys [][]byte
+		ok      bool
+	}{
+		{"1 of 1", 1, pubKeys[:1], true},
+		{"2 of 3", 2, pubKeys[:3], true},
+		{"16 of 16", 16, pubKeys[:16], true},
+		{"0 of 3", 0, pubKeys[:3], false},
+		{"4 of 3", 4, pubKeys[:3], false},
+		{"no keys", 1, nil, false},
+		{"17 keys", 1, pubKeys, false},
+		{"invalid key", 1, [][]byte{pubKeys[0][:32]}, false},
+	}
+
+	for _, tt := range tests {
+		script, err := MultisigScript(tt.m, tt.pubKeys)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: MultisigScript succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		m, parsed, err := parseMultisigScript(script)
+		if err != nil || m != tt.m || len(parsed) != len(tt.pubKeys) {
+			t.Errorf("%s: parseMultisigScript = %d, %d keys, %v", tt.name, m, len(parsed), err)
+		}
+	}
+}
+
+// lockScript 返回 <n> opcode OP_DROP OP_1，只检查时间锁
+func lockScript(n int64, opcode byte) []byte {
+	return append(pushData(nil, scriptNumBytes(n)), opcode, OpDrop, Op1)
+}
+
+func TestCheckLockTimeVerify(t *testing.T) {
+	const timestamp = LockTimeThreshold + 100
+
+	tests := []struct {
+		name     string
+		script   []byte
+		lockTime uint32
+		sequence uint32
+		want     error
+	}{
+		{"height reached", lockScript(100, OpCheckLockTimeVerify), 100, 0, nil},
+		{"height passed", lockScript(100, OpCheckLockTimeVerify), 150, 0, nil},
+		{"time reached", lockScript(timestamp, OpCheckLockTimeVerify), timestamp, 0, nil},
+		{"zero", lockScript(0, OpCheckLockTimeVerify), 0, 0, nil},
+		{"height not reached", lockScript(101, OpCheckLockTimeVerify), 100, 0, ErrUnsatisfiedLockTime},
+		{"time not reached", lockScript(timestamp+1, OpCheckLockTimeVerify), timestamp, 0, ErrUnsatisfiedLockTime},
+		{"height against time", lockScript(100, OpCheckLockTimeVerify), timestamp, 0, ErrUnsatisfiedLockTime},
+		{"time against height", lockScript(timestamp, OpCheckLockTimeVerify), LockTimeThreshold - 1, 0, ErrUnsatisfiedLockTime},
+		{"final sequence", lockScript(100, OpCheckLockTimeVerify), 100, SequenceFinal, ErrUnsatisfiedLockTime},
+		{"negative", lockScript(-1, OpCheckLockTimeVerify), 100, 0, ErrBadScript},
+		{"number too long", append(pushData(nil, []byte{1, 2, 3, 4, 5, 6}), OpCheckLockTimeVerify), 100, 0, ErrBadScript},
+		{"empty stack", []byte{OpCheckLockTimeVerify}, 100, 0, ErrBadScript},
+	}
+
+	for _, tt := range tests {
+		tx := scriptTestTx(tt.lockTime, tt.sequence)
+		err := VerifyScript(nil, tt.script, tx, 0)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckSequenceVerify(t *testing.T) {
+	const seconds = SequenceLockTimeIsSeconds
+
+	tests := []struct {
+		name     string
+		script   []byte
+		sequence uint32
+		want     error
+	}{
+		{"blocks reached", lockScript(10, OpCheckSequenceVerify), 10, nil},
+		{"blocks passed", lockScript(10, OpCheckSequenceVerify), 20, nil},
+		{"seconds reached", lockScript(seconds|10, OpCheckSequenceVerify), seconds | 10, nil},
+		{"disabled in script", lockScript(SequenceLockTimeDisabled|100, OpCheckSequenceVerify), SequenceFinal, nil},
+		{"bits outside mask ignored", lockScript(1<<16|10, OpCheckSequenceVerify), 10, nil},
+		{"blocks not reached", lockScript(11, OpCheckSequenceVerify), 10, ErrUnsatisfiedLockTime},
+		{"seconds not reached", lockScript(seconds|11, OpCheckSequenceVerify), seconds | 10, ErrUnsatisfiedLockTime},
+		{"disabled in input", lockScript(10, OpCheckSequenceVerify), SequenceLockTimeDisabled | 10, ErrUnsatisfiedLockTime},
+		{"final input", lockScript(10, OpCheckSequenceVerify), SequenceFinal, ErrUnsatisfiedLockTime},
+		{"seconds against blocks", lockScript(seconds|10, OpCheckSequenceVerify), 20, ErrUnsatisfiedLockTime},
+		{"blocks against seconds", lockScript(10, OpCheckSequenceVerify), seconds | 20, ErrUnsatisfiedLockTime},
+		{"negative", lockScript(-1, OpCheckSequenceVerify), 10, ErrBadScript},
+		{"empty stack", []byte{OpCheckSequenceVerify}, 10, ErrBadScript},
+	}
+
+	for _, tt := range tests {
+		tx := scriptTestTx(0, tt.sequence)
+		err := VerifyScript(nil, tt.script, tx, 0)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"blockchain_go/wallet"
+)
+
+/*
+签名哈希（sighash）。
+
+每个输入的签名都是对一个 32 字节摘要的签名，摘要的计算方法：
+1. 复制交易，去掉所有输入的 ScriptSig
+2. 被签名输入的 ScriptSig 换成 scriptCode：普通输出是它的 ScriptPubKey，P2SH 输出是赎回脚本
+3. 根据 hashType 的低 5 位修改输出：
+   - SigHashAll：保留所有输出
+   - SigHashNone：去掉所有输出，其他人可以任意修改输出
+   - SigHashSingle：只保留与被签名输入相同下标的输出，之前的输出替换为 Value = -1、ScriptPubKey 为空，
+     之后的输出全部去掉；没有对应输出时不能签名
+   SigHashNone 和 SigHashSingle 同时把其他输入的 Sequence 置为 0，其他输入的所有者可以修改自己的 Sequence
+4. hashType 带有 SigHashAnyoneCanPay 时只保留被签名的输入，其他人可以继续添加输入
+5. 对副本的规范编码（见 encoding.go，不含解锁脚本）加上 4 字节大端 hashType 做两次 SHA-256
+
+脚本中签名的最后一个字节是 hashType，前面是 DER 编码的签名（见 signature.go）。
+*/
+
+type SigHashType byte
+
+const (
+	SigHashAll          SigHashType = 0x01
+	SigHashNone         SigHashType = 0x02
+	SigHashSingle       SigHashType = 0x03
+	SigHashAnyoneCanPay SigHashType = 0x80
+
+	sigHashMask = 0x1f
+)
+
+var (
+	ErrBadSigHashType = errors.New("invalid signature hash type")
+	ErrNoSingleOutput = errors.New("SIGHASH_SINGLE input has no matching output")
+	ErrNotEnoughKeys  = errors.New("not enough keys to sign multisig input")
+)
+
+// Valid 判断 hashType 是否是支持的组合
+func (t SigHashType) Valid() bool {
+	base := t &^ SigHashAnyoneCanPay
+	return base == SigHashAll || base == SigHashNone || base == SigHashSingle
+}
+
+// SignatureHash 计算第 inIdx 个输入用 hashType 签名时的摘要，scriptCode 是验证签名的脚本
+func (tx *Transaction) SignatureHash(inIdx int, scriptCode []byte, hashType SigHashType) ([]byte, error) {
+	if inIdx < 0 || inIdx >= len(tx.Inputs) {
+		return nil, fmt.Errorf("input %d out of range", inIdx)
+	}
+	if !hashType.Valid() {
+		return nil, fmt.Errorf("%w: %#x", ErrBadSigHashType, byte(hashType))
+	}
+
+	txCopy := tx.TrimmedCopy()
+	txCopy.Inputs[inIdx].ScriptSig = scriptCode
+
+	switch hashType & sigHashMask {
+	case SigHashNone:
+		txCopy.Outputs = nil
+		txCopy.clearOtherSequences(inIdx)
+	case SigHashSingle:
+		if inIdx >= len(txCopy.Outputs) {
+			return nil, fmt.Errorf("%w: input %d", ErrNoSingleOutput, inIdx)
+		}
+		txCopy.Outputs = txCopy.Outputs[:inIdx+1]
+		for i := 0; i < inIdx; i++ {
+			txCopy.Outputs[i] = TxOutput{-1, nil}
+		}
+		txCopy.clearOtherSequences(inIdx)
+	}
+
+	if hashType&SigHashAnyoneCanPay != 0 {
+		txCopy.Inputs = []TxInput{txCopy.Inputs[inIdx]}
+	}
+
+	// 副本中只有被签名输入的 ScriptSig（即 scriptCode）不为空
+	var e encoder
+	txCopy.encode(&e, true)
+	e.uint32(uint32(hashType))
+
+	first := sha256.Sum256(e.buf)
+	hash := sha256.Sum256(first[:])
+
+	return hash[:], nil
+}
+
+func (tx *Transaction) clearOtherSequences(inIdx int) {
+	for i := range tx.Inputs {
+		if i != inIdx {
+			tx.Inputs[i].Sequence = 0
+		}
+	}
+}
+
+// RawSignature 返回 privKey 对第 inIdx 个输入的签名（DER 编码 + 1 字节 hashType），scriptCode 是验证签名的脚本
+func (tx *Transaction) RawSignature(privKey *ecdsa.PrivateKey, inIdx int, scriptCode []byte, hashType SigHashType) ([]byte, error) {
+	hash, err := tx.SignatureHash(inIdx, scriptCode, hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := encodeSignature(r, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(der, byte(hashType)), nil
+}
+
+// SignInput 用 privKey 和 hashType 签名第 inIdx 个输入，prevTX 是该输入花费的交易，被花费的输出必须是 P2PKH 输出
+func (tx *Transaction) SignInput(privKey *ecdsa.PrivateKey, inIdx int, prevTX Transaction, hashType SigHashType) error {
+	if inIdx < 0 || inIdx >= len(tx.Inputs) {
+		return fmt.Errorf("input %d out of range", inIdx)
+	}
+	in := tx.Inputs[inIdx]
+	if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+		return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
+	}
+
+	return tx.signP2PKHInput(privKey, inIdx, prevTX.Outputs[in.Out].ScriptPubKey, hashType)
+}
+
+// signP2PKHInput 签名第 inIdx 个输入，scriptPubKey 是它花费的 P2PKH 输出的锁定脚本
+func (tx *Transaction) signP2PKHInput(privKey *ecdsa.PrivateKey, inIdx int, scriptPubKey []byte, hashType SigHashType) error {
+	in := tx.Inputs[inIdx]
+	if !isP2PKH(scriptPubKey) {
+		return fmt.Errorf("%w: %x:%d is not a P2PKH output", ErrBadScript, in.ID, in.Out)
+	}
+
+	sig, err := tx.RawSignature(privKey, inIdx, scriptPubKey, hashType)
+	if err != nil {
+		return err
+	}
+	pubKey := wallet.SerializePublicKey(&privKey.PublicKey)
+	tx.Inputs[inIdx].ScriptSig = pushData(pushData(nil, sig), pubKey)
+
+	return nil
+}
+
+// SignMultisigInput 签名花费 P2SH 多签输出的第 inIdx 个输入，redeemScript 是多签赎回脚本。
+// privKeys 中与赎回脚本公钥对应的私钥按公钥顺序签名，至少要有赎回脚本要求的 m 个
+func (tx *Transaction) SignMultisigInput(privKeys []*ecdsa.PrivateKey, inIdx int, redeemScript []byte, hashType SigHashType) error {
+	if inIdx < 0 || inIdx >= len(tx.Inputs) {
+		return fmt.Errorf("input %d out of range", inIdx)
+	}
+	m, pubKeys, err := parseMultisigScript(redeemScript)
+	if err != nil {
+		return err
+	}
+
+	var scriptSig []byte
+	signed := 0
+	for _, pubKey := range pubKeys {
+		if signed == m {
+			break
+		}
+		for _, privKey := range privKeys {
+			if !bytes.Equal(wallet.SerializePublicKey(&privKey.PublicKey), pubKey) {
+				continue
+			}
+			sig, err := tx.RawSignature(privKey, inIdx, redeemScript, hashType)
+			if err != nil {
+				return err
+			}
+			scriptSig = pushData(scriptSig, sig)
+			signed++
+			break
+		}
+	}
+	if signed < m {
+		return fmt.Errorf("%w: have %d of %d required keys", ErrNotEnoughKeys, signed, m)
+	}
+
+	tx.Inputs[inIdx].ScriptSig = pushData(scriptSig, redeemScript)
+
+	return nil
+}
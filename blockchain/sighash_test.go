@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"blockchain_go/wallet"
+)
+
+// sighashTestTx 返回一笔两个输入、三个输出的交易和它花费的交易，两个输入花费的输出都锁定到 w
+func sighashTestTx(w *wallet.Wallet) (*Transaction, Transaction) {
+	script := P2PKHScript(wallet.PublicKeyHash(w.PublicKey))
+	prev := Transaction{Outputs: []TxOutput{{100, script}}}
+	prev.ID = prev.Hash()
+
+	tx := &Transaction{
+		Inputs: []TxInput{
+			{bytes.Repeat([]byte{1}, 32), 0, nil, SequenceFinal},
+			{prev.ID, 0, nil, SequenceFinal},
+		},
+		Outputs: []TxOutput{{10, script}, {20, script}, {30, script}},
+	}
+	tx.ID = tx.Hash()
+
+	return tx, prev
+}
+
+// 签名第二个输入后修改交易，hashType 没有覆盖的部分可以修改，覆盖的部分修改后签名失效
+func TestSignatureHashTypes(t *testing.T) {
+	w := wallet.MakeWallet()
+
+	mutations := []struct {
+		name   string
+		mutate func(tx *Transaction)
+	}{
+		{"earlier output", func(tx *Transaction) { tx.Outputs[0].Value++ }},
+		{"matching output", func(tx *Transaction) { tx.Outputs[1].Value++ }},
+		{"later output", func(tx *Transaction) { tx.Outputs[2].Value++ }},
+		{"added output", func(tx *Transaction) { tx.Outputs = append(tx.Outputs, tx.Outputs[0]) }},
+		{"other input sequence", func(tx *Transaction) { tx.Inputs[0].Sequence = 7 }},
+		{"other input outpoint", func(tx *Transaction) { tx.Inputs[0].Out = 1 }},
+		{"added input", func(tx *Transaction) { tx.Inputs = append(tx.Inputs, TxInput{bytes.Repeat([]byte{2}, 32), 0, nil, 0}) }},
+		{"signed input sequence", func(tx *Transaction) { tx.Inputs[1].Sequence = 7 }},
+		{"lock time", func(tx *Transaction) { tx.LockTime = 1 }},
+	}
+
+	// valid 按 mutations 的顺序列出修改后签名是否仍然有效
+	tests := []struct {
+		hashType SigHashType
+		valid    []bool
+	}{
+		{SigHashAll, []bool{false, false, false, false, false, false, false, false, false}},
+		{SigHashNone, []bool{true, true, true, true, true, false, false, false, false}},
+		{SigHashSingle, []bool{true, false, true, true, true, false, false, false, false}},
+		{SigHashAll | SigHashAnyoneCanPay, []bool{false, false, false, false, true, true, true, false, false}},
+		{SigHashNone | SigHashAnyoneCanPay, []bool{true, true, true, true, true, true, true, false, false}},
+		{SigHashSingle | SigHashAnyoneCanPay, []bool{true, false, true, true, true, true, true, false, false}},
+	}
+
+	for _, tt := range tests {
+		for i, m := range mutations {
+			tx, prev := sighashTestTx(w)
+			if err := tx.SignInput(&w.PrivateKey, 1, prev, tt.hashType); err != nil {
+				t.Fatalf("hashType %#x: %v", byte(tt.hashType), err)
+			}
+			in := tx.Inputs[1]
+			if err := VerifyScript(in.ScriptSig, prev.Outputs[0].ScriptPubKey, tx, 1); err != nil {
+				t.Fatalf("hashType %#x: signature does not verify before mutation: %v", byte(tt.hashType), err)
+			}
+
+			m.mutate(tx)
+			err := VerifyScript(in.ScriptSig, prev.Outputs[0].ScriptPubKey, tx, 1)
+			if tt.valid[i] && err != nil {
+				t.Errorf("hashType %#x, %s: signature became invalid: %v", byte(tt.hashType), m.name, err)
+			} else if !tt.valid[i] && !errors.Is(err, ErrScriptFailed) {
+				t.Errorf("hashType %#x, %s: got %v, want ErrScriptFailed", byte(tt.hashType), m.name, err)
+			}
+		}
+	}
+}
+
+func TestSignatureHashErrors(t *testing.T) {
+	w := wallet.MakeWallet()
+	tx, prev := sighashTestTx(w)
+	script := prev.Outputs[0].ScriptPubKey
+
+	tests := []struct {
+		name     string
+		inIdx    int
+		outputs  int
+		hashType SigHashType
+		want     error
+	}{
+		{"single without matching output", 1, 1, SigHashSingle, ErrNoSingleOutput},
+		{"single anyone can pay without matching output", 1, 1, SigHashSingle | SigHashAnyoneCanPay, ErrNoSingleOutput},
+		{"zero hash type", 0, 3, 0, ErrBadSigHashType},
+		{"unknown base type", 0, 3, 0x04, ErrBadSigHashType},
+		{"unknown flag", 0, 3, SigHashAll | 0x40, ErrBadSigHashType},
+		{"anyone can pay alone", 0, 3, SigHashAnyoneCanPay, ErrBadSigHashType},
+	}
+
+	for _, tt := range tests {
+		txCopy := *tx
+		txCopy.Outputs = tx.Outputs[:tt.outputs]
+		if _, err := txCopy.SignatureHash(tt.inIdx, script, tt.hashType); !errors.Is(err, tt.want) {
+			t.Errorf("%s: SignatureHash got %v, want %v", tt.name, err, tt.want)
+		}
+		if err := txCopy.SignInput(&w.PrivateKey, tt.inIdx, prev, tt.hashType); !errors.Is(err, tt.want) {
+			t.Errorf("%s: SignInput got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := tx.SignatureHash(2, script, SigHashAll); err == nil {
+		t.Error("SignatureHash accepted an input index out of range")
+	}
+}
+
+// 签名的最后一个字节 hashType 也被签名覆盖，修改它或者换成无效的值后签名失效
+func TestSignatureHashTypeByte(t *testing.T) {
+	w := wallet.MakeWallet()
+
+	for _, hashType := range []byte{byte(SigHashAll | SigHashAnyoneCanPay), byte(SigHashNone), 0x00, 0x04} {
+		tx, prev := sighashTestTx(w)
+		if err := tx.SignInput(&w.PrivateKey, 1, prev, SigHashAll); err != nil {
+			t.Fatal(err)
+		}
+
+		// ScriptSig 是 <签名> <公钥>，签名的最后一个字节是 hashType
+		scriptSig := append([]byte{}, tx.Inputs[1].ScriptSig...)
+		scriptSig[scriptSig[0]] = hashType
+		if err := VerifyScript(scriptSig, prev.Outputs[0].ScriptPubKey, tx, 1); !errors.Is(err, ErrScriptFailed) {
+			t.Errorf("hashType %#x: got %v, want ErrScriptFailed", hashType, err)
+		}
+	}
+}
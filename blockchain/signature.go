@@ -0,0 +1,71 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+/*
+签名编码。
+
+脚本中的签名 = DER 编码的 ECDSA 签名 + 1 字节 hashType，DER 格式：
+  0x30 总长度 0x02 len(r) r 0x02 len(s) s
+r 和 s 是最短的大端正整数（最高位为 1 时前面补 0x00）。
+(r, s) 和 (r, N-s) 都是有效签名，为了避免签名被第三方修改，s 必须不大于 N/2（low-S），
+签名时会自动转换，验证时拒绝 s > N/2 的签名和不是严格 DER 编码的签名。
+*/
+
+var ErrBadSignatureEncoding = errors.New("invalid signature encoding")
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+var (
+	curveOrder     = elliptic.P256().Params().N
+	halfCurveOrder = new(big.Int).Rsh(curveOrder, 1)
+)
+
+// encodeSignature 把签名转换为 low-S 形式并按 DER 编码
+func encodeSignature(r, s *big.Int) ([]byte, error) {
+	if s.Cmp(halfCurveOrder) > 0 {
+		s = new(big.Int).Sub(curveOrder, s)
+	}
+
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+// parseSignature 解析严格 DER 编码的 low-S 签名
+func parseSignature(der []byte) (*big.Int, *big.Int, error) {
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) > 0 {
+		return nil, nil, ErrBadSignatureEncoding
+	}
+
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.Cmp(curveOrder) >= 0 || sig.S.Cmp(halfCurveOrder) > 0 {
+		return nil, nil, ErrBadSignatureEncoding
+	}
+
+	// asn1 可以接受一些非最短的编码，重新编码后必须与原始数据相同
+	canonical, err := asn1.Marshal(sig)
+	if err != nil || !bytes.Equal(canonical, der) {
+		return nil, nil, ErrBadSignatureEncoding
+	}
+
+	return sig.R, sig.S, nil
+}
+
+// verifySignature 检查 sig（DER 编码）是否是 pub 对 hash 的有效签名
+func verifySignature(pub *ecdsa.PublicKey, hash, sig []byte) bool {
+	r, s, err := parseSignature(sig)
+	if err != nil {
+		return false
+	}
+
+	return ecdsa.Verify(pub, hash, r, s)
+}
@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"testing"
+
+	"blockchain_go/wallet"
+)
+
+// derSignature 按 DER 格式拼出签名，r 和 s 按原样写入，用来构造不规范的编码
+func derSignature(r, s []byte) []byte {
+	sig := []byte{0x30, byte(4 + len(r) + len(s)), 0x02, byte(len(r))}
+	sig = append(sig, r...)
+	sig = append(sig, 0x02, byte(len(s)))
+
+	return append(sig, s...)
+}
+
+func TestSignatureLowS(t *testing.T) {
+	w := wallet.MakeWallet()
+	hash := sha256.Sum256([]byte("message"))
+
+	// 重复签名，直到 s 小于和大于 N/2 的情况都出现过，两种都应该编码成 low-S 并验证通过
+	seenHigh, seenLow := false, false
+	for !seenHigh || !seenLow {
+		r, s, err := ecdsa.Sign(rand.Reader, &w.PrivateKey, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Cmp(halfCurveOrder) > 0 {
+			seenHigh = true
+		} else {
+			seenLow = true
+		}
+
+		der, err := encodeSignature(r, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsedR, parsedS, err := parseSignature(der)
+		if err != nil {
+			t.Fatalf("parseSignature: %v", err)
+		}
+		if parsedR.Cmp(r) != 0 || parsedS.Cmp(halfCurveOrder) > 0 {
+			t.Errorf("encoded signature has r = %x, s = %x", parsedR, parsedS)
+		}
+		if !verifySignature(&w.PrivateKey.PublicKey, hash[:], der) {
+			t.Error("low-S signature does not verify")
+		}
+
+		// 同一个签名的 high-S 形式对 ecdsa.Verify 仍然有效，但必须被拒绝
+		highS := new(big.Int).Sub(curveOrder, parsedS)
+		high, err := asn1.Marshal(ecdsaSignature{r, highS})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.Verify(&w.PrivateKey.PublicKey, hash[:], r, highS) {
+			t.Fatal("high-S signature is not valid ECDSA")
+		}
+		if verifySignature(&w.PrivateKey.PublicKey, hash[:], high) {
+			t.Error("high-S signature verifies")
+		}
+	}
+}
+
+func TestParseSignatureRejectsMalformed(t *testing.T) {
+	one := []byte{0x01}
+	n := curveOrder.Bytes()
+	half := halfCurveOrder.Bytes()
+	halfPlusOne := new(big.Int).Add(halfCurveOrder, big.NewInt(1)).Bytes()
+
+	tests := []struct {
+		name string
+		der  []byte
+		ok   bool
+	}{
+		{"minimal", derSignature(one, one), true},
+		{"s equals half order", derSignature(one, half), true},
+		{"s above half order", derSignature(one, halfPlusOne), false},
+		{"r equals order", derSignature(append([]byte{0}, n...), one), false},
+		{"zero r", derSignature([]byte{0x00}, one), false},
+		{"zero s", derSignature(one, []byte{0x00}), false},
+		{"negative r", derSignature([]byte{0x81}, one), false},
+		{"negative s", derSignature(one, []byte{0xff}), false},
+		{"padded r", derSignature([]byte{0x00, 0x01}, one), false},
+		{"padded s", derSignature(one, []byte{0x00, 0x01}), false},
+		{"empty r", derSignature(nil, one), false},
+		{"wrong sequence tag", append([]byte{0x31}, derSignature(one, one)[1:]...), false},
+		{"wrong integer tag", append([]byte{0x30, 0x06, 0x03}, derSignature(one, one)[3:]...), false},
+		{"long total length", append([]byte{0x30, 0x07}, derSignature(one, one)[2:]...), false},
+		{"short total length", append([]byte{0x30, 0x05}, derSignature(one, one)[2:]...), false},
+		{"trailing bytes", append(derSignature(one, one), 0x00), false},
+		{"truncated", derSignature(one, one)[:7], false},
+		{"missing s", []byte{0x30, 0x03, 0x02, 0x01, 0x01}, false},
+		{"empty", nil, false},
+	}
+
+	for _, tt := range tests {
+		_, _, err := parseSignature(tt.der)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if !tt.ok && !errors.Is(err, ErrBadSignatureEncoding) {
+			t.Errorf("%s: got %v, want ErrBadSignatureEncoding", tt.name, err)
+		}
+	}
+}
+
+// 脚本中的签名和公钥编码错误只会让 OP_CHECKSIG 返回假，交易无效但脚本执行不出错
+func TestCheckSigEncodings(t *testing.T) {
+	w := wallet.MakeWallet()
+	tx, prev := sighashTestTx(w)
+	if err := tx.SignInput(&w.PrivateKey, 1, prev, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	sig := tx.Inputs[1].ScriptSig[1 : 1+tx.Inputs[1].ScriptSig[0]]
+
+	pub := w.PrivateKey.PublicKey
+	uncompressed := append([]byte{0x04}, append(pub.X.FillBytes(make([]byte, 32)), pub.Y.FillBytes(make([]byte, 32))...)...)
+	wrongParity := append([]byte{}, w.PublicKey...)
+	wrongParity[0] ^= 0x01
+	offCurve := append([]byte{}, uncompressed...)
+	offCurve[len(offCurve)-1] ^= 0x01
+
+	tests := []struct {
+		name   string
+		sig    []byte
+		pubKey []byte
+		valid  bool
+	}{
+		{"compressed public key", sig, w.PublicKey, true},
+		{"uncompressed public key", sig, uncompressed, true},
+		{"wrong parity", sig, wrongParity, false},
+		{"point not on curve", sig, offCurve, false},
+		{"bad prefix", sig, append([]byte{0x05}, w.PublicKey[1:]...), false},
+		{"truncated public key", sig, w.PublicKey[:32], false},
+		{"empty signature", nil, w.PublicKey, false},
+		{"signature without hash type", sig[:len(sig)-1], w.PublicKey, false},
+		{"signature with extra byte", append(append(append([]byte{}, sig[:len(sig)-1]...), 0x00), sig[len(sig)-1]), w.PublicKey, false},
+	}
+
+	for _, tt := range tests {
+		// 直接执行 OP_CHECKSIG，不受 P2PKH 公钥哈希的限制；签名摘要使用被花费输出的锁定脚本
+		vm := scriptEngine{tx: tx, inIdx: 1, script: prev.Outputs[0].ScriptPubKey}
+		vm.push(tt.sig)
+		vm.push(tt.pubKey)
+		if err := vm.step(OpCheckSig, nil); err != nil {
+			t.Errorf("%s: OP_CHECKSIG failed with %v", tt.name, err)
+			continue
+		}
+		if vm.success() != tt.valid {
+			t.Errorf("%s: OP_CHECKSIG = %v, want %v", tt.name, vm.success(), tt.valid)
+		}
+	}
+
+	// P2PKH 锁定到压缩公钥的哈希，同一个密钥的未压缩公钥不能解锁
+	scriptSig := pushData(pushData(nil, sig), uncompressed)
+	if err := VerifyScript(scriptSig, prev.Outputs[0].ScriptPubKey, tx, 1); err == nil {
+		t.Error("P2PKH output locked to a compressed key was unlocked with the uncompressed key")
+	}
+
+	if !bytes.Equal(wallet.SerializePublicKey(&pub), w.PublicKey) || len(w.PublicKey) != wallet.CompressedPubKeyLen {
+		t.Error("wallet public key is not in compressed form")
+	}
+}
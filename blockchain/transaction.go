@@ -1,16 +1,13 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 
 	"blockchain_go/common"
@@ -18,44 +15,56 @@ import (
 )
 
 type Transaction struct {
-	ID      []byte
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       []byte
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime uint32 // 绝对锁定时间，交易在这个高度或时间之后才能打包（见 locktime.go）
 }
 
+// Hash 计算交易 ID：不包含解锁脚本的规范编码的 SHA-256，所以签名前后交易 ID 相同
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
+	var e encoder
+	tx.encode(&e, false)
+	hash := sha256.Sum256(e.buf)
 
-	txCopy := *tx
-	txCopy.ID = []byte{}
+	return hash[:]
+}
 
-	hash = sha256.Sum256(txCopy.Serialize())
+// FullHash 计算包括解锁脚本的规范编码的 SHA-256。区块的默克尔根用它构建，这样区块哈希也承诺了交易的签名，
+// 转发区块的节点不能在不改变区块哈希的情况下替换解锁脚本。coinbase 交易的 FullHash 与交易 ID 相同
+func (tx *Transaction) FullHash() []byte {
+	hash := sha256.Sum256(tx.Serialize())
 
 	return hash[:]
 }
 
+// Serialize 返回交易（包括签名）的规范二进制编码（见 encoding.go）
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
-
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	if err != nil {
-		log.Panic(err)
-	}
+	var e encoder
+	tx.encode(&e, true)
 
-	return encoded.Bytes()
+	return e.buf
 }
 
+// DeserializeTransaction 解码交易并重新计算交易 ID
 func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
+	transaction, err := DecodeTransaction(data)
 	common.HandlerError(err)
 	return transaction
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+// DecodeTransaction 与 DeserializeTransaction 相同，但数据格式错误时返回 ErrBadEncoding
+func DecodeTransaction(data []byte) (Transaction, error) {
+	var transaction Transaction
+
+	d := decoder{data: data}
+	transaction.decode(&d)
+	return transaction, d.finish()
+}
+
+// CoinbaseTx 创建高度为 height 的区块的第一笔交易，value 是区块奖励加上区块中所有交易的手续费。
+// 解锁脚本以区块高度开头（见 CheckBlock），不同区块的 coinbase 交易 ID 不会相同
+func CoinbaseTx(to, data string, height, value int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
@@ -63,56 +72,85 @@ func CoinbaseTx(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(20, to)
+	scriptSig := append(coinbaseHeight(height), data...)
+	txin := TxInput{[]byte{}, -1, scriptSig, SequenceFinal}
+	txout := NewTXOutput(value, to)
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
+	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}, 0}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
-	var inputs []TxInput
-	var outputs []TxOutput
-
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+// NewTransaction 从钱包 w 向 to 转账 amount，另外支付 fee 作为手续费，
+// 输入总额减去 amount 和 fee 后的余额作为找零返回给 w。
+// lockTime 不为 0 时交易在这个高度或时间之后才能打包（见 locktime.go）。
+// 向多个地址付款或者使用多个钱包的输入时使用 TxBuilder（见 builder.go）
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	if fee < 0 {
+		log.Panic("Error: fee must not be negative")
+	}
 
-	if acc < amount {
+	tx, err := NewTxBuilder(UTXO).
+		AddSource(WalletSource(w)).
+		AddPayment(to, amount).
+		SetFeePolicy(FixedFee(fee)).
+		SetLockTime(lockTime).
+		Build()
+	if errors.Is(err, ErrInsufficientFunds) {
 		log.Panic("Error: not enough funds")
 	}
+	common.HandlerError(err)
 
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
-		common.HandlerError(err)
+	return tx
+}
 
-		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
-			inputs = append(inputs, input)
-		}
+// NewDataTransaction 创建一笔把 data 写入数据输出（OP_RETURN）的交易，用于在链上锚定文档哈希等数据，
+// 钱包 w 支付手续费 fee，余额找零返回给 w
+func NewDataTransaction(w *wallet.Wallet, data []byte, fee int, UTXO *UTXOSet) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: negative fee %d", ErrBadPayment, fee)
 	}
 
-	from := fmt.Sprintf("%s", w.Address())
+	return NewTxBuilder(UTXO).
+		AddSource(WalletSource(w)).
+		AddData(data).
+		SetFeePolicy(FixedFee(fee)).
+		Build()
+}
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
+// NewMultisigTransaction 从多签赎回脚本 redeemScript 的 P2SH 地址向 to 转账 amount，
+// 用 privKeys 中与赎回脚本公钥对应的私钥签名，找零返回给 P2SH 地址
+func NewMultisigTransaction(redeemScript []byte, privKeys []*ecdsa.PrivateKey, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
+	if fee < 0 {
+		log.Panic("Error: fee must not be negative")
+	}
 
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	tx, err := NewTxBuilder(UTXO).
+		AddSource(MultisigSource(redeemScript, privKeys)).
+		AddPayment(to, amount).
+		SetFeePolicy(FixedFee(fee)).
+		SetLockTime(lockTime).
+		Build()
+	if errors.Is(err, ErrInsufficientFunds) {
+		log.Panic("Error: not enough funds")
 	}
+	common.HandlerError(err)
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	return tx
+}
 
-	return &tx
+// coinbaseHeight 返回 coinbase 解锁脚本开头压入区块高度的操作
+func coinbaseHeight(height int) []byte {
+	return pushData(nil, scriptNumBytes(int64(height)))
 }
 
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Sign 用 SigHashAll 签名交易的所有输入
+func (tx *Transaction) Sign(privKey *ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
 	}
@@ -123,66 +161,36 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-
-	for inId, in := range txCopy.Inputs {
+	for inId, in := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
-
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
+		err := tx.SignInput(privKey, inId, prevTX, SigHashAll)
 		common.HandlerError(err)
-		signature := append(r.Bytes(), s.Bytes()...)
-
-		tx.Inputs[inId].Signature = signature
-		txCopy.Inputs[inId].PubKey = nil
 	}
 }
 
+// Verify 对每个输入执行它的解锁脚本和被花费输出的锁定脚本（见 script.go），所有输入都解锁成功才返回 true
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+	return tx.VerifyScripts(prevTXs) == nil
+}
+
+// VerifyScripts 与 Verify 相同，但返回第一个没有解锁成功的输入的错误
+func (tx *Transaction) VerifyScripts(prevTXs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return true
+		return nil
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous transaction not correct")
+	for inIdx, in := range tx.Inputs {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if !ok || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
 		}
-	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
-	for inId, in := range tx.Inputs {
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-
-		r := big.Int{}
-		s := big.Int{}
-
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
-
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
-			return false
+		if err := VerifyScript(in.ScriptSig, prevTX.Outputs[in.Out].ScriptPubKey, tx, inIdx); err != nil {
+			return fmt.Errorf("input %d: %w", inIdx, err)
 		}
-		txCopy.Inputs[inId].PubKey = nil
 	}
 
-	return true
+	return nil
 }
 
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -190,14 +198,14 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
@@ -210,14 +218,26 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		if input.Sequence != SequenceFinal {
+			lines = append(lines, fmt.Sprintf("       Sequence:  %#x", input.Sequence))
+		}
+		if tx.IsCoinbase() {
+			lines = append(lines, fmt.Sprintf("       Data:      %x", input.ScriptSig))
+		} else {
+			lines = append(lines, fmt.Sprintf("       ScriptSig: %s", DisasmScript(input.ScriptSig)))
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", DisasmScript(output.ScriptPubKey)))
+		if address, ok := ExtractAddress(output.ScriptPubKey); ok {
+			lines = append(lines, fmt.Sprintf("       Address: %s", address))
+		}
+	}
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
 	}
 
 	return strings.Join(lines, "\n")
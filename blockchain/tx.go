@@ -2,72 +2,78 @@ package blockchain
 
 import (
 	"blockchain_go/common"
-	"blockchain_go/wallet"
 	"bytes"
-	"encoding/gob"
 )
 
-// TxOutput, 在 UTXO 模型下，每个输出就是一笔未花费的“钱”，可以被某个公钥解锁。
+// TxOutput, 在 UTXO 模型下，每个输出就是一笔未花费的“钱”，满足锁定脚本的条件才能花费。
 type TxOutput struct{
-	Value int     // 输出金额（token 数量）
-	PubKeyHash []byte // 对应拥有者的公钥或地址（表示谁能花这笔钱）
+	Value        int    // 输出金额（token 数量）
+	ScriptPubKey []byte // 锁定脚本，规定花费这笔钱需要满足的条件（见 script.go）
 }
 // TxInput, 输入就是“花钱的凭证”，指向某个未花费输出。
 type TxInput struct{
-	ID []byte  // 引用的 前一笔交易的 TxID（也就是你要花的那笔输出所在的交易）
-	Out int    // 前一笔交易中输出的索引（哪一个输出被花掉）
-	Signature []byte  // 签名或数据，用于证明你有权花掉这个输出
-	PubKey    []byte
+	ID        []byte // 引用的 前一笔交易的 TxID（也就是你要花的那笔输出所在的交易）
+	Out       int    // 前一笔交易中输出的索引（哪一个输出被花掉）
+	ScriptSig []byte // 解锁脚本，提供签名、公钥等满足锁定脚本的数据；coinbase 交易中是任意数据
+	Sequence  uint32 // 相对锁定时间，SequenceFinal 表示不锁定（见 locktime.go）
 }
 
+// TxOutputs 是 UTXO 集合中一笔交易剩余的未花费输出，key 为输出在原交易中的索引。
+// Height 和 IsCoinbase 记录输出来自哪个高度的区块、是否是 coinbase 交易，用于检查 coinbase 成熟度。
 type TxOutputs struct {
-	Outputs []TxOutput
+	Outputs    map[int]TxOutput
+	Height     int
+	IsCoinbase bool
 }
 
 /*
 In Bitcoin’s transaction model:
-A transaction output (TxOutput) is “locked” to a public key hash (pubKeyHash).
-To spend this output (UTXO), a transaction input (TxInput) must provide a valid
-signature and public key to “unlock” it.
+A transaction output (TxOutput) is “locked” by a script (ScriptPubKey), usually
+to a public key hash (P2PKH) or to the hash of a redeem script (P2SH).
+To spend this output (UTXO), a transaction input (TxInput) must provide a
+ScriptSig, e.g. a valid signature and public key, that “unlocks” it.
 */
 
-func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
-
-	return bytes.Equal(lockingHash, pubKeyHash)
+// IsLockedWithScript 判断输出是否使用锁定脚本 script
+func (out *TxOutput) IsLockedWithScript(script []byte) bool {
+	return bytes.Equal(out.ScriptPubKey, script)
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
-}
+// NewTXOutput 创建发送到 address 的输出，address 可以是 P2PKH 或 P2SH 地址
+func NewTXOutput(value int, address string) *TxOutput {
+	script, err := LockScript(address)
+	common.HandlerError(err)
 
-func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Equal(out.PubKeyHash, pubKeyHash)
+	return &TxOutput{value, script}
 }
 
-func NewTXOutput(value int, address string) *TxOutput {
-	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
-	return txo
+// IsMature 判断这些输出能否被高度为 spendHeight 的区块中的交易花费，
+// coinbase 交易的输出要经过 ChainParams.CoinbaseMaturity 个区块才能花费
+func (outs TxOutputs) IsMature(spendHeight int) bool {
+	return !outs.IsCoinbase || spendHeight-outs.Height >= ChainParams.CoinbaseMaturity
 }
 
+// Serialize 返回 UTXO 条目的规范二进制编码（见 encoding.go）
 func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
+	var e encoder
+	outs.encode(&e)
+
+	return e.buf
+}
 
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
+func DeserializeOutputs(data []byte) TxOutputs {
+	outputs, err := DecodeOutputs(data)
 	common.HandlerError(err)
 
-	return buffer.Bytes()
+	return outputs
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
+// DecodeOutputs 与 DeserializeOutputs 相同，但数据格式错误时返回 ErrBadEncoding
+func DecodeOutputs(data []byte) (TxOutputs, error) {
 	var outputs TxOutputs
 
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	common.HandlerError(err)
-	return outputs
-}
\ No newline at end of file
+	d := decoder{data: data}
+	outputs.decode(&d)
+
+	return outputs, d.finish()
+}
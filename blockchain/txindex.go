@@ -0,0 +1,249 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+交易索引和地址历史索引。
+FindTransaction 原来从 tip 开始向前遍历整条链查找交易，地址的历史交易也只能遍历整条链得到。
+这里为主链上的交易保存两个索引：
+  交易索引  key: "txidx-" + 32 字节交易 ID
+           value: version, bytes 区块哈希, varint 区块高度, uvarint 交易在区块中的位置
+  地址历史  key: "hist-" + 21 字节地址键（见 utxoindex.go）+ 4 字节大端区块高度 + 4 字节大端交易位置
+           value: version, bytes 交易 ID, varint Received, varint Sent
+           Received 是交易支付给这个地址的金额，Sent 是交易花掉的这个地址的输出的金额
+
+两个索引与 UTXO 集合在同一个 Badger 事务中由 UTXOSet.Update 写入、UTXOSet.Undo 删除，
+所以链重组后只包含新主链上的交易；UTXOSet.Reindex 从主链重新生成它们。
+*/
+
+var (
+	txIndexPrefix = []byte("txidx-")
+	historyPrefix = []byte("hist-")
+)
+
+var ErrTxNotFound = errors.New("transaction does not exist in the main chain")
+
+// TxLocation 是交易在主链上的位置
+type TxLocation struct {
+	BlockHash []byte
+	Height    int
+	Index     int
+}
+
+// HistoryEntry 是一个地址的一笔历史交易
+type HistoryEntry struct {
+	TxID     []byte
+	Height   int
+	Index    int
+	Received int
+	Sent     int
+}
+
+func txIndexKey(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+func historyAddressPrefix(addrKey []byte) []byte {
+	return append(append([]byte{}, historyPrefix...), addrKey...)
+}
+
+func historyKey(addrKey []byte, height, index int) []byte {
+	key := binary.BigEndian.AppendUint32(historyAddressPrefix(addrKey), uint32(height))
+	return binary.BigEndian.AppendUint32(key, uint32(index))
+}
+
+func (loc *TxLocation) encode(e *encoder) {
+	e.uvarint(encodingVersion)
+	e.bytes(loc.BlockHash)
+	e.varint(int64(loc.Height))
+	e.uvarint(uint64(loc.Index))
+}
+
+func (loc *TxLocation) decode(d *decoder) {
+	d.version()
+	loc.BlockHash = d.bytes()
+	loc.Height = d.int()
+	loc.Index = int(d.uvarint())
+}
+
+func (h *HistoryEntry) encode(e *encoder) {
+	e.uvarint(encodingVersion)
+	e.bytes(h.TxID)
+	e.varint(int64(h.Received))
+	e.varint(int64(h.Sent))
+}
+
+func (h *HistoryEntry) decode(d *decoder) {
+	d.version()
+	h.TxID = d.bytes()
+	h.Received = d.int()
+	h.Sent = d.int()
+}
+
+// getTxLocation 读取交易 txID 在主链上的位置
+func getTxLocation(txn *badger.Txn, txID []byte) (TxLocation, error) {
+	var loc TxLocation
+
+	item, err := txn.Get(txIndexKey(txID))
+	if err == badger.ErrKeyNotFound {
+		return loc, fmt.Errorf("%w: %x", ErrTxNotFound, txID)
+	} else if err != nil {
+		return loc, err
+	}
+
+	err = item.Value(func(val []byte) error {
+		d := decoder{data: val}
+		loc.decode(&d)
+		return d.finish()
+	})
+
+	return loc, err
+}
+
+// getBlock 在事务 txn 中读取区块
+func getBlock(txn *badger.Txn, hash []byte) (*Block, error) {
+	item, err := txn.Get(hash)
+	if err != nil {
+		return nil, fmt.Errorf("block %x: %w", hash, err)
+	}
+
+	var block *Block
+	err = item.Value(func(val []byte) error {
+		block, err = DecodeBlock(val)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("block %x: %w", hash, err)
+	}
+
+	return block, nil
+}
+
+// getIndexedTransaction 通过交易索引读取交易和它所在区块的高度
+func getIndexedTransaction(txn *badger.Txn, txID []byte) (Transaction, int, error) {
+	loc, err := getTxLocation(txn, txID)
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+	block, err := getBlock(txn, loc.BlockHash)
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+	if loc.Index >= len(block.Transactions) {
+		return Transaction{}, 0, fmt.Errorf("%w: %x has index %d in block %x", ErrTxNotFound, txID, loc.Index, loc.BlockHash)
+	}
+
+	return *block.Transactions[loc.Index], loc.Height, nil
+}
+
+// txHistory 计算交易 tx 涉及的地址和每个地址的收支，prevOuts 是交易各个输入花费的输出（coinbase 交易为空）
+func txHistory(tx *Transaction, prevOuts []TxOutput) map[string]*HistoryEntry {
+	entries := make(map[string]*HistoryEntry)
+	entry := func(script []byte) *HistoryEntry {
+		addrKey := string(addressIndexKey(script))
+		if entries[addrKey] == nil {
+			entries[addrKey] = &HistoryEntry{TxID: tx.ID}
+		}
+		return entries[addrKey]
+	}
+
+	for _, out := range prevOuts {
+		entry(out.ScriptPubKey).Sent += out.Value
+	}
+	for _, out := range tx.Outputs {
+		if IsUnspendable(out.ScriptPubKey) {
+			continue
+		}
+		entry(out.ScriptPubKey).Received += out.Value
+	}
+
+	return entries
+}
+
+// indexTransaction 把高度为 height 的区块 blockHash 中第 index 笔交易加入交易索引和地址历史
+func indexTransaction(txn *badger.Txn, tx *Transaction, prevOuts []TxOutput, blockHash []byte, height, index int) error {
+	loc := TxLocation{blockHash, height, index}
+	var e encoder
+	loc.encode(&e)
+	if err := txn.Set(txIndexKey(tx.ID), e.buf); err != nil {
+		return err
+	}
+
+	for addrKey, entry := range txHistory(tx, prevOuts) {
+		var e encoder
+		entry.encode(&e)
+		if err := txn.Set(historyKey([]byte(addrKey), height, index), e.buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexTransaction 是 indexTransaction 的逆操作
+func unindexTransaction(txn *badger.Txn, tx *Transaction, prevOuts []TxOutput, height, index int) error {
+	if err := txn.Delete(txIndexKey(tx.ID)); err != nil {
+		return err
+	}
+
+	for addrKey := range txHistory(tx, prevOuts) {
+		if err := txn.Delete(historyKey([]byte(addrKey), height, index)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindTransactionLocation 通过交易索引返回交易在主链上的位置
+func (chain *BlockChain) FindTransactionLocation(txID []byte) (TxLocation, error) {
+	var loc TxLocation
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		loc, err = getTxLocation(txn, txID)
+		return err
+	})
+
+	return loc, err
+}
+
+// GetHistory 通过地址历史索引返回锁定脚本为 lockScript 的地址在主链上的所有交易，按区块高度和交易位置排序
+func (chain *BlockChain) GetHistory(lockScript []byte) ([]HistoryEntry, error) {
+	var history []HistoryEntry
+	prefix := historyAddressPrefix(addressIndexKey(lockScript))
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()[len(prefix):]
+			if len(key) != 8 {
+				continue
+			}
+
+			entry := HistoryEntry{
+				Height: int(binary.BigEndian.Uint32(key[:4])),
+				Index:  int(binary.BigEndian.Uint32(key[4:])),
+			}
+			err := it.Item().Value(func(val []byte) error {
+				d := decoder{data: val}
+				entry.decode(&d)
+				return d.finish()
+			})
+			if err != nil {
+				return err
+			}
+			history = append(history, entry)
+		}
+		return nil
+	})
+
+	return history, err
+}
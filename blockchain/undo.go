@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+区块的撤销数据（undo data）。
+UTXOSet.Update 连接区块时会从 UTXO 集合中删除区块花掉的输出，链重组断开区块时需要把它们放回去。
+为了不用再到链上查找被花费的交易，Update 在删除之前把这些输出按顺序记录下来：
+  key:   "undo-" + 区块哈希
+  value: version, uvarint 个数, 按区块中非 coinbase 交易的顺序、每笔交易输入的顺序，
+         每个被花费的输出 {varint Height, 1 字节 IsCoinbase, varint Value, bytes ScriptPubKey}
+UTXOSet.Undo 读取撤销数据恢复 UTXO 集合，然后删除撤销数据。
+*/
+
+var undoPrefix = []byte("undo-")
+
+// SpentOutput 是被区块中的交易花掉的输出，Height 和 IsCoinbase 与它在 UTXO 集合中的条目相同
+type SpentOutput struct {
+	Output     TxOutput
+	Height     int
+	IsCoinbase bool
+}
+
+// BlockUndo 是一个区块的撤销数据
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
+}
+
+func (u *BlockUndo) encode(e *encoder) {
+	e.uvarint(encodingVersion)
+	e.uvarint(uint64(len(u.Spent)))
+	for _, spent := range u.Spent {
+		e.varint(int64(spent.Height))
+		e.bool(spent.IsCoinbase)
+		e.varint(int64(spent.Output.Value))
+		e.bytes(spent.Output.ScriptPubKey)
+	}
+}
+
+func (u *BlockUndo) decode(d *decoder) {
+	d.version()
+	u.Spent = make([]SpentOutput, d.count())
+	for i := range u.Spent {
+		u.Spent[i].Height = d.int()
+		u.Spent[i].IsCoinbase = d.bool()
+		u.Spent[i].Output = TxOutput{d.int(), d.bytes()}
+	}
+}
+
+func putBlockUndo(txn *badger.Txn, hash []byte, undo *BlockUndo) error {
+	var e encoder
+	undo.encode(&e)
+
+	return txn.Set(undoKey(hash), e.buf)
+}
+
+func getBlockUndo(txn *badger.Txn, hash []byte) (*BlockUndo, error) {
+	item, err := txn.Get(undoKey(hash))
+	if err != nil {
+		return nil, fmt.Errorf("undo data of block %x: %w", hash, err)
+	}
+
+	undo := &BlockUndo{}
+	err = item.Value(func(val []byte) error {
+		d := decoder{data: val}
+		undo.decode(&d)
+		return d.finish()
+	})
+
+	return undo, err
+}
+
+// spentByTx 按区块中交易的顺序把撤销数据分给每笔交易，coinbase 交易没有被花费的输出
+func (u *BlockUndo) spentByTx(block *Block) ([][]SpentOutput, error) {
+	spent := make([][]SpentOutput, len(block.Transactions))
+	next := 0
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		if next+len(tx.Inputs) > len(u.Spent) {
+			return nil, fmt.Errorf("%w: undo data of block %x has %d spent outputs", ErrBadEncoding, block.Hash, len(u.Spent))
+		}
+		spent[i] = u.Spent[next : next+len(tx.Inputs)]
+		next += len(tx.Inputs)
+	}
+	if next != len(u.Spent) {
+		return nil, fmt.Errorf("%w: undo data of block %x has %d spent outputs, block spends %d", ErrBadEncoding, block.Hash, len(u.Spent), next)
+	}
+
+	return spent, nil
+}
@@ -14,9 +14,8 @@ UTXO Set 是一个集合，它包含了所有未花费的交易输出。在比
 // UTXO Set 用于存储和管理所有未花费的交易输出（UTXO）。
 import (
 	"blockchain_go/common"
-	"bytes"
 	"encoding/hex"
-	"log"
+	"fmt"
 
 	"github.com/dgraph-io/badger"
 )
@@ -24,84 +23,106 @@ import (
 var (
 	utxoPrefix   = []byte("utxo-")
 	prefixLength = len(utxoPrefix)
+
+	// utxoBestKey 记录 UTXO 集合对应的主链 tip，正常情况下与 "lh" 相同（见 repair.go）
+	utxoBestKey = []byte("bestutxo")
 )
 
+func utxoKey(txID []byte) []byte {
+	return append(append([]byte{}, utxoPrefix...), txID...)
+}
+
 type UTXOSet struct {
 	Blockchain *BlockChain
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOuts := make(map[string][]int)
-	accumulated := 0
-	db := u.Blockchain.Database
-
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+// FindSpendableOutputs 用 DefaultCoinSelector 从锁定脚本为 lockScript、可以在下一个区块中花费的输出中选择总额达到 amount 的输出，
+// 还没有成熟的 coinbase 输出不会被选中。余额不足时返回所有可以花费的输出
+func (u UTXOSet) FindSpendableOutputs(lockScript []byte, amount int) (int, map[string][]int) {
+	return u.SelectSpendableOutputs(lockScript, amount, DefaultCoinSelector)
+}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+// SelectSpendableOutputs 与 FindSpendableOutputs 相同，但使用选币方法 selector（见 coinselect.go）
+func (u UTXOSet) SelectSpendableOutputs(lockScript []byte, amount int, selector CoinSelector) (int, map[string][]int) {
+	coins := u.SpendableCoins(lockScript)
+	selected, err := selector(coins, amount)
+	if err != nil {
+		selected = coins
+	}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var v []byte
-			if err := item.Value(func(val []byte) error {
-				v = append(v, val...)
-				return nil
-			}); err != nil{
-				common.HandlerError(err)
-			}
-			
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
-			}
-		}
-		return nil
-	})
-	common.HandlerError(err)
+	unspentOuts := make(map[string][]int)
+	for _, coin := range selected {
+		txID := hex.EncodeToString(coin.TxID)
+		unspentOuts[txID] = append(unspentOuts[txID], coin.Out)
+	}
 
-	return accumulated, unspentOuts
+	return sumCoins(selected), unspentOuts
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
+// FindOutput 在 UTXO 集合中查找交易 txID 的第 outIdx 个输出，输出已花费或不存在时返回 false
+func (u UTXOSet) FindOutput(txID []byte, outIdx int) (TxOutput, bool, error) {
+	outs, ok, err := u.FindOutputs(txID)
+	if !ok || err != nil {
+		return TxOutput{}, false, err
+	}
+	out, found := outs.Outputs[outIdx]
 
-	db := u.Blockchain.Database
+	return out, found, nil
+}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+// FindOutputs 返回交易 txID 在 UTXO 集合中的条目，交易的输出已经全部花费时返回 false。
+// 读取数据库失败或者条目无法解码时返回错误
+func (u UTXOSet) FindOutputs(txID []byte) (TxOutputs, bool, error) {
+	var outs TxOutputs
+	found := false
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoKey(txID))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			var v []byte
-		   if err := item.Value(func(val []byte) error {
-				v = append(v, val...)
-				return nil
-			}); err != nil{
-				common.HandlerError(err)
-			}
-			outs := DeserializeOutputs(v)
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+		return item.Value(func(val []byte) error {
+			if outs, err = DecodeOutputs(val); err != nil {
+				return err
 			}
-
-		}
-		return nil
+			found = true
+			return nil
+		})
 	})
+	if err != nil {
+		return TxOutputs{}, false, fmt.Errorf("utxo of transaction %x: %w", txID, err)
+	}
+
+	return outs, found, nil
+}
+
+// GetBalance 通过地址索引返回锁定脚本为 lockScript 的输出的余额：spendable 是下一个区块中可以花费的金额，immature 是还没有成熟的 coinbase 奖励
+func (u UTXOSet) GetBalance(lockScript []byte) (spendable, immature int) {
+	bestHeight, err := u.Blockchain.GetBestHeight()
 	common.HandlerError(err)
 
+	for _, coin := range u.ListUnspent(lockScript) {
+		outs := TxOutputs{Height: coin.Height, IsCoinbase: coin.IsCoinbase}
+		if outs.IsMature(bestHeight + 1) {
+			spendable += coin.Value
+		} else {
+			immature += coin.Value
+		}
+	}
+
+	return spendable, immature
+}
+
+// FindUnspentTransactions 通过地址索引返回锁定脚本为 lockScript 的所有未花费输出
+func (u UTXOSet) FindUnspentTransactions(lockScript []byte) []TxOutput {
+	var UTXOs []TxOutput
+	for _, coin := range u.ListUnspent(lockScript) {
+		UTXOs = append(UTXOs, TxOutput{coin.Value, lockScript})
+	}
+
 	return UTXOs
 }
 
@@ -126,122 +147,239 @@ func (u UTXOSet) CountTransactions() int {
 	return counter
 }
 
-func (u UTXOSet) Reindex() {
+// Reindex 从主链重新生成 UTXO 集合、地址索引、交易索引、地址历史和撤销数据。
+// 从创世块开始按主链顺序逐个连接区块，每个区块一个事务，内存中只保存当前的区块，链再长也不会超过事务大小的限制。
+// 连接区块的过程中退出时，UTXO 集合停在已经连接的最后一个区块，下次启动时从那里继续连接到 tip（见 repair.go）
+func (u UTXOSet) Reindex() error {
 	db := u.Blockchain.Database
 
-	u.DeleteByPrefix(utxoPrefix)
-
-	UTXO := u.Blockchain.FindUTXO()
-
+	// 删除旧数据的过程中退出时 UTXO 集合没有最佳区块，下次启动时会重新生成（见 repair.go）
 	err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			common.HandlerError(err)
-			key = append(utxoPrefix, key...)
+		return txn.Delete(utxoBestKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range [][]byte{utxoPrefix, addrUTXOPrefix, txIndexPrefix, historyPrefix, undoPrefix} {
+		if err := u.DeleteByPrefix(prefix); err != nil {
+			return err
+		}
+	}
 
-			err = txn.Set(key, outs.Serialize())
-			common.HandlerError(err)
+	bestHeight, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	for height := 0; height <= bestHeight; height++ {
+		err := db.Update(func(txn *badger.Txn) error {
+			hash, err := getMainChainHash(txn, height)
+			if err != nil {
+				return fmt.Errorf("main chain block at height %d: %w", height, err)
+			}
+			block, err := getBlock(txn, hash)
+			if err != nil {
+				return err
+			}
+			return connectUTXO(txn, block)
+		})
+		if err != nil {
+			return err
 		}
+	}
 
-		return nil
+	return nil
+}
+
+// Update 把 block 连接到 UTXO 集合，不移动主链 tip；连接主链区块使用 BlockChain.ConnectBlock
+func (u *UTXOSet) Update(block *Block) {
+	err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return connectUTXO(txn, block)
 	})
 	common.HandlerError(err)
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+// Undo 是 Update 的逆操作，不移动主链 tip；断开主链区块使用 BlockChain.DisconnectBlock
+func (u *UTXOSet) Undo(block *Block) {
+	err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return undoUTXO(txn, block)
+	})
+	common.HandlerError(err)
+}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					common.HandlerError(err)
-					var v []byte
-					err = item.Value(func(val []byte) error {
-						v = append(v, val...)
-						return nil
-					})
-					common.HandlerError(err)
-
-					outs := DeserializeOutputs(v)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
-					}
+// connectUTXO 在事务 txn 中把 block 连接到 UTXO 集合：删除区块中交易花掉的输出，加入新的输出，
+// 记录撤销数据（见 undo.go），更新地址索引、交易索引和地址历史（见 utxoindex.go、txindex.go），
+// 并把 UTXO 集合的最佳区块设为 block
+func connectUTXO(txn *badger.Txn, block *Block) error {
+	undo := &BlockUndo{}
+	for txIdx, tx := range block.Transactions {
+		// checkBlockTransactions 已经拒绝了这样的区块，这里防止覆盖 UTXO 集合中的条目，断开区块时再把它删除
+		if _, err := txn.Get(utxoKey(tx.ID)); err == nil {
+			return fmt.Errorf("%w: %x", ErrOverwriteTx, tx.ID)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		var prevOuts []TxOutput
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				inID := utxoKey(in.ID)
+				item, err := txn.Get(inID)
+				if err != nil {
+					return fmt.Errorf("%w: %x:%d: %v", ErrMissingInput, in.ID, in.Out, err)
+				}
+				var outs TxOutputs
+				err = item.Value(func(val []byte) error {
+					d := decoder{data: val}
+					outs.decode(&d)
+					return d.finish()
+				})
+				if err != nil {
+					return err
+				}
+				out, ok := outs.Outputs[in.Out]
+				if !ok {
+					return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
+				}
+
+				prevOuts = append(prevOuts, out)
+				undo.Spent = append(undo.Spent, SpentOutput{out, outs.Height, outs.IsCoinbase})
+				if err := deleteAddrUTXO(txn, in.ID, in.Out, out); err != nil {
+					return err
+				}
+				delete(outs.Outputs, in.Out)
+
+				if len(outs.Outputs) == 0 {
+					err = txn.Delete(inID)
+				} else {
+					err = txn.Set(inID, outs.Serialize())
+				}
+				if err != nil {
+					return err
 				}
 			}
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
+		}
+		if err := indexTransaction(txn, tx, prevOuts, block.Hash, block.Height, txIdx); err != nil {
+			return err
+		}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+		// 不能花费的输出（例如数据输出）不进入 UTXO 集合
+		newOutputs := TxOutputs{make(map[int]TxOutput), block.Height, tx.IsCoinbase()}
+		for outIdx, out := range tx.Outputs {
+			if IsUnspendable(out.ScriptPubKey) {
+				continue
+			}
+			newOutputs.Outputs[outIdx] = out
+			if err := putAddrUTXO(txn, tx.ID, outIdx, out, block.Height, tx.IsCoinbase()); err != nil {
+				return err
 			}
 		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
 
-		return nil
-	})
-	common.HandlerError(err)
+		if err := txn.Set(utxoKey(tx.ID), newOutputs.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	if err := putBlockUndo(txn, block.Hash, undo); err != nil {
+		return err
+	}
+	return txn.Set(utxoBestKey, block.Hash)
 }
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
+// undoUTXO 是 connectUTXO 的逆操作：删除区块中交易产生的输出，用撤销数据把这些交易花掉的输出放回 UTXO 集合，
+// 删除这些交易的索引和区块的撤销数据，并把 UTXO 集合的最佳区块设为 block 的父区块。
+// 交易按倒序处理，这样同一区块内互相引用的交易也能正确回滚。
+func undoUTXO(txn *badger.Txn, block *Block) error {
+	undo, err := getBlockUndo(txn, block.Hash)
+	if err != nil {
+		return err
+	}
+	spentByTx, err := undo.spentByTx(block)
+	if err != nil {
+		return err
+	}
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		if err := txn.Delete(utxoKey(tx.ID)); err != nil {
+			return err
+		}
+		for outIdx, out := range tx.Outputs {
+			if err := deleteAddrUTXO(txn, tx.ID, outIdx, out); err != nil {
+				return err
+			}
+		}
+
+		var prevOuts []TxOutput
+		for j, in := range tx.Inputs {
+			if tx.IsCoinbase() {
+				break
+			}
+			spent := spentByTx[i][j]
+			prevOuts = append(prevOuts, spent.Output)
+
+			inID := utxoKey(in.ID)
+			outs := TxOutputs{make(map[int]TxOutput), spent.Height, spent.IsCoinbase}
+			item, err := txn.Get(inID)
+			if err == nil {
+				if err := item.Value(func(val []byte) error {
+					d := decoder{data: val}
+					outs.decode(&d)
+					return d.finish()
+				}); err != nil {
 					return err
 				}
+			} else if err != badger.ErrKeyNotFound {
+				return err
 			}
-			return nil
-		}); err != nil {
+
+			outs.Outputs[in.Out] = spent.Output
+			if err := txn.Set(inID, outs.Serialize()); err != nil {
+				return err
+			}
+			if err := putAddrUTXO(txn, in.ID, in.Out, spent.Output, spent.Height, spent.IsCoinbase); err != nil {
+				return err
+			}
+		}
+
+		if err := unindexTransaction(txn, tx, prevOuts, block.Height, i); err != nil {
 			return err
 		}
-		return nil
 	}
 
-	collectSize := 100000
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
+	if err := txn.Delete(undoKey(block.Hash)); err != nil {
+		return err
+	}
+	return txn.Set(utxoBestKey, block.PrevHash)
+}
+
+// DeleteByPrefix 删除所有以 prefix 开头的 key。删除通过 WriteBatch 写入，事务快要超过大小限制时自动提交，
+// key 再多也不会返回 ErrTxnTooBig
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
+	db := u.Blockchain.Database
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
-		}
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+			if err := wb.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
-}
\ No newline at end of file
+	if err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"encoding/binary"
+
+	"blockchain_go/common"
+	"blockchain_go/wallet"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+按地址索引的 UTXO。
+UTXO 集合以交易 ID 为 key，查找一个地址的输出需要遍历整个集合。
+地址索引为每个未花费输出另外保存一条记录，查找一个地址的输出只需要遍历这个地址的前缀：
+  key:   "addrutxo-" + 21 字节地址键 + 32 字节交易 ID + 4 字节大端输出索引
+  value: version, varint Value, varint Height, 1 字节 IsCoinbase
+
+地址键是 1 字节版本 + 20 字节哈希：P2PKH 输出是公钥哈希（版本 0x00），P2SH 输出是脚本哈希（版本 0x05），
+其他脚本是整个脚本的 HASH160（版本 0xff）。
+索引与 UTXO 集合在同一个 Badger 事务中由 Update、Undo 和 Reindex 维护。
+*/
+
+var addrUTXOPrefix = []byte("addrutxo-")
+
+const nonStandardScriptVersion = 0xff
+
+// addressIndexKey 返回锁定脚本 script 的地址键
+func addressIndexKey(script []byte) []byte {
+	switch {
+	case isP2PKH(script):
+		return append([]byte{wallet.PubKeyHashVersion}, script[3:23]...)
+	case IsP2SH(script):
+		return append([]byte{wallet.ScriptHashVersion}, script[2:22]...)
+	}
+
+	return append([]byte{nonStandardScriptVersion}, wallet.PublicKeyHash(script)...)
+}
+
+func addrUTXOScriptPrefix(script []byte) []byte {
+	return append(append([]byte{}, addrUTXOPrefix...), addressIndexKey(script)...)
+}
+
+func addrUTXOKey(script, txID []byte, outIdx int) []byte {
+	key := append(addrUTXOScriptPrefix(script), txID...)
+	return binary.BigEndian.AppendUint32(key, uint32(outIdx))
+}
+
+func (c *UnspentOutput) encode(e *encoder) {
+	e.uvarint(encodingVersion)
+	e.varint(int64(c.Value))
+	e.varint(int64(c.Height))
+	e.bool(c.IsCoinbase)
+}
+
+func (c *UnspentOutput) decode(d *decoder) {
+	d.version()
+	c.Value = d.int()
+	c.Height = d.int()
+	c.IsCoinbase = d.bool()
+}
+
+// putAddrUTXO 把交易 txID 的第 outIdx 个输出加入地址索引
+func putAddrUTXO(txn *badger.Txn, txID []byte, outIdx int, out TxOutput, height int, isCoinbase bool) error {
+	coin := UnspentOutput{nil, outIdx, out.Value, height, isCoinbase}
+	var e encoder
+	coin.encode(&e)
+
+	return txn.Set(addrUTXOKey(out.ScriptPubKey, txID, outIdx), e.buf)
+}
+
+// deleteAddrUTXO 从地址索引中删除交易 txID 的第 outIdx 个输出
+func deleteAddrUTXO(txn *badger.Txn, txID []byte, outIdx int, out TxOutput) error {
+	return txn.Delete(addrUTXOKey(out.ScriptPubKey, txID, outIdx))
+}
+
+// ListUnspent 通过地址索引返回锁定脚本为 lockScript 的所有未花费输出，包括还没有成熟的 coinbase 输出
+func (u UTXOSet) ListUnspent(lockScript []byte) []UnspentOutput {
+	var coins []UnspentOutput
+	prefix := addrUTXOScriptPrefix(lockScript)
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()[len(prefix):]
+			if len(key) != 32+4 {
+				continue
+			}
+
+			var coin UnspentOutput
+			err := it.Item().Value(func(val []byte) error {
+				d := decoder{data: val}
+				coin.decode(&d)
+				return d.finish()
+			})
+			if err != nil {
+				return err
+			}
+			coin.TxID = append([]byte{}, key[:32]...)
+			coin.Out = int(binary.BigEndian.Uint32(key[32:]))
+			coins = append(coins, coin)
+		}
+		return nil
+	})
+	common.HandlerError(err)
+
+	return coins
+}
+
+// SpendableCoins 返回锁定脚本为 lockScript、可以在下一个区块中花费的输出
+func (u UTXOSet) SpendableCoins(lockScript []byte) []UnspentOutput {
+	bestHeight, err := u.Blockchain.GetBestHeight()
+	common.HandlerError(err)
+
+	var coins []UnspentOutput
+	for _, coin := range u.ListUnspent(lockScript) {
+		outs := TxOutputs{Height: coin.Height, IsCoinbase: coin.IsCoinbase}
+		if outs.IsMature(bestHeight + 1) {
+			coins = append(coins, coin)
+		}
+	}
+
+	return coins
+}
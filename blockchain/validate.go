@@ -0,0 +1,579 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+区块验证（共识规则）。
+
+一个区块只有通过下面所有检查才会被保存并连接到主链：
+1. 与上下文无关的检查（CheckBlock）：
+   - 区块编码后不超过 MaxBlockSize 字节，至少包含一笔交易，且第一笔是唯一的 coinbase 交易
+   - coinbase 的解锁脚本以压入区块高度的操作开头，不同区块的 coinbase 交易 ID 不会相同
+   - 默克尔根与区块中的交易（包括解锁脚本）一致，区块哈希与区块内容一致，并满足工作量证明
+   - 交易 ID 与交易内容一致，区块内没有重复交易，交易不会两次花费同一个输出，输出金额和交易的输出总额在 0 到 MaxMoney 之间
+   - 以 OP_RETURN 开头的输出必须是金额为 0 的标准数据输出（见 script.go）
+2. 与父区块相关的检查：
+   - PrevHash 必须指向已知区块
+   - Height 必须等于父区块高度 + 1，Bits 必须等于按难度调整规则计算出的目标值
+   - 时间戳必须大于最近 11 个区块时间戳的中位数，且不能超前当前时间太多
+3. 交易检查（只在区块连接到主链时进行，因为需要对应的 UTXO 集合）：
+   - 所有输入必须引用存在且未花费的输出（防止双花）
+   - 交易 ID 不能与 UTXO 集合中还有未花费输出的交易相同，否则连接区块会覆盖原来的输出，断开区块时又会把它们删除
+   - coinbase 输出必须经过 CoinbaseMaturity 个区块才能花费，防止链重组后花费的奖励消失
+   - 交易的绝对和相对锁定时间必须已经到期（见 locktime.go）
+   - 每个输入的解锁脚本必须满足被花费输出的锁定脚本（签名有效）
+   - 输入总额不能小于输出总额，差额是交易手续费；所有求和都检查溢出并且不能超过 MaxMoney
+   - coinbase 的输出总额不能超过区块奖励（BlockSubsidy）加上区块中所有交易的手续费
+   侧链上的区块在保存之前先检查解锁脚本（checkBlockScripts），解锁脚本无效的区块不会被保存。
+
+内存池接收其他节点发来的交易时（CheckTransaction）对单独的交易做同样的检查，花费的输出可以在 UTXO 集合中，
+也可以是内存池中另一笔交易的输出；两处都找不到的交易返回 ErrOrphanTx，由内存池暂时保存，等父交易到达后再检查。
+IsRuleError 区分违反共识规则的错误和暂时无法验证的情况。
+*/
+
+const (
+	medianTimeBlocks   = 11
+	maxFutureBlockTime = 2 * 60 * 60 // 秒
+)
+
+var (
+	ErrBlockTooLarge     = errors.New("block is larger than the maximum block size")
+	ErrNoTransactions    = errors.New("block contains no transactions")
+	ErrBadCoinbase       = errors.New("first transaction must be the only coinbase")
+	ErrBadCoinbaseHeight = errors.New("coinbase does not start with the block height")
+	ErrBadMerkleRoot     = errors.New("merkle root does not match block transactions")
+	ErrBadBlockHash      = errors.New("block hash does not match block content")
+	ErrBadProofOfWork    = errors.New("block hash does not satisfy proof of work")
+	ErrBadDifficulty     = errors.New("block target does not match required difficulty")
+	ErrDuplicateTx       = errors.New("duplicate transaction in block")
+	ErrOverwriteTx       = errors.New("transaction ID already has unspent outputs")
+	ErrBadTxID           = errors.New("transaction ID does not match transaction content")
+	ErrBadPrevHash       = errors.New("block does not link to a valid previous block")
+	ErrOrphanBlock       = errors.New("previous block is unknown")
+	ErrBadHeight         = errors.New("block height does not follow its parent")
+	ErrTimeTooOld        = errors.New("block timestamp is not after median time past")
+	ErrTimeTooNew        = errors.New("block timestamp is too far in the future")
+	ErrMissingInput      = errors.New("transaction input spends a missing or already spent output")
+	ErrDoubleSpend       = errors.New("output is spent twice")
+	ErrImmatureSpend     = errors.New("transaction spends an immature coinbase output")
+	ErrBadSignature      = errors.New("transaction input script or signature is invalid")
+	ErrBadTxValue        = errors.New("transaction output value is invalid")
+	ErrBadDataOutput     = errors.New("data output is invalid")
+	ErrBadCoinbaseValue  = errors.New("coinbase pays more than the block reward")
+	ErrOrphanTx          = errors.New("transaction spends an unknown transaction")
+)
+
+// ruleErrors 是违反共识规则的错误，这样的区块或交易以后也不会变得有效。
+// 不包括 ErrOrphanBlock、ErrOrphanTx（父区块或父交易可能稍后到达）和 ErrTimeTooNew（取决于本地时钟）
+var ruleErrors = []error{
+	ErrBlockTooLarge, ErrNoTransactions, ErrBadCoinbase, ErrBadCoinbaseHeight, ErrBadMerkleRoot, ErrBadBlockHash,
+	ErrBadProofOfWork, ErrBadDifficulty, ErrDuplicateTx, ErrOverwriteTx, ErrBadTxID, ErrBadPrevHash, ErrBadHeight,
+	ErrTimeTooOld, ErrMissingInput, ErrDoubleSpend, ErrImmatureSpend, ErrBadSignature, ErrBadTxValue,
+	ErrBadDataOutput, ErrBadCoinbaseValue, ErrNonFinalTx, ErrSequenceLock, ErrBadEncoding,
+}
+
+// IsRuleError 判断 err 是否说明区块或交易违反了共识规则，而不是数据库错误或者暂时无法验证
+func IsRuleError(err error) bool {
+	for _, ruleErr := range ruleErrors {
+		if errors.Is(err, ruleErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateBlock 在区块保存之前执行共识检查。
+// 父区块不存在时返回 ErrOrphanBlock；父区块是当前 tip 时针对 UTXO 集合检查交易，
+// 侧链上的区块在保存前只检查解锁脚本（checkBlockScripts），链重组、连接到主链时再完整检查交易。
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if err := CheckBlock(block); err != nil {
+		return err
+	}
+
+	if len(block.PrevHash) == 0 {
+		return fmt.Errorf("%w: unexpected genesis block %x", ErrBadPrevHash, block.Hash)
+	}
+	if !chain.HasBlock(block.PrevHash) {
+		return fmt.Errorf("%w: %x", ErrOrphanBlock, block.PrevHash)
+	}
+	if err := chain.checkHeaderContext(&block.BlockHeader); err != nil {
+		return err
+	}
+
+	if bytes.Equal(block.PrevHash, chain.Tip()) {
+		return chain.checkBlockTransactions(block)
+	}
+
+	return chain.checkBlockScripts(block)
+}
+
+// checkBlockScripts 检查侧链区块中每个输入的解锁脚本，没有通过检查的区块不会被保存。
+// 被花费的交易可能在区块本身、侧链上的祖先区块或者主链（交易索引）中，交易 ID 包含交易的输出，
+// 所以无论在哪里找到，被花费输出的锁定脚本都相同。输出是否存在、是否已经花费和金额在连接到主链时检查
+func (chain *BlockChain) checkBlockScripts(block *Block) error {
+	known := make(map[string]Transaction)
+	for _, tx := range block.Transactions {
+		known[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	// 侧链上的祖先区块，直到主链上的公共祖先
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		hash := block.PrevHash
+		for {
+			header, err := getHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			mainHash, err := getMainChainHash(txn, header.Height)
+			if err == nil && bytes.Equal(mainHash, hash) {
+				return nil
+			} else if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			ancestor, err := getBlock(txn, hash)
+			if err != nil {
+				return err
+			}
+			for _, tx := range ancestor.Transactions {
+				known[hex.EncodeToString(tx.ID)] = *tx
+			}
+			hash = header.PrevHash
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions[1:] {
+		prevTXs := make(map[string]Transaction)
+		for _, in := range tx.Inputs {
+			prevID := hex.EncodeToString(in.ID)
+			if prevTX, ok := known[prevID]; ok {
+				prevTXs[prevID] = prevTX
+				continue
+			}
+
+			prevTX, err := chain.FindTransaction(in.ID)
+			if errors.Is(err, ErrTxNotFound) {
+				return fmt.Errorf("%w: %s:%d", ErrMissingInput, prevID, in.Out)
+			} else if err != nil {
+				return err
+			}
+			prevTXs[prevID] = prevTX
+		}
+
+		if err := tx.VerifyScripts(prevTXs); err != nil {
+			return fmt.Errorf("%w: %x: %v", ErrBadSignature, tx.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateHeader 检查单独收到的区块头（headers-first 同步），父区块头必须已知
+func (chain *BlockChain) ValidateHeader(header *BlockHeader, hash []byte) error {
+	if err := CheckHeader(header, hash); err != nil {
+		return err
+	}
+
+	if len(header.PrevHash) == 0 {
+		return fmt.Errorf("%w: unexpected genesis block %x", ErrBadPrevHash, hash)
+	}
+	if !chain.HasHeader(header.PrevHash) {
+		return fmt.Errorf("%w: %x", ErrOrphanBlock, header.PrevHash)
+	}
+
+	return chain.checkHeaderContext(header)
+}
+
+// CheckHeader 检查区块哈希与区块头内容一致，并满足工作量证明
+func CheckHeader(header *BlockHeader, hash []byte) error {
+	target := CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(ChainParams.PowLimit()) > 0 {
+		return fmt.Errorf("%w: target %064x out of range", ErrBadDifficulty, target)
+	}
+
+	if !bytes.Equal(header.ComputeHash(), hash) {
+		return fmt.Errorf("%w: %x", ErrBadBlockHash, hash)
+	}
+	if !NewProof(header).Validate() {
+		return fmt.Errorf("%w: %x", ErrBadProofOfWork, hash)
+	}
+
+	return nil
+}
+
+// checkHeaderContext 检查区块头与父区块头之间的关系：高度、难度和时间戳
+func (chain *BlockChain) checkHeaderContext(header *BlockHeader) error {
+	parent, err := chain.GetHeader(header.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	if header.Height != parent.Height+1 {
+		return fmt.Errorf("%w: got %d, parent is at %d", ErrBadHeight, header.Height, parent.Height)
+	}
+
+	bits, err := chain.nextWorkRequired(parent)
+	if err != nil {
+		return err
+	}
+	if header.Bits != bits {
+		return fmt.Errorf("%w: got %08x, want %08x", ErrBadDifficulty, header.Bits, bits)
+	}
+
+	medianTime, err := chain.medianTimePast(parent)
+	if err != nil {
+		return err
+	}
+	if header.Timestamp <= medianTime {
+		return fmt.Errorf("%w: %d <= %d", ErrTimeTooOld, header.Timestamp, medianTime)
+	}
+	if header.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return fmt.Errorf("%w: %d", ErrTimeTooNew, header.Timestamp)
+	}
+
+	return nil
+}
+
+// CheckBlock 执行与链状态无关的区块检查
+func CheckBlock(block *Block) error {
+	if size := len(block.Serialize()); size > MaxBlockSize {
+		return fmt.Errorf("%w: %d bytes", ErrBlockTooLarge, size)
+	}
+
+	if len(block.Transactions) == 0 {
+		return ErrNoTransactions
+	}
+
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return fmt.Errorf("%w: %x", ErrBadMerkleRoot, block.Hash)
+	}
+
+	if err := CheckHeader(&block.BlockHeader, block.Hash); err != nil {
+		return err
+	}
+
+	txIDs := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() != (i == 0) {
+			return fmt.Errorf("%w: transaction %d", ErrBadCoinbase, i)
+		}
+		if i == 0 && !bytes.HasPrefix(tx.Inputs[0].ScriptSig, coinbaseHeight(block.Height)) {
+			return fmt.Errorf("%w: height %d", ErrBadCoinbaseHeight, block.Height)
+		}
+
+		txID := hex.EncodeToString(tx.ID)
+		if txIDs[txID] {
+			return fmt.Errorf("%w: %s", ErrDuplicateTx, txID)
+		}
+		txIDs[txID] = true
+
+		if err := checkTransactionSanity(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTransactionSanity 执行与链状态无关的交易检查：交易 ID、输入输出个数、重复的输入、输出金额和数据输出
+func checkTransactionSanity(tx *Transaction) error {
+	txID := hex.EncodeToString(tx.ID)
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return fmt.Errorf("%w: %s", ErrBadTxID, txID)
+	}
+
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return fmt.Errorf("%w: transaction %s has no inputs or outputs", ErrBadTxValue, txID)
+	}
+
+	// 同一个输出在交易中出现两次时输入金额会被计算两次，区块中也无法连接
+	seen := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+		if seen[outpoint] {
+			return fmt.Errorf("%w: %s in %s", ErrDoubleSpend, outpoint, txID)
+		}
+		seen[outpoint] = true
+	}
+	outputValue := 0
+	for _, out := range tx.Outputs {
+		if out.Value < 0 || out.Value > MaxMoney {
+			return fmt.Errorf("%w: output value %d out of range in %s", ErrBadTxValue, out.Value, txID)
+		}
+		var ok bool
+		if outputValue, ok = addMoney(outputValue, out.Value); !ok {
+			return fmt.Errorf("%w: total output value out of range in %s", ErrBadTxValue, txID)
+		}
+		if len(out.ScriptPubKey) > 0 && out.ScriptPubKey[0] == OpReturn {
+			if _, ok := extractNullData(out.ScriptPubKey); !ok || out.Value != 0 {
+				return fmt.Errorf("%w: %s", ErrBadDataOutput, txID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addMoney 计算金额 a + b，a、b 或者结果不在 0 到 MaxMoney 之间时返回 false
+func addMoney(a, b int) (int, bool) {
+	if a < 0 || a > MaxMoney || b < 0 || b > MaxMoney || a+b > MaxMoney {
+		return 0, false
+	}
+
+	return a + b, true
+}
+
+// totalOutput 返回交易的输出总额，checkTransactionSanity 已经检查过它不超过 MaxMoney
+func totalOutput(tx *Transaction) int {
+	total := 0
+	for _, out := range tx.Outputs {
+		total += out.Value
+	}
+
+	return total
+}
+
+// coin 是交易输入花费的输出，以及它所在区块的高度和是否来自 coinbase 交易
+type coin struct {
+	TxOutput
+	height   int
+	coinbase bool
+}
+
+// coinLookup 返回输入 in 花费的输出，找不到时返回说明原因的错误
+type coinLookup func(in TxInput) (coin, error)
+
+// checkInputs 是内存池（CheckTransaction）、区块验证（checkBlockTransactions）和矿工选择交易（selectTransactions）
+// 共用的输入检查：用 lookup 找到每个输入花费的输出，检查 coinbase 输出已经成熟、输入总额没有溢出并且不小于输出总额，
+// 最后执行每个输入的解锁脚本。所有输出都找到之后才验证签名，找不到输出时不会浪费时间在签名上。
+// 返回手续费和每个输入花费的输出所在区块的高度（用于检查相对锁定时间）。
+// 调用前 tx 必须已经通过 checkTransactionSanity，height 是打包交易的区块高度
+func checkInputs(tx *Transaction, height int, lookup coinLookup) (int, []int, error) {
+	coins := make([]coin, len(tx.Inputs))
+	coinHeights := make([]int, len(tx.Inputs))
+	inputValue := 0
+
+	for i, in := range tx.Inputs {
+		c, err := lookup(in)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.coinbase && height-c.height < ChainParams.CoinbaseMaturity {
+			return 0, nil, fmt.Errorf("%w: %x:%d from height %d", ErrImmatureSpend, in.ID, in.Out, c.height)
+		}
+
+		var ok bool
+		if inputValue, ok = addMoney(inputValue, c.Value); !ok {
+			return 0, nil, fmt.Errorf("%w: total input value out of range in %x", ErrBadTxValue, tx.ID)
+		}
+		coins[i] = c
+		coinHeights[i] = c.height
+	}
+
+	outputValue := totalOutput(tx)
+	if outputValue > inputValue {
+		return 0, nil, fmt.Errorf("%w: %x spends %d but has %d", ErrBadTxValue, tx.ID, outputValue, inputValue)
+	}
+
+	for i, in := range tx.Inputs {
+		if err := VerifyScript(in.ScriptSig, coins[i].ScriptPubKey, tx, i); err != nil {
+			return 0, nil, fmt.Errorf("%w: %x: input %d: %v", ErrBadSignature, tx.ID, i, err)
+		}
+	}
+
+	return inputValue - outputValue, coinHeights, nil
+}
+
+// blockView 是检查区块中交易时看到的输出：UTXO 集合中的输出，加上区块中前面的交易（已经添加的交易）的输出，
+// 减去区块中前面的交易已经花费的输出
+type blockView struct {
+	utxo   UTXOSet
+	height int
+	txs    map[string]*Transaction
+	spent  map[string]bool
+}
+
+func (chain *BlockChain) newBlockView(height int) *blockView {
+	return &blockView{UTXOSet{chain}, height, make(map[string]*Transaction), make(map[string]bool)}
+}
+
+// lookup 实现 coinLookup。输出已经被区块中前面的交易花费时返回 ErrDoubleSpend，
+// 既不在区块中也不在 UTXO 集合中时返回 ErrMissingInput
+func (v *blockView) lookup(in TxInput) (coin, error) {
+	outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+	if v.spent[outpoint] {
+		return coin{}, fmt.Errorf("%w: %s", ErrDoubleSpend, outpoint)
+	}
+
+	if prevTX, ok := v.txs[hex.EncodeToString(in.ID)]; ok {
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return coin{}, fmt.Errorf("%w: %s", ErrMissingInput, outpoint)
+		}
+		return coin{prevTX.Outputs[in.Out], v.height, prevTX.IsCoinbase()}, nil
+	}
+
+	outs, ok, err := v.utxo.FindOutputs(in.ID)
+	if err != nil {
+		return coin{}, err
+	}
+	out, found := outs.Outputs[in.Out]
+	if !ok || !found {
+		return coin{}, fmt.Errorf("%w: %s", ErrMissingInput, outpoint)
+	}
+
+	return coin{out, outs.Height, outs.IsCoinbase}, nil
+}
+
+// add 把交易加入区块，之后的交易可以花费它的输出，不能再花费它花费过的输出
+func (v *blockView) add(tx *Transaction) {
+	if !tx.IsCoinbase() {
+		for _, in := range tx.Inputs {
+			v.spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] = true
+		}
+	}
+	v.txs[hex.EncodeToString(tx.ID)] = tx
+}
+
+// CheckTransaction 检查其他节点发来的、要放入内存池的交易是否可以进入下一个区块，返回交易的手续费。
+// 每个输入花费的输出必须在 UTXO 集合中（已经成熟），或者是 poolTx 返回的内存池中交易的输出，
+// 所有输入的签名都必须有效，输入总额不能小于输出总额。
+// 输入引用的交易既不在 UTXO 集合中也不在内存池中时返回 ErrOrphanTx
+func (chain *BlockChain) CheckTransaction(tx *Transaction, poolTx func(id []byte) (*Transaction, bool)) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, fmt.Errorf("%w: %x is a coinbase", ErrBadCoinbase, tx.ID)
+	}
+	if err := checkTransactionSanity(tx); err != nil {
+		return 0, err
+	}
+	if err := chain.CheckFinalTx(tx); err != nil {
+		return 0, err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	UTXOSet := UTXOSet{chain}
+	lookup := func(in TxInput) (coin, error) {
+		outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+		outs, ok, err := UTXOSet.FindOutputs(in.ID)
+		if err != nil {
+			return coin{}, err
+		}
+		if ok {
+			out, found := outs.Outputs[in.Out]
+			if !found {
+				return coin{}, fmt.Errorf("%w: %s", ErrMissingInput, outpoint)
+			}
+			return coin{out, outs.Height, outs.IsCoinbase}, nil
+		}
+
+		parent, found := poolTx(in.ID)
+		if !found {
+			return coin{}, fmt.Errorf("%w: %s", ErrOrphanTx, outpoint)
+		}
+		if in.Out < 0 || in.Out >= len(parent.Outputs) {
+			return coin{}, fmt.Errorf("%w: %s", ErrMissingInput, outpoint)
+		}
+		return coin{parent.Outputs[in.Out], bestHeight + 1, false}, nil
+	}
+
+	fee, _, err := checkInputs(tx, bestHeight+1, lookup)
+
+	return fee, err
+}
+
+// checkBlockTransactions 针对当前 UTXO 集合检查区块中的交易，
+// 调用时 block 的父区块必须是当前 tip。
+func (chain *BlockChain) checkBlockTransactions(block *Block) error {
+	view := chain.newBlockView(block.Height)
+	fees := 0
+
+	parent, err := chain.GetHeader(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	medianTime, err := chain.medianTimePast(parent)
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+
+		if _, ok, err := view.utxo.FindOutputs(tx.ID); err != nil {
+			return err
+		} else if ok {
+			return fmt.Errorf("%w: %s", ErrOverwriteTx, txID)
+		}
+
+		if tx.IsCoinbase() {
+			if !tx.IsFinal(block.Height, medianTime) {
+				return fmt.Errorf("%w: coinbase %s", ErrNonFinalTx, txID)
+			}
+			view.add(tx)
+			continue
+		}
+
+		fee, coinHeights, err := checkInputs(tx, block.Height, view.lookup)
+		if err != nil {
+			return err
+		}
+		if err := chain.checkLockTimes(tx, coinHeights, block.Height, medianTime); err != nil {
+			return fmt.Errorf("%s: %w", txID, err)
+		}
+
+		var ok bool
+		if fees, ok = addMoney(fees, fee); !ok {
+			return fmt.Errorf("%w: total fees out of range at %s", ErrBadTxValue, txID)
+		}
+		view.add(tx)
+	}
+
+	// 超过 MaxMoney 的上限截断为 MaxMoney，coinbase 的输出总额已经由 checkTransactionSanity 限制在 MaxMoney 以内
+	reward := totalOutput(block.Transactions[0])
+	limit, ok := addMoney(ChainParams.BlockSubsidy(block.Height), fees)
+	if !ok {
+		limit = MaxMoney
+	}
+	if reward > limit {
+		return fmt.Errorf("%w: %d > %d", ErrBadCoinbaseValue, reward, limit)
+	}
+
+	return nil
+}
+
+// medianTimePast 返回 header 及其之前共 11 个区块时间戳的中位数
+func (chain *BlockChain) medianTimePast(header *BlockHeader) (int64, error) {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeBlocks; i++ {
+		timestamps = append(timestamps, header.Timestamp)
+		if len(header.PrevHash) == 0 {
+			break
+		}
+		parent, err := chain.GetHeader(header.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		header = parent
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
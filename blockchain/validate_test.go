@@ -0,0 +1,345 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"blockchain_go/wallet"
+)
+
+// newTestChain 在临时目录中创建区块链，创世块奖励发送给一个新钱包。
+// 测试期间使用最低难度和较短的 coinbase 成熟期，结束后恢复 ChainParams
+func newTestChain(t *testing.T) (*BlockChain, *wallet.Wallet) {
+	t.Helper()
+
+	saved := ChainParams
+	ChainParams.PowLimitBits = 4
+	ChainParams.InitialDifficulty = 4
+	ChainParams.CoinbaseMaturity = 2
+	t.Cleanup(func() { ChainParams = saved })
+
+	w := wallet.MakeWallet()
+	chain, err := InitBlockChain(string(w.Address()), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+
+	return chain, w
+}
+
+// mineBlocks 在 tip 上挖 n 个只有 coinbase 的区块，返回最后一个区块
+func mineBlocks(t *testing.T, chain *BlockChain, address string, n int) *Block {
+	t.Helper()
+
+	var block *Block
+	for i := 0; i < n; i++ {
+		var err error
+		if block, err = chain.MineBlock(context.Background(), address, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return block
+}
+
+// testBlock 在父区块 prevHash 上挖出包含 txs 的区块，但不加入区块链。
+// coinbase 支付区块奖励，调用者可以在挖矿之前修改区块中的交易
+func testBlock(t *testing.T, chain *BlockChain, prevHash []byte, address string, txs ...*Transaction) *Block {
+	t.Helper()
+
+	parent, err := chain.GetHeader(prevHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.nextWorkRequired(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	medianTime, err := chain.medianTimePast(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Now().Unix()
+	if timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
+
+	cbTx := CoinbaseTx(address, "", parent.Height+1, ChainParams.BlockSubsidy(parent.Height+1))
+	block, err := newBlock(context.Background(), append([]*Transaction{cbTx}, txs...), prevHash, parent.Height+1, bits, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// spendTx 创建花费 inputs 并支付 outputs 的交易，用钱包 w 签名所有输入
+func spendTx(t *testing.T, chain *BlockChain, w *wallet.Wallet, inputs []TxInput, outputs []TxOutput) *Transaction {
+	t.Helper()
+
+	tx := &Transaction{Inputs: inputs, Outputs: outputs}
+	for i := range tx.Inputs {
+		tx.Inputs[i].Sequence = SequenceFinal
+	}
+	tx.ID = tx.Hash()
+	chain.SignTransaction(tx, &w.PrivateKey)
+
+	return tx
+}
+
+// noPoolTx 用于没有内存池的 CheckTransaction
+func noPoolTx(id []byte) (*Transaction, bool) {
+	return nil, false
+}
+
+func TestAddMoney(t *testing.T) {
+	tests := []struct {
+		a, b int
+		want int
+		ok   bool
+	}{
+		{0, 0, 0, true},
+		{1, 2, 3, true},
+		{MaxMoney - 1, 1, MaxMoney, true},
+		{MaxMoney, 1, 0, false},
+		{math.MaxInt64, math.MaxInt64, 0, false},
+		{math.MaxInt64, 2, 0, false},
+		{-1, 1, 0, false},
+		{1, -1, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := addMoney(tt.a, tt.b)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("addMoney(%d, %d) = %d, %v, want %d, %v", tt.a, tt.b, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheckTransactionSanityOutputValues(t *testing.T) {
+	script := P2PKHScript(make([]byte, 20))
+	tests := []struct {
+		name   string
+		values []int
+		ok     bool
+	}{
+		{"normal", []int{1, 2}, true},
+		{"max money", []int{MaxMoney}, true},
+		{"negative", []int{-1}, false},
+		{"above max money", []int{MaxMoney + 1}, false},
+		{"sum above max money", []int{MaxMoney, 1}, false},
+		{"sum wraps around", []int{math.MaxInt64, math.MaxInt64, 2}, false},
+	}
+
+	for _, tt := range tests {
+		tx := &Transaction{Inputs: []TxInput{{make([]byte, 32), 0, nil, SequenceFinal}}}
+		for _, v := range tt.values {
+			tx.Outputs = append(tx.Outputs, TxOutput{v, script})
+		}
+		tx.ID = tx.Hash()
+
+		err := checkTransactionSanity(tx)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if !tt.ok && !errors.Is(err, ErrBadTxValue) {
+			t.Errorf("%s: got %v, want ErrBadTxValue", tt.name, err)
+		}
+	}
+}
+
+// 回归测试：输出总额溢出后变成很小的数，交易曾经被当作手续费为正的交易接受并打包进区块
+func TestOutputOverflowRejected(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+
+	spendable := mineBlocks(t, chain, address, 1).Transactions[0]
+	mineBlocks(t, chain, address, ChainParams.CoinbaseMaturity)
+
+	script := spendable.Outputs[0].ScriptPubKey
+	tx := spendTx(t, chain, w, []TxInput{{ID: spendable.ID, Out: 0}},
+		[]TxOutput{{math.MaxInt64, script}, {math.MaxInt64, script}, {2, script}})
+
+	if _, err := chain.CheckTransaction(tx, noPoolTx); !errors.Is(err, ErrBadTxValue) {
+		t.Errorf("CheckTransaction: got %v, want ErrBadTxValue", err)
+	}
+
+	tip := chain.Tip()
+	if _, err := chain.MineBlock(context.Background(), address, []*Transaction{tx}); err == nil {
+		t.Error("MineBlock accepted a transaction whose outputs overflow")
+	}
+
+	block := testBlock(t, chain, tip, address, tx)
+	if _, _, err := chain.AddBlock(block); !errors.Is(err, ErrBadTxValue) {
+		t.Errorf("AddBlock: got %v, want ErrBadTxValue", err)
+	}
+	if chain.HasBlock(block.Hash) || string(chain.Tip()) != string(tip) {
+		t.Error("block with overflowing outputs was stored")
+	}
+}
+
+func TestCoinbaseValue(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+	mineBlocks(t, chain, address, 1)
+
+	tests := []struct {
+		name  string
+		value int
+		ok    bool
+	}{
+		{"subsidy", ChainParams.BlockSubsidy(2), true},
+		{"more than subsidy", ChainParams.BlockSubsidy(2) + 1, false},
+		{"max money", MaxMoney, false},
+	}
+
+	for _, tt := range tests {
+		block := testBlock(t, chain, chain.Tip(), address)
+		block.Transactions[0] = CoinbaseTx(address, "", block.Height, tt.value)
+		block.MerkleRoot = block.HashTransactions()
+		nonce, hash, err := NewProof(&block.BlockHeader).Mine(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Nonce, block.Hash = nonce, hash
+
+		err = chain.ValidateBlock(block)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if !tt.ok && !errors.Is(err, ErrBadCoinbaseValue) {
+			t.Errorf("%s: got %v, want ErrBadCoinbaseValue", tt.name, err)
+		}
+	}
+}
+
+// 两次花费同一个输出的交易曾经通过 CheckTransaction 进入内存池，之后每次挖矿都因为区块无效而失败
+func TestDuplicateInputRejected(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+
+	spendable := mineBlocks(t, chain, address, 1).Transactions[0]
+	other := mineBlocks(t, chain, address, 1).Transactions[0]
+	mineBlocks(t, chain, address, ChainParams.CoinbaseMaturity)
+
+	script := spendable.Outputs[0].ScriptPubKey
+	value := spendable.Outputs[0].Value
+	dup := spendTx(t, chain, w, []TxInput{{ID: spendable.ID, Out: 0}, {ID: spendable.ID, Out: 0}},
+		[]TxOutput{{2 * value, script}})
+
+	if err := checkTransactionSanity(dup); !errors.Is(err, ErrDoubleSpend) {
+		t.Errorf("checkTransactionSanity: got %v, want ErrDoubleSpend", err)
+	}
+	if _, err := chain.CheckTransaction(dup, noPoolTx); !errors.Is(err, ErrDoubleSpend) {
+		t.Errorf("CheckTransaction: got %v, want ErrDoubleSpend", err)
+	}
+
+	block := testBlock(t, chain, chain.Tip(), address, dup)
+	if _, _, err := chain.AddBlock(block); !errors.Is(err, ErrDoubleSpend) {
+		t.Errorf("AddBlock: got %v, want ErrDoubleSpend", err)
+	}
+
+	// 矿工跳过这笔交易，仍然可以打包其他交易
+	valid := spendTx(t, chain, w, []TxInput{{ID: other.ID, Out: 0}}, []TxOutput{{value - 1, script}})
+	mined, err := chain.MineBlock(context.Background(), address, []*Transaction{dup, valid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mined.Transactions) != 2 || string(mined.Transactions[1].ID) != string(valid.ID) {
+		t.Errorf("mined block has %d transactions, want the coinbase and the valid transaction", len(mined.Transactions))
+	}
+}
+
+// MaxBlockSize 曾经只是矿工策略，其他节点发来的超大区块仍然有效，超过网络消息的大小上限后无法转发
+func TestCheckBlockSize(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+
+	block := testBlock(t, chain, chain.Tip(), address)
+	if size := len(block.Serialize()); size > blockReservedSize {
+		t.Fatalf("block with only a coinbase is %d bytes, more than the %d bytes reserved for it", size, blockReservedSize)
+	}
+	if err := CheckBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	// 大小检查在其他检查之前，不需要重新计算默克尔根和工作量证明
+	tx := &Transaction{
+		Inputs:  []TxInput{{make([]byte, 32), 0, make([]byte, MaxBlockSize), SequenceFinal}},
+		Outputs: []TxOutput{{1, P2PKHScript(make([]byte, 20))}},
+	}
+	tx.ID = tx.Hash()
+	block.Transactions = append(block.Transactions, tx)
+
+	err := CheckBlock(block)
+	if !errors.Is(err, ErrBlockTooLarge) {
+		t.Fatalf("CheckBlock: got %v, want ErrBlockTooLarge", err)
+	}
+	if !IsRuleError(err) {
+		t.Error("ErrBlockTooLarge is not a rule error")
+	}
+}
+
+// 矿工可以让两个区块的 coinbase 交易完全相同，后一个曾经覆盖 UTXO 集合中前一个的输出，断开区块时又把它们删除。
+// coinbase 以区块高度开头之后不同区块的 coinbase 交易 ID 不会相同，UTXO 集合中已有的交易 ID 也被拒绝
+func TestCoinbaseUniqueness(t *testing.T) {
+	chain, w := newTestChain(t)
+	address := string(w.Address())
+	first := mineBlocks(t, chain, address, 1).Transactions[0]
+	mineBlocks(t, chain, address, 1)
+
+	tests := []struct {
+		name     string
+		coinbase func(height int) *Transaction
+		want     error
+	}{
+		{"block height", func(height int) *Transaction {
+			return CoinbaseTx(address, "", height, ChainParams.BlockSubsidy(height))
+		}, nil},
+		{"no height", func(height int) *Transaction {
+			tx := CoinbaseTx(address, "", height, ChainParams.BlockSubsidy(height))
+			tx.Inputs[0].ScriptSig = []byte("data")
+			tx.ID = tx.Hash()
+			return tx
+		}, ErrBadCoinbaseHeight},
+		{"parent height", func(height int) *Transaction {
+			return CoinbaseTx(address, "", height-1, ChainParams.BlockSubsidy(height))
+		}, ErrBadCoinbaseHeight},
+		{"unspent coinbase of an earlier block", func(height int) *Transaction { return first }, ErrBadCoinbaseHeight},
+	}
+
+	for _, tt := range tests {
+		block := testBlock(t, chain, chain.Tip(), address)
+		block.Transactions[0] = tt.coinbase(block.Height)
+		block.MerkleRoot = block.HashTransactions()
+		nonce, hash, err := NewProof(&block.BlockHeader).Mine(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Nonce, block.Hash = nonce, hash
+
+		err = chain.ValidateBlock(block)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// 不检查高度时，与 UTXO 集合中的交易 ID 相同的 coinbase 在检查交易和连接区块时都被拒绝，UTXO 集合不变
+	block := testBlock(t, chain, chain.Tip(), address)
+	block.Transactions[0] = first
+	state := mainChainState(t, chain)
+	if err := chain.checkBlockTransactions(block); !errors.Is(err, ErrOverwriteTx) {
+		t.Errorf("checkBlockTransactions: got %v, want ErrOverwriteTx", err)
+	}
+	if err := chain.ConnectBlock(block); !errors.Is(err, ErrOverwriteTx) {
+		t.Errorf("ConnectBlock: got %v, want ErrOverwriteTx", err)
+	}
+	compareState(t, "rejected block", mainChainState(t, chain), state)
+	if _, ok, _ := (UTXOSet{chain}).FindOutputs(first.ID); !ok {
+		t.Error("outputs of the earlier coinbase are missing from the UTXO set")
+	}
+}
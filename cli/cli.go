@@ -1,30 +1,55 @@
 package cli
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"blockchain_go/blockchain"
+	"blockchain_go/config"
 	"blockchain_go/network"
 	"blockchain_go/wallet"
 )
 
-type CommandLine struct{}
+type CommandLine struct {
+	cfg *config.Config
+}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] [-config FILE] COMMAND")
+	fmt.Println(" -datadir DIR - Node data directory, defaults to tmp/node_$NODE_ID")
+	fmt.Println(" -config FILE - JSON config file, defaults to DIR/config.json")
+	fmt.Println("Commands:")
 	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
+	fmt.Println(" gethistory -address ADDRESS - List the main chain transactions that pay to or spend from an address")
 	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -mine - Send amount of coins and pay FEE to the miner. Then -mine flag is set, mine off of this node")
+	fmt.Println("   -to ADDR:AMOUNT and -from ADDR can be repeated to pay several addresses from several wallets in one transaction")
+	fmt.Println("   -csv FILE: read address,amount payouts from FILE. -change ADDR: change address, defaults to the first -from")
+	fmt.Println("   -feerate RATE: pay RATE per 1000 bytes of the signed transaction instead of a fixed -fee")
+	fmt.Println("   -coins STRATEGY: coin selection, one of " + blockchain.CoinSelectorNames() + " (default auto)")
+	fmt.Println("   -locktime: the transaction can only be mined after this block height (or Unix time if >= 500000000)")
+	fmt.Println(" anchor -from FROM -data HEX -fee FEE -mine - Store up to 80 bytes of data (e.g. a document hash) on chain, FROM pays the fee")
+	fmt.Println(" findanchor -data HEX - Find the block that anchored the data and print its Merkle proof")
+	fmt.Println(" mine -address ADDRESS -blocks N - Mine N empty blocks and send the rewards to ADDRESS")
 	fmt.Println(" createwallet - Creates a new Wallet")
-	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
+	fmt.Println(" createmultisig -m M -keys KEYS - Creates an M-of-N multisig address from comma separated wallet addresses or hex public keys")
+	fmt.Println(" listaddresses -pubkeys - Lists the addresses in our wallet file. -pubkeys also prints their public keys")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" startnode -miner ADDRESS - Start a node listening on the configured address. -miner enables mining")
+	fmt.Println(" listbanned - List the IPs banned for misbehavior")
+	fmt.Println(" clearbanned -ip IP - Unban IP (IP:PORT for nodes on this machine), or all banned IPs if -ip is not given")
 }
 
 func (cli *CommandLine) validateArgs() {
@@ -34,49 +59,140 @@ func (cli *CommandLine) validateArgs() {
 	}
 }
 
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
-	fmt.Printf("Starting Node %s\n", nodeID)
+// loadConfig 按 默认值 < 配置文件 < 命令行参数 的顺序生成节点配置。
+// 没有指定 -datadir 时使用 NODE_ID 环境变量得到数据目录 tmp/node_$NODE_ID 和监听地址 localhost:$NODE_ID。
+func loadConfig(dataDir, configFile string) (*config.Config, error) {
+	cfg := config.Default("")
+
+	if nodeID := os.Getenv("NODE_ID"); nodeID != "" {
+		cfg.DataDir = filepath.Join("tmp", "node_"+nodeID)
+		cfg.ListenAddr = fmt.Sprintf("localhost:%s", nodeID)
+	}
+	if dataDir != "" {
+		cfg.DataDir = dataDir
+	}
+
+	if configFile == "" && cfg.DataDir != "" {
+		if _, err := os.Stat(cfg.DefaultConfigFile()); err == nil {
+			configFile = cfg.DefaultConfigFile()
+		}
+	}
+	if configFile != "" {
+		if err := cfg.LoadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	if dataDir != "" {
+		cfg.DataDir = dataDir
+	}
+
+	if cfg.DataDir == "" {
+		return nil, fmt.Errorf("no data directory: set NODE_ID env or use -datadir")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cli *CommandLine) StartNode(minerAddress string) {
+	fmt.Printf("Starting Node %s, data directory %s\n", cli.cfg.ListenAddr, cli.cfg.DataDir)
 
 	if len(minerAddress) > 0 {
-		if wallet.ValidateAddress(minerAddress) {
-			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+		cli.cfg.MinerAddress = minerAddress
+	}
+	if len(cli.cfg.MinerAddress) > 0 {
+		if wallet.ValidateAddress(cli.cfg.MinerAddress) {
+			fmt.Println("Mining is on. Address to receive rewards: ", cli.cfg.MinerAddress)
 		} else {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeID, minerAddress)
+	network.StartServer(cli.cfg)
 }
 
-func (cli *CommandLine) reindexUTXO(nodeID string) {
-	chain,_ := blockchain.ContinueBlockChain(nodeID)
+// openChain 打开数据目录中已有的区块链。数据库不存在、被锁定或者修复 UTXO 集合失败时打印错误并以非零状态退出
+func (cli *CommandLine) openChain() *blockchain.BlockChain {
+	chain, err := blockchain.ContinueBlockChain(cli.cfg.ChainDir())
+	if err != nil {
+		exitWithError(err)
+	}
+
+	return chain
+}
+
+// exitWithError 打印 err 并以非零状态退出。main 中 defer 的 os.Exit(0) 会吞掉 panic 的退出状态，所以这里直接调用 os.Exit
+func exitWithError(err error) {
+	fmt.Println(err)
+	os.Exit(1)
+}
+
+func (cli *CommandLine) reindexUTXO() {
+	chain := cli.openChain()
 	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{Blockchain:chain}
-	UTXOSet.Reindex()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		log.Panic(err)
+	}
 
 	count := UTXOSet.CountTransactions()
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
-func (cli *CommandLine) listAddresses(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
+func (cli *CommandLine) listAddresses(showPubKeys bool) {
+	wallets, _ := wallet.CreateWallets(cli.cfg.WalletFile())
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
+		if w, ok := wallets.Wallets[address]; ok && showPubKeys {
+			fmt.Printf("%s %x\n", address, w.PublicKey)
+			continue
+		}
 		fmt.Println(address)
 	}
 
 }
 
-func (cli *CommandLine) createWallet(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
+func (cli *CommandLine) createWallet() {
+	wallets, _ := wallet.CreateWallets(cli.cfg.WalletFile())
 	address := wallets.AddWallet()
-	wallets.SaveFile(nodeID)
+	wallets.SaveFile(cli.cfg.WalletFile())
 
 	fmt.Printf("New address is: %s\n", address)
 }
 
-func (cli *CommandLine) printChain(nodeID string) {
-	chain,_ := blockchain.ContinueBlockChain(nodeID)
+// createMultisig 创建需要 keys 中任意 m 个签名的多签地址，keys 是钱包文件中的地址或十六进制公钥。
+// 赎回脚本保存在钱包文件中，之后可以用 send -from 从这个地址转账
+func (cli *CommandLine) createMultisig(m int, keys []string) {
+	wallets, _ := wallet.CreateWallets(cli.cfg.WalletFile())
+
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if w, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, w.PublicKey)
+			continue
+		}
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			log.Panicf("%s is neither a wallet address nor a hex public key", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	redeemScript, err := blockchain.MultisigScript(m, pubKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+	address := wallets.AddScript(redeemScript)
+	wallets.SaveFile(cli.cfg.WalletFile())
+
+	fmt.Printf("Multisig address is: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", redeemScript)
+}
+
+func (cli *CommandLine) printChain() {
+	chain := cli.openChain()
 	defer chain.Database.Close()
 	iter := chain.Iterator()
 
@@ -85,7 +201,7 @@ func (cli *CommandLine) printChain(nodeID string) {
 
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		pow := blockchain.NewProof(block)
+		pow := blockchain.NewProof(&block.BlockHeader)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
@@ -98,80 +214,281 @@ func (cli *CommandLine) printChain(nodeID string) {
 	}
 }
 
-func (cli *CommandLine) createBlockChain(address, nodeID string) {
+func (cli *CommandLine) createBlockChain(address string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
-	chain,_ := blockchain.InitBlockChain(address, nodeID)
+	chain, err := blockchain.InitBlockChain(address, cli.cfg.ChainDir())
+	if err != nil {
+		exitWithError(err)
+	}
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{Blockchain:chain}
-	UTXOSet.Reindex()
-
 	fmt.Println("Finished!")
 }
 
-func (cli *CommandLine) getBalance(address, nodeID string) {
+func (cli *CommandLine) getBalance(address string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
-	chain,_ := blockchain.ContinueBlockChain(nodeID)
+	chain := cli.openChain()
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
-
-	for _, out := range UTXOs {
-		balance += out.Value
+	lockScript, err := blockchain.LockScript(address)
+	if err != nil {
+		log.Panic(err)
 	}
+	balance, immature := UTXOSet.GetBalance(lockScript)
 
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+	if immature > 0 {
+		fmt.Printf("Immature coinbase rewards: %d\n", immature)
+	}
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !wallet.ValidateAddress(to) {
+// getHistory 打印 address 在主链上的历史交易：高度、交易 ID、收到和花掉的金额，以及每笔交易后的余额
+func (cli *CommandLine) getHistory(address string) {
+	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
-	if !wallet.ValidateAddress(from) {
+	chain := cli.openChain()
+	defer chain.Database.Close()
+
+	lockScript, err := blockchain.LockScript(address)
+	if err != nil {
+		log.Panic(err)
+	}
+	history, err := chain.GetHistory(lockScript)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	balance := 0
+	for _, entry := range history {
+		balance += entry.Received - entry.Sent
+		fmt.Printf("%6d %x %+6d %6d\n", entry.Height, entry.TxID, entry.Received-entry.Sent, balance)
+	}
+	fmt.Printf("%d transactions, balance %d\n", len(history), balance)
+}
+
+// mine 在本节点上挖 count 个只包含 coinbase 交易的区块，奖励发送给 address，
+// 新链上的 coinbase 奖励要经过 CoinbaseMaturity 个区块才能花费
+func (cli *CommandLine) mine(address string, count int) {
+	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
-	chain,_ := blockchain.ContinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{Blockchain:chain}
+	chain := cli.openChain()
 	defer chain.Database.Close()
 
-	wallets, err := wallet.CreateWallets(nodeID)
+	for i := 0; i < count; i++ {
+		if _, err := chain.MineBlock(context.Background(), address, nil); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	fmt.Println("Success!")
+}
+
+// send 从 from 中的地址（普通地址或多签地址）向 payments 中的地址付款，所有付款在同一笔交易中，
+// 找零发送到 change，为空时发送到第一个 from 地址
+func (cli *CommandLine) send(from []string, payments []blockchain.Payment, change string, fee blockchain.FeePolicy, selector blockchain.CoinSelector, lockTime uint32, mineNow bool) {
+	for _, p := range payments {
+		if !wallet.ValidateAddress(p.Address) {
+			log.Panicf("Address %s is not Valid", p.Address)
+		}
+	}
+	for _, address := range from {
+		if !wallet.ValidateAddress(address) {
+			log.Panicf("Address %s is not Valid", address)
+		}
+	}
+	if change != "" && !wallet.ValidateAddress(change) {
+		log.Panicf("Address %s is not Valid", change)
+	}
+	chain := cli.openChain()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	wallets, err := wallet.CreateWallets(cli.cfg.WalletFile())
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	builder := blockchain.NewTxBuilder(&UTXOSet)
+	for _, address := range from {
+		if redeemScript, ok := wallets.GetScript(address); ok {
+			// 从多签地址转账：用钱包文件中与赎回脚本公钥对应的私钥签名
+			var privKeys []*ecdsa.PrivateKey
+			for _, w := range wallets.Wallets {
+				privKeys = append(privKeys, &w.PrivateKey)
+			}
+			builder.AddSource(blockchain.MultisigSource(redeemScript, privKeys))
+			continue
+		}
+		w, ok := wallets.Wallets[address]
+		if !ok {
+			log.Panicf("Address %s is not in the wallet file", address)
+		}
+		builder.AddSource(blockchain.WalletSource(w))
+	}
+
+	tx, err := builder.
+		AddPayments(payments).
+		SetChangeAddress(change).
+		SetFeePolicy(fee).
+		SetCoinSelector(selector).
+		SetLockTime(lockTime).
+		Build()
+	if err != nil {
+		log.Panic(err)
+	}
+	cli.submitTx(chain, tx, from[0], mineNow)
+
+	fmt.Printf("Sent %d payments in transaction %x\n", len(payments), tx.ID)
+	fmt.Println("Success!")
+}
+
+// submitTx 在本节点上把 tx 挖进新区块（奖励发送给 miner），或者发送给种子节点或地址簿中的其他节点
+func (cli *CommandLine) submitTx(chain *blockchain.BlockChain, tx *blockchain.Transaction, miner string, mineNow bool) {
 	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		txs := []*blockchain.Transaction{tx}
+		if _, err := chain.MineBlock(context.Background(), miner, txs); err != nil {
+			log.Panic(err)
+		}
 	} else {
-		network.SendTx(network.KnownNodes[0], tx)
+		if err := network.BroadcastTx(cli.cfg, tx); err != nil {
+			log.Panic(err)
+		}
 		fmt.Println("send tx")
 	}
+}
 
-	fmt.Println("Success!")
+// anchor 把 data（例如文档的哈希）写入一笔交易的数据输出，由 from 支付手续费
+func (cli *CommandLine) anchor(from string, data []byte, fee int, mineNow bool) {
+	if !wallet.ValidateAddress(from) {
+		exitWithError(fmt.Errorf("address %s is not valid", from))
+	}
+	wallets, err := wallet.CreateWallets(cli.cfg.WalletFile())
+	if err != nil {
+		exitWithError(err)
+	}
+	// 多签地址和不在钱包文件中的地址没有可以签名的私钥
+	w, ok := wallets.Wallets[from]
+	if !ok {
+		exitWithError(fmt.Errorf("address %s is not in the wallet file", from))
+	}
+
+	chain := cli.openChain()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	tx, err := blockchain.NewDataTransaction(w, data, fee, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	cli.submitTx(chain, tx, from, mineNow)
+
+	fmt.Printf("Anchored %x in transaction %x\n", data, tx.ID)
+}
+
+// findAnchor 查找锚定了 data 的区块，打印区块信息和交易的默克尔证明
+func (cli *CommandLine) findAnchor(data []byte) {
+	chain := cli.openChain()
+	defer chain.Database.Close()
+
+	block, proof, err := chain.FindAnchor(data)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Printf("Block:       %x\n", block.Hash)
+	fmt.Printf("Height:      %d\n", block.Height)
+	fmt.Printf("Time:        %s\n", time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+	fmt.Printf("Transaction: %x\n", proof.TxID)
+	fmt.Printf("Tx hash:     %x\n", proof.TxHash)
+	fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
+	fmt.Printf("Proof index: %d\n", proof.Index)
+	for i, hash := range proof.Hashes {
+		fmt.Printf("Proof %d:     %x\n", i, hash)
+	}
+	fmt.Printf("Proof valid: %t\n", proof.Verify(block.MerkleRoot))
+}
+
+// listBanned 打印封禁列表中没有过期的 IP
+func (cli *CommandLine) listBanned() {
+	bans, err := network.NewBanList(cli.cfg.BanlistFile())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	entries := bans.List()
+	if len(entries) == 0 {
+		fmt.Println("No banned IPs")
+		return
+	}
+	for _, entry := range entries {
+		until := time.Unix(entry.Until, 0).UTC().Format(time.RFC3339)
+		fmt.Printf("%s banned until %s: %s\n", entry.Host, until, entry.Reason)
+	}
+}
+
+// clearBanned 解除对 host 的封禁，host 为空时解除所有封禁。运行中的节点会重新读取封禁列表
+func (cli *CommandLine) clearBanned(host string) {
+	bans, err := network.NewBanList(cli.cfg.BanlistFile())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if host == "" {
+		if err := bans.Clear(); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("Cleared all bans")
+		return
+	}
+
+	found, err := bans.Unban(host)
+	if err != nil {
+		log.Panic(err)
+	}
+	if !found {
+		fmt.Printf("%s is not banned\n", host)
+		return
+	}
+	fmt.Printf("Unbanned %s\n", host)
 }
 
 func (cli *CommandLine) Run() {
 	cli.validateArgs()
 
-	nodeID := os.Getenv("NODE_ID")
-	if nodeID == "" {
-		fmt.Printf("NODE_ID env is not set!")
+	globalCmd := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	dataDir := globalCmd.String("datadir", "", "Node data directory")
+	configFile := globalCmd.String("config", "", "JSON config file")
+	if err := globalCmd.Parse(os.Args[1:]); err != nil {
+		log.Panic(err)
+	}
+	args := globalCmd.Args()
+	if len(args) < 1 {
+		cli.printUsage()
+		runtime.Goexit()
+	}
+
+	cfg, err := loadConfig(*dataDir, *configFile)
+	if err != nil {
+		fmt.Println(err)
 		runtime.Goexit()
 	}
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		log.Panic(err)
+	}
+	cli.cfg = cfg
+	blockchain.ChainParams = cfg.Params
+	network.NetworkMagic = cfg.NetworkMagic
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	getHistoryCmd := flag.NewFlagSet("gethistory", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
@@ -179,53 +496,113 @@ func (cli *CommandLine) Run() {
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	anchorCmd := flag.NewFlagSet("anchor", flag.ExitOnError)
+	findAnchorCmd := flag.NewFlagSet("findanchor", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	getHistoryAddress := getHistoryCmd.String("address", "", "The address to list transactions for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
-	sendFrom := sendCmd.String("from", "", "Source wallet address")
-	sendTo := sendCmd.String("to", "", "Destination wallet address")
-	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	var sendFrom, sendTo stringList
+	sendCmd.Var(&sendFrom, "from", "Source wallet address, can be repeated")
+	sendCmd.Var(&sendTo, "to", "Destination wallet address, or ADDR:AMOUNT; can be repeated")
+	sendAmount := sendCmd.Int("amount", 0, "Amount to send to a single -to address")
+	sendCSV := sendCmd.String("csv", "", "CSV file of address,amount payouts")
+	sendChange := sendCmd.String("change", "", "Change address, defaults to the first -from address")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee per 1000 bytes of the signed transaction, overrides -fee")
+	sendCoins := sendCmd.String("coins", "auto", "Coin selection strategy: "+blockchain.CoinSelectorNames())
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendLockTime := sendCmd.Uint("locktime", 0, "Block height (or Unix time if >= 500000000) before which the transaction cannot be mined")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
-
-	switch os.Args[1] {
+	mineAddress := mineCmd.String("address", "", "The address to send block rewards to")
+	mineBlocks := mineCmd.Int("blocks", 1, "Number of blocks to mine")
+	anchorFrom := anchorCmd.String("from", "", "Wallet address paying the fee")
+	anchorData := anchorCmd.String("data", "", "Hex encoded data to anchor")
+	anchorFee := anchorCmd.Int("fee", 1, "Fee paid to the miner")
+	anchorMine := anchorCmd.Bool("mine", false, "Mine immediately on the same node")
+	findAnchorData := findAnchorCmd.String("data", "", "Hex encoded anchored data")
+	listPubKeys := listAddressesCmd.Bool("pubkeys", false, "Also print public keys")
+	multisigRequired := createMultisigCmd.Int("m", 0, "Number of signatures required")
+	multisigKeys := createMultisigCmd.String("keys", "", "Comma separated wallet addresses or hex public keys")
+	clearBannedIP := clearBannedCmd.String("ip", "", "The IP to unban, all IPs if empty")
+
+	switch args[0] {
 	case "reindexutxo":
-		err := reindexUTXOCmd.Parse(os.Args[2:])
+		err := reindexUTXOCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
+		err := getBalanceCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gethistory":
+		err := getHistoryCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
+		err := createBlockchainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "startnode":
-		err := startNodeCmd.Parse(os.Args[2:])
+		err := startNodeCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
+		err := listAddressesCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
+		err := createWalletCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "mine":
+		err := mineCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "anchor":
+		err := anchorCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "findanchor":
+		err := findAnchorCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "clearbanned":
+		err := clearBannedCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
@@ -239,7 +616,15 @@ func (cli *CommandLine) Run() {
 			getBalanceCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		cli.getBalance(*getBalanceAddress)
+	}
+
+	if getHistoryCmd.Parsed() {
+		if *getHistoryAddress == "" {
+			getHistoryCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getHistory(*getHistoryAddress)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -247,38 +632,106 @@ func (cli *CommandLine) Run() {
 			createBlockchainCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.createBlockChain(*createBlockchainAddress, nodeID)
+		cli.createBlockChain(*createBlockchainAddress)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain(nodeID)
+		cli.printChain()
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet()
 	}
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
+		cli.listAddresses(*listPubKeys)
 	}
 	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO(nodeID)
+		cli.reindexUTXO()
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		var payments []blockchain.Payment
+		if len(sendTo) == 1 && *sendAmount > 0 {
+			payments = append(payments, blockchain.Payment{Address: sendTo[0], Amount: *sendAmount})
+		} else {
+			for _, to := range sendTo {
+				p, err := parsePayment(to)
+				if err != nil {
+					fmt.Println(err)
+					runtime.Goexit()
+				}
+				payments = append(payments, p)
+			}
+		}
+		if *sendCSV != "" {
+			csvPayments, err := readPaymentsCSV(*sendCSV)
+			if err != nil {
+				fmt.Println(err)
+				runtime.Goexit()
+			}
+			payments = append(payments, csvPayments...)
+		}
+
+		selector, ok := blockchain.CoinSelectors[*sendCoins]
+		if len(sendFrom) == 0 || len(payments) == 0 || !ok || *sendFee < 0 || *sendFeeRate < 0 || *sendLockTime > math.MaxUint32 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		fee := blockchain.FixedFee(*sendFee)
+		if *sendFeeRate > 0 {
+			fee = blockchain.FeePerKB(*sendFeeRate)
+		}
+		cli.send(sendFrom, payments, *sendChange, fee, selector, uint32(*sendLockTime), *sendMine)
 	}
 
-	if startNodeCmd.Parsed() {
-		nodeID := os.Getenv("NODE_ID")
-		if nodeID == "" {
-			startNodeCmd.Usage()
+	if mineCmd.Parsed() {
+		if *mineAddress == "" || *mineBlocks <= 0 {
+			mineCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+
+		cli.mine(*mineAddress, *mineBlocks)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *multisigRequired <= 0 || *multisigKeys == "" {
+			createMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.createMultisig(*multisigRequired, strings.Split(*multisigKeys, ","))
 	}
-}
\ No newline at end of file
+
+	if anchorCmd.Parsed() {
+		data, err := hex.DecodeString(*anchorData)
+		if *anchorFrom == "" || len(data) == 0 || err != nil || *anchorFee < 0 {
+			anchorCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.anchor(*anchorFrom, data, *anchorFee, *anchorMine)
+	}
+
+	if findAnchorCmd.Parsed() {
+		data, err := hex.DecodeString(*findAnchorData)
+		if len(data) == 0 || err != nil {
+			findAnchorCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.findAnchor(data)
+	}
+
+	if listBannedCmd.Parsed() {
+		cli.listBanned()
+	}
+
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned(*clearBannedIP)
+	}
+
+	if startNodeCmd.Parsed() {
+		cli.StartNode(*startNodeMiner)
+	}
+}
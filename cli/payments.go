@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"blockchain_go/blockchain"
+)
+
+// stringList 是可以重复指定的命令行参数，例如 -from A -from B
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parsePayment 解析 ADDR:AMOUNT 形式的付款
+func parsePayment(s string) (blockchain.Payment, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return blockchain.Payment{}, fmt.Errorf("payment %q is not ADDR:AMOUNT", s)
+	}
+	amount, err := strconv.Atoi(strings.TrimSpace(s[i+1:]))
+	if err != nil || amount <= 0 {
+		return blockchain.Payment{}, fmt.Errorf("payment %q has an invalid amount", s)
+	}
+
+	return blockchain.Payment{Address: strings.TrimSpace(s[:i]), Amount: amount}, nil
+}
+
+// readPaymentsCSV 读取每行为 address,amount 的付款文件，# 开头的行是注释，
+// 第一行的金额不是数字时作为表头跳过
+func readPaymentsCSV(file string) ([]blockchain.Payment, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+
+	var payments []blockchain.Payment
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		amount, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil && first {
+			continue
+		}
+		if err != nil || amount <= 0 {
+			line, _ := r.FieldPos(1)
+			return nil, fmt.Errorf("%s:%d: invalid amount %q", file, line, record[1])
+		}
+		payments = append(payments, blockchain.Payment{Address: strings.TrimSpace(record[0]), Amount: amount})
+	}
+
+	return payments, nil
+}
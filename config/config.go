@@ -0,0 +1,131 @@
+package config
+
+/*
+节点配置和数据目录。
+
+每个节点使用自己的数据目录（-datadir），目录结构如下：
+  <datadir>/config.json  配置文件（可选，也可以用 -config 指定其他位置）
+  <datadir>/chain/       Badger 数据库：区块、区块头、索引和 UTXO 集合（放在同一个数据库中，可以在一个事务里更新）
+  <datadir>/wallets.dat  钱包文件
+  <datadir>/peers.json   地址簿：已知节点的地址、上次见到的时间和连接失败的次数
+  <datadir>/banlist.json 被封禁的 IP
+同一台机器上为每个节点使用不同的数据目录和监听地址，就可以同时运行多个节点。
+
+配置的优先级：命令行参数 > 配置文件 > 默认值。配置文件中没有出现的字段保持默认值。
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"blockchain_go/blockchain"
+)
+
+const (
+	ConfigFileName = "config.json"
+	chainDirName   = "chain"
+	walletFileName = "wallets.dat"
+	peersFileName  = "peers.json"
+	banlistName    = "banlist.json"
+
+	// DefaultNetworkMagic 是默认网络的消息头魔数（见 network/wire.go），与比特币各个网络的魔数都不同
+	DefaultNetworkMagic uint32 = 0xb7c2e3f4
+)
+
+type Config struct {
+	DataDir         string            `json:"datadir"`
+	NetworkMagic    uint32            `json:"network_magic"`    // 消息头中的网络魔数，同一个网络的节点必须一致
+	ListenAddr      string            `json:"listen_addr"`      // 节点监听的地址，例如 localhost:3000
+	SeedPeers       []string          `json:"seed_peers"`       // 启动时连接的节点，连接失败时不从地址簿中删除
+	MaxOutbound     int               `json:"max_outbound"`     // 主动连接的目标数量
+	MaxInbound      int               `json:"max_inbound"`      // 最多接受多少个对方连接过来的连接
+	BanThreshold    int               `json:"ban_threshold"`    // 连接的不当行为分数达到这个值时封禁对方
+	BanDuration     int               `json:"ban_duration"`     // 封禁的时间，单位是秒
+	MinerAddress    string            `json:"miner_address"`    // 不为空时开启挖矿，奖励发送到这个地址
+	MiningThreshold int               `json:"mining_threshold"` // 内存池中至少有多少笔交易才开始挖矿
+	Params          blockchain.Params `json:"params"`           // 共识参数（难度、奖励等），网络中所有节点必须一致
+}
+
+// Default 返回使用数据目录 dataDir 的默认配置
+func Default(dataDir string) *Config {
+	return &Config{
+		DataDir:         dataDir,
+		NetworkMagic:    DefaultNetworkMagic,
+		ListenAddr:      "localhost:3000",
+		SeedPeers:       []string{"localhost:3000"},
+		MiningThreshold: 2,
+		MaxOutbound:     8,
+		MaxInbound:      32,
+		BanThreshold:    100,
+		BanDuration:     24 * 60 * 60,
+		Params:          blockchain.ChainParams,
+	}
+}
+
+// LoadFile 从 JSON 配置文件读取配置，覆盖 c 中已有的值
+func (c *Config) LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(content, c); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Validate 检查配置是否可用
+func (c *Config) Validate() error {
+	if c.DataDir == "" {
+		return fmt.Errorf("data directory is not set")
+	}
+	if c.NetworkMagic == 0 {
+		return fmt.Errorf("network magic is not set")
+	}
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen address is not set")
+	}
+	if c.MiningThreshold <= 0 {
+		return fmt.Errorf("mining threshold must be positive, got %d", c.MiningThreshold)
+	}
+	if c.MaxOutbound < 0 || c.MaxInbound < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if c.BanThreshold <= 0 || c.BanDuration <= 0 {
+		return fmt.Errorf("ban threshold and ban duration must be positive")
+	}
+	if c.Params.RetargetInterval < 0 || c.Params.TargetSpacing <= 0 {
+		return fmt.Errorf("invalid difficulty parameters")
+	}
+	if c.Params.PowLimitBits > c.Params.InitialDifficulty || c.Params.InitialDifficulty >= 256 {
+		return fmt.Errorf("initial difficulty must be between pow limit and 255 bits")
+	}
+
+	return nil
+}
+
+// DefaultConfigFile 返回数据目录中默认的配置文件路径
+func (c *Config) DefaultConfigFile() string {
+	return filepath.Join(c.DataDir, ConfigFileName)
+}
+
+// ChainDir 返回区块链数据库（包括 UTXO 集合）所在的目录
+func (c *Config) ChainDir() string {
+	return filepath.Join(c.DataDir, chainDirName)
+}
+
+func (c *Config) WalletFile() string {
+	return filepath.Join(c.DataDir, walletFileName)
+}
+
+func (c *Config) PeersFile() string {
+	return filepath.Join(c.DataDir, peersFileName)
+}
+
+func (c *Config) BanlistFile() string {
+	return filepath.Join(c.DataDir, banlistName)
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"blockchain_go/blockchain"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{"default", func(c *Config) {}, false},
+		{"no data directory", func(c *Config) { c.DataDir = "" }, true},
+		{"no network magic", func(c *Config) { c.NetworkMagic = 0 }, true},
+		{"no listen address", func(c *Config) { c.ListenAddr = "" }, true},
+		{"zero mining threshold", func(c *Config) { c.MiningThreshold = 0 }, true},
+		{"negative outbound", func(c *Config) { c.MaxOutbound = -1 }, true},
+		{"zero ban duration", func(c *Config) { c.BanDuration = 0 }, true},
+		{"zero target spacing", func(c *Config) { c.Params.TargetSpacing = 0 }, true},
+		{"initial difficulty equals pow limit", func(c *Config) {
+			c.Params.PowLimitBits, c.Params.InitialDifficulty = 8, 8
+		}, false},
+		{"initial difficulty below pow limit", func(c *Config) {
+			c.Params.PowLimitBits, c.Params.InitialDifficulty = 12, 8
+		}, true},
+		{"initial difficulty too large", func(c *Config) { c.Params.InitialDifficulty = 256 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default(t.TempDir())
+			tt.modify(c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 创世块的目标值正好是最低难度时也必须能够挖出新区块
+func TestMineAtPowLimit(t *testing.T) {
+	c := Default(t.TempDir())
+	c.Params.PowLimitBits, c.Params.InitialDifficulty = 8, 8
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := blockchain.ChainParams
+	blockchain.ChainParams = c.Params
+	t.Cleanup(func() { blockchain.ChainParams = saved })
+
+	chain, err := blockchain.InitBlockChain("1BoatSLRHtKNngkdXEeobR76b53LETtpyT", c.ChainDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := chain.MineBlock(t.Context(), "1BoatSLRHtKNngkdXEeobR76b53LETtpyT", nil); err != nil {
+			t.Fatalf("mining block %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestLoadFileKeepsDefaults(t *testing.T) {
+	c := Default(t.TempDir())
+	path := filepath.Join(t.TempDir(), ConfigFileName)
+	if err := os.WriteFile(path, []byte(`{"listen_addr": "localhost:4000", "params": {"initial_difficulty": 16}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != "localhost:4000" || c.Params.InitialDifficulty != 16 {
+		t.Errorf("config file values not applied: %+v", c)
+	}
+	if c.MaxOutbound != 8 || c.Params.PowLimitBits != blockchain.ChainParams.PowLimitBits {
+		t.Errorf("defaults overwritten: %+v", c)
+	}
+}
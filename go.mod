@@ -5,6 +5,7 @@ go 1.24.9
 require (
 	github.com/dgraph-io/badger v1.6.2
 	github.com/mr-tron/base58 v1.2.0
+	github.com/vrecan/death/v3 v3.0.3
 	golang.org/x/crypto v0.44.0
 )
 
@@ -15,7 +16,6 @@ require (
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
-	github.com/vrecan/death/v3 v3.0.3 // indirect
 	golang.org/x/net v0.46.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 )
@@ -0,0 +1,489 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+地址簿：节点知道的其他节点的监听地址，保存在数据目录的 peers.json 中，节点重启后从这里恢复。
+每个地址记录：
+  last_seen     上次收到这个节点的消息的时间（Unix 时间，从 addr 消息得到、还没有连接过的地址为 0）
+  last_attempt  上次主动连接的时间（Unix 时间）
+  attempts      连续连接失败的次数，连接成功后清零
+  added         加入地址簿的时间（Unix 时间）
+  source        告诉我们这个地址的节点（hostOf 它的连接地址），种子节点和自己连接过的地址为空
+连接失败后按 retryBackoff 等待一段时间再重试，等待时间随失败次数翻倍；连续失败 maxFailures 次的地址从地址簿中删除，
+配置文件中的种子节点除外。选择要连接的地址时优先选择失败次数少、最近见过的地址（见 score）。
+
+其他节点发来的地址先经过 checkAddr 检查：必须是端口不为 0 的 host:port，host 是 IP 或者合法的主机名，
+不能是本节点的监听地址，也不能是 0.0.0.0、组播或广播地址。回环地址、局域网地址和主机名只接受来自回环或局域网中的节点，
+公网上的节点不能让我们去连接本机或者局域网中的服务。
+地址簿最多保存 maxAddresses 个地址，一个来源最多加入 maxAddrPerSource 个地址，一个节点不能用假地址填满地址簿。
+地址簿满了时删除分数最低、最久没有见过的地址（种子节点除外）；超过 maxAddrAge 没有见过的地址也会被删除。
+*/
+
+const (
+	baseRetryDelay = 5 * time.Second
+	maxRetryDelay  = 10 * time.Minute
+
+	// maxFailures 是删除一个地址之前允许的连续连接失败次数
+	maxFailures = 10
+	// maxAddrPerMsg 是一条 addr 消息中最多的地址数，地址更多的消息不处理并增加对方的分数（见 misbehavior.go）
+	maxAddrPerMsg = 1000
+	// maxAddresses 是地址簿中最多的地址数
+	maxAddresses = 2000
+	// maxAddrPerSource 是一个节点最多能加入地址簿的地址数
+	maxAddrPerSource = 100
+	// maxAddrAge 是删除一个地址之前允许多久没有见过它（没有见过的地址从加入地址簿的时间算起）
+	maxAddrAge = 30 * 24 * time.Hour
+)
+
+var (
+	ErrBadAddress  = errors.New("bad address")
+	ErrUnroutable  = errors.New("unroutable address")
+	ErrSelfAddress = errors.New("own address")
+)
+
+// KnownAddress 是地址簿中的一个地址
+type KnownAddress struct {
+	Addr        string `json:"addr"`
+	LastSeen    int64  `json:"last_seen"`
+	LastAttempt int64  `json:"last_attempt"`
+	Attempts    int    `json:"attempts"`
+	Added       int64  `json:"added"`
+	Source      string `json:"source,omitempty"`
+}
+
+// AddrBook 是可以在多个 goroutine 中使用的地址簿
+type AddrBook struct {
+	mu    sync.Mutex
+	file  string
+	self  string          // 本节点的监听地址，不加入地址簿
+	seeds map[string]bool // 种子节点，连接失败时不删除
+	addrs map[string]*KnownAddress
+	dirty bool // 有没有保存到文件的修改
+}
+
+// NewAddrBook 创建保存在 file 中的地址簿并加入种子节点，file 为空时不保存
+func NewAddrBook(file, self string, seeds []string) *AddrBook {
+	b := &AddrBook{
+		file:  file,
+		self:  self,
+		seeds: make(map[string]bool),
+		addrs: make(map[string]*KnownAddress),
+	}
+	for _, seed := range seeds {
+		b.seeds[seed] = true
+		b.Add(seed, "")
+	}
+
+	return b
+}
+
+// isLocalHost 判断 host 是不是回环地址或者 localhost
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// isLocalNetwork 判断 host 是不是回环地址、局域网地址或者主机名（主机名可能解析到任何地址）
+func isLocalNetwork(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// validHostname 判断 host 是否是合法的主机名：由字母、数字和 - 组成、用 . 分开的标签
+func validHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	label := 0
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		switch {
+		case c == '.':
+			if label == 0 {
+				return false
+			}
+			label = 0
+			continue
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+		default:
+			return false
+		}
+		label++
+		if label > 63 {
+			return false
+		}
+	}
+
+	return label > 0
+}
+
+// checkAddr 检查 source 发来的地址 addr 是否可以加入地址簿，source 为空表示地址来自配置文件或者本节点
+func (b *AddrBook) checkAddr(addr, source string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrBadAddress, addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("%w: %s: invalid port", ErrBadAddress, addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			return fmt.Errorf("%w: %s", ErrUnroutable, addr)
+		}
+	} else if !validHostname(host) {
+		return fmt.Errorf("%w: %s: invalid host", ErrBadAddress, addr)
+	}
+	if b.isSelf(host, portStr) {
+		return fmt.Errorf("%w: %s", ErrSelfAddress, addr)
+	}
+	if source != "" && isLocalNetwork(host) && !isLocalNetwork(hostOf(source)) {
+		return fmt.Errorf("%w: %s from %s", ErrUnroutable, addr, source)
+	}
+
+	return nil
+}
+
+// isSelf 判断 host:port 是不是本节点的监听地址。localhost 和回环地址看作同一个 host
+func (b *AddrBook) isSelf(host, port string) bool {
+	selfHost, selfPort, err := net.SplitHostPort(b.self)
+	if err != nil || port != selfPort {
+		return false
+	}
+
+	return host == selfHost || (isLocalHost(host) && (isLocalHost(selfHost) || selfHost == ""))
+}
+
+// lastActive 返回上次见过 ka 的时间，没有见过时为加入地址簿的时间
+func (ka *KnownAddress) lastActive() int64 {
+	return max(ka.LastSeen, ka.Added)
+}
+
+// expireLocked 删除超过 maxAddrAge 没有见过的地址，种子节点除外
+func (b *AddrBook) expireLocked(now time.Time) {
+	for addr, ka := range b.addrs {
+		if !b.seeds[addr] && now.Sub(time.Unix(ka.lastActive(), 0)) > maxAddrAge {
+			delete(b.addrs, addr)
+			b.dirty = true
+		}
+	}
+}
+
+// makeRoomLocked 在地址簿满了时删除一个地址：分数最低的，分数相同时最久没有见过的。
+// 返回是否可以加入新的地址，只剩种子节点时不能加入
+func (b *AddrBook) makeRoomLocked(now time.Time) bool {
+	if len(b.addrs) < maxAddresses {
+		return true
+	}
+
+	var worst *KnownAddress
+	for addr, ka := range b.addrs {
+		if b.seeds[addr] {
+			continue
+		}
+		if worst == nil || ka.score(now) < worst.score(now) ||
+			(ka.score(now) == worst.score(now) && ka.lastActive() < worst.lastActive()) {
+			worst = ka
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	delete(b.addrs, worst.Addr)
+	b.dirty = true
+
+	return true
+}
+
+// countSourceLocked 返回 source 加入的地址数
+func (b *AddrBook) countSourceLocked(source string) int {
+	count := 0
+	for _, ka := range b.addrs {
+		if ka.Source == source {
+			count++
+		}
+	}
+
+	return count
+}
+
+// retryBackoff 返回连续失败 attempts 次之后再次连接前要等待的时间
+func retryBackoff(attempts int) time.Duration {
+	if attempts <= 0 {
+		return 0
+	}
+
+	delay := baseRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxRetryDelay)
+}
+
+// score 越高越优先连接：每次失败减 1 分，最近一天内见过加 1 分
+func (ka *KnownAddress) score(now time.Time) int {
+	score := -ka.Attempts
+	if ka.LastSeen > 0 && now.Sub(time.Unix(ka.LastSeen, 0)) < 24*time.Hour {
+		score++
+	}
+
+	return score
+}
+
+// Load 读取地址簿文件，文件不存在时什么也不做。也接受旧版本的格式（地址字符串的数组）
+func (b *AddrBook) Load() error {
+	content, err := os.ReadFile(b.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var addrs []KnownAddress
+	if err := json.Unmarshal(content, &addrs); err != nil {
+		var old []string
+		if json.Unmarshal(content, &old) != nil {
+			return fmt.Errorf("peers file %s: %w", b.file, err)
+		}
+		for _, addr := range old {
+			addrs = append(addrs, KnownAddress{Addr: addr})
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for i := range addrs {
+		ka := addrs[i]
+		// 文件可能是旧版本写的或者被手动修改过，和其他节点发来的地址一样检查
+		if b.checkAddr(ka.Addr, ka.Source) != nil {
+			continue
+		}
+		if ka.Added == 0 {
+			ka.Added = now.Unix()
+		}
+		if existing, ok := b.addrs[ka.Addr]; ok {
+			// 种子节点已经加入了，使用文件中的记录
+			*existing = ka
+			continue
+		}
+		if !b.makeRoomLocked(now) {
+			break
+		}
+		b.addrs[ka.Addr] = &ka
+	}
+	b.expireLocked(now)
+
+	return nil
+}
+
+// Save 删除过期的地址后把地址簿写入文件，没有修改时什么也不做
+func (b *AddrBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expireLocked(time.Now())
+	if b.file == "" || !b.dirty {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(b.sortedLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(b.file, content, 0644); err != nil {
+		return err
+	}
+	b.dirty = false
+
+	return nil
+}
+
+// sortedLocked 返回按地址排序的所有记录
+func (b *AddrBook) sortedLocked() []KnownAddress {
+	all := make([]KnownAddress, 0, len(b.addrs))
+	for _, ka := range b.addrs {
+		all = append(all, *ka)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Addr < all[j].Addr })
+
+	return all
+}
+
+// Add 加入 source 发来的地址，返回是否是新的地址。source 是发来地址的连接的 hostOf，
+// 为空表示地址来自配置文件或者本节点。没有通过 checkAddr 的地址和超过 maxAddrPerSource 的地址不加入
+func (b *AddrBook) Add(addr, source string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.checkAddr(addr, source) != nil {
+		return false
+	}
+	if _, ok := b.addrs[addr]; ok {
+		return false
+	}
+	if source != "" && b.countSourceLocked(source) >= maxAddrPerSource {
+		return false
+	}
+	now := time.Now()
+	if !b.makeRoomLocked(now) {
+		return false
+	}
+	b.addrs[addr] = &KnownAddress{Addr: addr, Added: now.Unix(), Source: source}
+	b.dirty = true
+
+	return true
+}
+
+// Remove 从地址簿中删除地址
+func (b *AddrBook) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.addrs[addr]; ok {
+		delete(b.addrs, addr)
+		b.dirty = true
+	}
+}
+
+// Attempt 记录开始连接 addr
+func (b *AddrBook) Attempt(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ka, ok := b.addrs[addr]; ok {
+		ka.LastAttempt = time.Now().Unix()
+		b.dirty = true
+	}
+}
+
+// Failed 记录连接 addr 失败，连续失败 maxFailures 次后删除不是种子节点的地址
+func (b *AddrBook) Failed(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.Attempts++
+	b.dirty = true
+	if ka.Attempts >= maxFailures && !b.seeds[addr] {
+		delete(b.addrs, addr)
+	}
+}
+
+// Good 记录与 addr 完成了握手：清除失败次数并更新 LastSeen，地址不在地址簿中时加入
+func (b *AddrBook) Good(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.checkAddr(addr, "") != nil {
+		return
+	}
+	now := time.Now()
+	ka, ok := b.addrs[addr]
+	if !ok {
+		if !b.makeRoomLocked(now) {
+			return
+		}
+		ka = &KnownAddress{Addr: addr, Added: now.Unix()}
+		b.addrs[addr] = ka
+	}
+	// 自己连接成功过的地址不再算作来源节点加入的地址
+	ka.Source = ""
+	ka.Attempts = 0
+	ka.LastSeen = now.Unix()
+	b.dirty = true
+}
+
+// Seen 更新 addr 的 LastSeen
+func (b *AddrBook) Seen(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ka, ok := b.addrs[addr]; ok {
+		ka.LastSeen = time.Now().Unix()
+		b.dirty = true
+	}
+}
+
+// Addresses 返回地址簿中的所有地址，按地址排序
+func (b *AddrBook) Addresses() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addrs []string
+	for _, ka := range b.sortedLocked() {
+		addrs = append(addrs, ka.Addr)
+	}
+
+	return addrs
+}
+
+// Len 返回地址簿中的地址数
+func (b *AddrBook) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.addrs)
+}
+
+// Candidates 返回现在可以连接的地址，不包括 exclude 中的地址和还在等待重试的地址，分数高的在前
+func (b *AddrBook) Candidates(exclude map[string]bool) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var ready []*KnownAddress
+	for _, ka := range b.addrs {
+		if exclude[ka.Addr] || now.Before(time.Unix(ka.LastAttempt, 0).Add(retryBackoff(ka.Attempts))) {
+			continue
+		}
+		ready = append(ready, ka)
+	}
+
+	// 分数相同的地址随机排列，避免所有节点都连接同一个节点
+	rand.Shuffle(len(ready), func(i, j int) { ready[i], ready[j] = ready[j], ready[i] })
+	sort.SliceStable(ready, func(i, j int) bool { return ready[i].score(now) > ready[j].score(now) })
+
+	addrs := make([]string, len(ready))
+	for i, ka := range ready {
+		addrs[i] = ka.Addr
+	}
+
+	return addrs
+}
+
+// Sample 随机返回最多 max 个地址，用于回复 getaddr
+func (b *AddrBook) Sample(max int) []string {
+	addrs := b.Addresses()
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > max {
+		addrs = addrs[:max]
+	}
+
+	return addrs
+}
@@ -0,0 +1,184 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+封禁列表：被封禁的 IP（本机上的节点是 127.0.0.1:端口，见 banKey）和封禁到期的时间，保存在数据目录的 banlist.json 中。
+节点拒绝被封禁的 IP 连接过来，也不会主动连接它们。命令行的 listbanned/clearbanned 直接读写这个文件，
+运行中的节点发现文件被修改后重新读取，所以不需要重启节点。
+*/
+
+// BanEntry 是封禁列表中的一个 IP
+type BanEntry struct {
+	Host   string `json:"host"`
+	Until  int64  `json:"until"` // 封禁到期的 Unix 时间
+	Reason string `json:"reason"`
+}
+
+// BanList 是可以在多个 goroutine 中使用的封禁列表
+type BanList struct {
+	mu      sync.Mutex
+	file    string
+	modTime time.Time // 上次读取或写入时文件的修改时间
+	bans    map[string]BanEntry
+}
+
+// NewBanList 创建保存在 file 中的封禁列表并读取文件
+func NewBanList(file string) (*BanList, error) {
+	b := &BanList{file: file, bans: make(map[string]BanEntry)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.loadLocked(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// hostOf 返回 addr（host:port）中的 host
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// loadLocked 读取封禁列表文件，文件不存在时清空列表
+func (b *BanList) loadLocked() error {
+	info, err := os.Stat(b.file)
+	if os.IsNotExist(err) {
+		b.bans = make(map[string]BanEntry)
+		b.modTime = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(b.file)
+	if err != nil {
+		return err
+	}
+	var entries []BanEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("banlist %s: %w", b.file, err)
+	}
+
+	b.bans = make(map[string]BanEntry)
+	for _, entry := range entries {
+		b.bans[entry.Host] = entry
+	}
+	b.modTime = info.ModTime()
+
+	return nil
+}
+
+// reloadLocked 在文件被其他进程（例如命令行）修改过时重新读取
+func (b *BanList) reloadLocked() {
+	info, err := os.Stat(b.file)
+	if (err == nil && info.ModTime().Equal(b.modTime)) || (os.IsNotExist(err) && b.modTime.IsZero()) {
+		return
+	}
+
+	if err := b.loadLocked(); err != nil {
+		fmt.Printf("Failed to reload banlist: %s\n", err)
+	}
+}
+
+// saveLocked 写入没有过期的封禁
+func (b *BanList) saveLocked() error {
+	content, err := json.MarshalIndent(b.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(b.file, content, 0644); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(b.file)
+	if err != nil {
+		return err
+	}
+	b.modTime = info.ModTime()
+
+	return nil
+}
+
+// listLocked 返回没有过期的封禁，按 IP 排序
+func (b *BanList) listLocked() []BanEntry {
+	now := time.Now().Unix()
+	entries := []BanEntry{}
+	for _, entry := range b.bans {
+		if entry.Until > now {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Host < entries[j].Host })
+
+	return entries
+}
+
+// Ban 封禁 host 一段时间并写入文件
+func (b *BanList) Ban(host string, duration time.Duration, reason string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reloadLocked()
+	b.bans[host] = BanEntry{host, time.Now().Add(duration).Unix(), reason}
+
+	return b.saveLocked()
+}
+
+// IsBanned 判断 host 是否被封禁
+func (b *BanList) IsBanned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reloadLocked()
+	entry, ok := b.bans[host]
+
+	return ok && entry.Until > time.Now().Unix()
+}
+
+// List 返回没有过期的封禁
+func (b *BanList) List() []BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reloadLocked()
+	return b.listLocked()
+}
+
+// Unban 解除对 host 的封禁，返回 host 是否被封禁过
+func (b *BanList) Unban(host string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reloadLocked()
+	if _, ok := b.bans[host]; !ok {
+		return false, nil
+	}
+	delete(b.bans, host)
+
+	return true, b.saveLocked()
+}
+
+// Clear 解除所有封禁
+func (b *BanList) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bans = make(map[string]BanEntry)
+	return b.saveLocked()
+}
@@ -0,0 +1,293 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+version/verack 握手。
+  1. 主动连接的一方发送 version：协议版本、服务、时间、nonce、user agent、区块高度和监听地址
+  2. 收到 version 的一方检查协议版本和 nonce，不接受时回复 reject 说明原因并断开连接；
+     接受时如果还没有发送自己的 version 就先发送，然后回复 verack
+  3. 收到 verack 后握手完成，对方的区块更多时发送 getheaders 开始同步；主动连接的一方还发送 getaddr 请求对方知道的地址
+发送 verack 之前不发送其他消息；收到 verack 之前对方发来 version/verack/reject 以外的消息（例如 inv、block、tx）时
+回复 reject 并断开连接。每个节点启动时生成一个随机的 nonce，收到带有自己 nonce 的 version 说明连接到了自己。
+*/
+
+const (
+	// ProtocolVersion 是本节点使用的协议版本，版本 2 开始使用 wire.go 中的消息封装和握手，
+	// 版本 3 开始区块的默克尔根包括交易的解锁脚本（见 encoding.go）
+	ProtocolVersion = 3
+	// MinProtocolVersion 是可以连接的最低协议版本，更早版本的节点不接受包含普通交易的新区块
+	MinProtocolVersion = 3
+
+	UserAgent = "/blockchain_go:0.2/"
+
+	// handshakeTimeout 是建立连接后完成握手的最长时间
+	handshakeTimeout = 30 * time.Second
+)
+
+// ServiceFlag 是节点在 version 消息中声明的服务，可以组合
+type ServiceFlag uint64
+
+const (
+	ServiceFullNode ServiceFlag = 1 << iota // 保存完整的区块链，可以提供区块和区块头
+	ServiceMiner                            // 挖矿
+	ServiceWallet                           // 只发送交易的钱包，没有监听地址
+)
+
+var serviceNames = []struct {
+	flag ServiceFlag
+	name string
+}{
+	{ServiceFullNode, "full"},
+	{ServiceMiner, "miner"},
+	{ServiceWallet, "wallet"},
+}
+
+var (
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	ErrSelfConnection      = errors.New("connected to self")
+	ErrDuplicateVersion    = errors.New("duplicate version message")
+	ErrHandshakeIncomplete = errors.New("message received before verack")
+	ErrRejected            = errors.New("rejected by peer")
+)
+
+// localNonce 是命令行（clientHandshake）在 version 消息中发送的 nonce。
+// 每个 Node 使用自己的 nonce（Node.nonce），同一个进程中的多个节点也可以互相连接
+var localNonce = newNonce()
+
+// Reject 说明拒绝了对方的哪条消息和原因
+type Reject struct {
+	Command string
+	Reason  string
+}
+
+func (s ServiceFlag) Has(flag ServiceFlag) bool {
+	return s&flag == flag
+}
+
+func (s ServiceFlag) String() string {
+	var names []string
+	for _, service := range serviceNames {
+		if s.Has(service.flag) {
+			names = append(names, service.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, "|")
+}
+
+func newNonce() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		log.Panic(err)
+	}
+
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func isHandshakeCommand(command string) bool {
+	return command == "version" || command == "verack" || command == "reject"
+}
+
+// localServices 返回本节点提供的服务
+func (n *Node) localServices() ServiceFlag {
+	services := ServiceFullNode
+	if len(n.minerAddr) > 0 {
+		services |= ServiceMiner
+	}
+
+	return services
+}
+
+// checkVersion 检查对方的 version 消息是否可以接受，nonce 是本端发送的 nonce
+func checkVersion(v *Version, nonce uint64) error {
+	if v.Version < MinProtocolVersion {
+		return fmt.Errorf("%w: peer uses version %d, minimum is %d", ErrIncompatibleVersion, v.Version, MinProtocolVersion)
+	}
+	if v.Nonce == nonce {
+		return ErrSelfConnection
+	}
+
+	return nil
+}
+
+// acceptVersion 检查并记录对方的 version 消息
+func (p *Peer) acceptVersion(v *Version) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.remote != nil {
+		return ErrDuplicateVersion
+	}
+	if err := checkVersion(v, p.node.nonce); err != nil {
+		return err
+	}
+	p.remote = v
+
+	return nil
+}
+
+func (p *Peer) sentVersion() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.versionSent
+}
+
+// handshakeComplete 返回是否已经收到对方的 verack
+func (p *Peer) handshakeComplete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.verackReceived
+}
+
+// isFullNode 返回是否已经与 p 完成握手并且对方是完整节点
+func (p *Peer) isFullNode() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.verackReceived && p.remote.Services.Has(ServiceFullNode)
+}
+
+// sendVerack 发送 verack，然后发送握手期间等待的消息
+func (p *Peer) sendVerack() {
+	p.mu.Lock()
+	if p.verackSent {
+		p.mu.Unlock()
+		return
+	}
+	p.verackSent = true
+	ok := p.enqueue(message{"verack", nil})
+	for _, msg := range p.pending {
+		if !ok {
+			break
+		}
+		ok = p.enqueue(msg)
+	}
+	p.pending = nil
+	p.mu.Unlock()
+
+	if !ok {
+		p.sendQueueFull()
+	}
+}
+
+func SendReject(p *Peer, command, reason string) {
+	SendData(p, "reject", GobEncode(Reject{command, reason}))
+}
+
+// rejectAndDisconnect 告诉对方拒绝 command 消息的原因，然后断开连接
+func rejectAndDisconnect(p *Peer, command string, reason error) {
+	fmt.Printf("Rejecting %s from %s: %s\n", command, p, reason)
+	SendReject(p, command, reason.Error())
+	p.DisconnectAfterSend()
+}
+
+// HandleVerack 处理 verack 消息：握手完成，对方的区块链更长时开始同步区块头。
+// 主动连接的握手完成后在地址簿中记录连接成功，并请求对方知道的地址
+func (n *Node) HandleVerack(p *Peer, request []byte) error {
+	p.mu.Lock()
+	remote := p.remote
+	if remote == nil {
+		p.mu.Unlock()
+		rejectAndDisconnect(p, "verack", errors.New("verack received before version"))
+		return nil
+	}
+	if p.verackReceived {
+		p.mu.Unlock()
+		return nil
+	}
+	p.verackReceived = true
+	p.mu.Unlock()
+
+	p.conn.SetReadDeadline(time.Time{})
+	fmt.Printf("Handshake with %s complete: version %d, services %s, user agent %s, height %d\n",
+		p, remote.Version, remote.Services, remote.UserAgent, remote.BestHeight)
+
+	if !remote.Services.Has(ServiceFullNode) {
+		return nil
+	}
+	if !p.Inbound {
+		n.book.Good(p.Addr())
+		n.SendGetAddr(p)
+	}
+
+	bestHeight, err := n.chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if bestHeight < remote.BestHeight {
+		return n.requestHeaders(p)
+	}
+
+	return nil
+}
+
+func HandleReject(p *Peer, request []byte) error {
+	var payload Reject
+	dec := gob.NewDecoder(bytes.NewReader(request))
+	if err := dec.Decode(&payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	fmt.Printf("%s rejected our %s message: %s\n", p, payload.Command, payload.Reason)
+
+	return nil
+}
+
+// clientHandshake 在没有运行节点的命令行中与 conn 另一端的节点握手，本端只声明 ServiceWallet
+func clientHandshake(conn net.Conn) error {
+	ours := Version{ProtocolVersion, ServiceWallet, time.Now().Unix(), localNonce, UserAgent, 0, ""}
+	if err := WriteMessage(conn, "version", GobEncode(ours)); err != nil {
+		return err
+	}
+
+	gotVersion, gotVerack := false, false
+	for !gotVersion || !gotVerack {
+		command, payload, err := ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch command {
+		case "version":
+			var v Version
+			if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&v); err != nil {
+				return err
+			}
+			if err := checkVersion(&v, localNonce); err != nil {
+				WriteMessage(conn, "reject", GobEncode(Reject{"version", err.Error()}))
+				return err
+			}
+			if err := WriteMessage(conn, "verack", nil); err != nil {
+				return err
+			}
+			gotVersion = true
+		case "verack":
+			gotVerack = true
+		case "reject":
+			var r Reject
+			if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&r); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %s: %s", ErrRejected, r.Command, r.Reason)
+		}
+	}
+
+	return nil
+}
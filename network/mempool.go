@@ -0,0 +1,339 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"blockchain_go/blockchain"
+)
+
+/*
+内存池：还没有打包进区块的交易，矿工从这里选择交易（见 MineTx）。
+进入内存池的交易都通过了 CheckTransaction：输入花费的是 UTXO 集合或者内存池中其他交易的输出，签名有效，手续费不为负。
+  - 内存池最多保存 maxPoolTxs 笔、总共 maxPoolBytes 字节的交易，超过时删除手续费率（手续费 / 交易字节数）最低的交易，
+    删除一笔交易时一起删除内存池中花费它的输出的交易（它们已经无法打包）
+  - 与内存池中的交易花费同一个输出的交易不接受（ErrPoolConflict），先到的交易优先
+  - 区块连接到主链后删除区块中的交易和与它们冲突的交易；链重组时被断开区块中的交易重新放回内存池，
+    之后针对新的 tip 重新检查内存池，删除已经无效的交易（updatePool）
+孤立交易：输入引用的交易既不在 UTXO 集合中也不在内存池中（CheckTransaction 返回 ErrOrphanTx），
+父交易可能还在路上，所以先保存在 orphanTxs 中，父交易进入内存池后再检查。
+最多保存 maxOrphanTxs 笔、每笔不超过 maxOrphanTxSize 字节，满了时删除最早收到的，超过 orphanTxExpiry 的也会被删除。
+孤立交易不转发给其他节点。
+*/
+
+const (
+	maxPoolTxs      = 5000
+	maxPoolBytes    = 5 << 20
+	maxOrphanTxs    = 100
+	maxOrphanTxSize = 10000
+	orphanTxExpiry  = 20 * time.Minute
+)
+
+var (
+	ErrPoolConflict = errors.New("transaction conflicts with a transaction in the memory pool")
+	ErrPoolFull     = errors.New("memory pool is full and the fee rate is too low")
+)
+
+// poolEntry 是内存池中的一笔交易
+type poolEntry struct {
+	tx   blockchain.Transaction
+	fee  int
+	size int
+}
+
+// lowerFeeRate 判断 e 的手续费率是否低于 other，交叉相乘避免浮点数
+func (e *poolEntry) lowerFeeRate(other *poolEntry) bool {
+	return e.fee*other.size < other.fee*e.size
+}
+
+// orphanTx 是一笔孤立交易
+type orphanTx struct {
+	tx      blockchain.Transaction
+	expires time.Time
+}
+
+func outpointKey(id []byte, out int) string {
+	return fmt.Sprintf("%x:%d", id, out)
+}
+
+// acceptTx 检查 p 发来的交易并放入内存池，然后转发给其他节点，接着检查等待这笔交易的孤立交易。
+// 违反共识规则的交易返回 ErrInvalidTx；以后可能有效的交易只拒绝，父交易还没有收到的交易放入孤立交易
+func (n *Node) acceptTx(p *Peer, tx blockchain.Transaction) error {
+	fee, err := n.chain.CheckTransaction(&tx, n.poolTx)
+	if errors.Is(err, blockchain.ErrOrphanTx) {
+		n.addOrphanTx(tx)
+		return nil
+	} else if err != nil {
+		if blockchain.IsRuleError(err) && !isPendingTxError(err) {
+			return fmt.Errorf("%w: %x: %v", ErrInvalidTx, tx.ID, err)
+		}
+		fmt.Printf("Rejecting transaction %x: %s\n", tx.ID, err)
+		return nil
+	}
+
+	poolSize, err := n.addToPool(tx, fee)
+	if err != nil {
+		fmt.Printf("Rejecting transaction %x: %s\n", tx.ID, err)
+		return nil
+	} else if poolSize == 0 {
+		return nil
+	}
+
+	fmt.Printf("%s, %d\n", n.addr, poolSize)
+
+	n.broadcastInv("tx", tx.ID, p)
+	if poolSize >= n.miningThreshold && len(n.minerAddr) > 0 {
+		n.startMining()
+	}
+
+	// 孤立交易来自哪个节点已经不重要，违反规则时不增加任何连接的分数
+	for _, orphan := range n.takeOrphansOf(tx.ID) {
+		if err := n.acceptTx(nil, orphan); err != nil {
+			fmt.Printf("Dropping orphan transaction %x: %s\n", orphan.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// addToPool 把交易加入内存池，返回内存池中的交易数，交易已经在内存池中时返回 0。
+// 与内存池中的交易冲突时返回 ErrPoolConflict，内存池满了并且交易的手续费率最低时返回 ErrPoolFull
+func (n *Node) addToPool(tx blockchain.Transaction, fee int) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := n.memoryPool[id]; ok {
+		return 0, nil
+	}
+	for _, in := range tx.Inputs {
+		if other, ok := n.poolSpends[outpointKey(in.ID, in.Out)]; ok {
+			return 0, fmt.Errorf("%w: %s spends %x:%d", ErrPoolConflict, other, in.ID, in.Out)
+		}
+	}
+
+	entry := &poolEntry{tx, fee, len(tx.Serialize())}
+	n.memoryPool[id] = entry
+	n.poolBytes += entry.size
+	for _, in := range tx.Inputs {
+		n.poolSpends[outpointKey(in.ID, in.Out)] = id
+	}
+
+	for len(n.memoryPool) > maxPoolTxs || n.poolBytes > maxPoolBytes {
+		var lowest *poolEntry
+		for _, e := range n.memoryPool {
+			if lowest == nil || e.lowerFeeRate(lowest) {
+				lowest = e
+			}
+		}
+		n.removeTxLocked(lowest.tx.ID, true)
+	}
+	if _, ok := n.memoryPool[id]; !ok {
+		return 0, fmt.Errorf("%w: fee %d for %d bytes", ErrPoolFull, fee, entry.size)
+	}
+
+	return len(n.memoryPool), nil
+}
+
+// removeTxLocked 从内存池中删除交易，descendants 为 true 时一起删除花费它的输出的交易。
+// 交易被打包进区块时它的输出仍然存在，不删除花费它们的交易
+func (n *Node) removeTxLocked(txID []byte, descendants bool) {
+	id := hex.EncodeToString(txID)
+	entry, ok := n.memoryPool[id]
+	if !ok {
+		return
+	}
+	delete(n.memoryPool, id)
+	n.poolBytes -= entry.size
+	for _, in := range entry.tx.Inputs {
+		delete(n.poolSpends, outpointKey(in.ID, in.Out))
+	}
+	if !descendants {
+		return
+	}
+
+	for out := range entry.tx.Outputs {
+		if child, ok := n.poolSpends[outpointKey(txID, out)]; ok {
+			childID, _ := hex.DecodeString(child)
+			n.removeTxLocked(childID, true)
+		}
+	}
+}
+
+// poolTx 返回内存池中的交易，用于 CheckTransaction 查找父交易和回复 getdata
+func (n *Node) poolTx(id []byte) (*blockchain.Transaction, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entry, ok := n.memoryPool[hex.EncodeToString(id)]
+	if !ok {
+		return nil, false
+	}
+	tx := entry.tx
+
+	return &tx, true
+}
+
+// haveTx 判断交易是否在内存池或者孤立交易中，收到 inv 时不再请求这些交易
+func (n *Node) haveTx(id []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := hex.EncodeToString(id)
+	_, inPool := n.memoryPool[key]
+	_, orphan := n.orphanTxs[key]
+
+	return inPool || orphan
+}
+
+func (n *Node) poolSize() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return len(n.memoryPool)
+}
+
+// poolTxs 返回内存池中所有交易的副本
+func (n *Node) poolTxs() []*blockchain.Transaction {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var txs []*blockchain.Transaction
+	for _, entry := range n.memoryPool {
+		tx := entry.tx
+		txs = append(txs, &tx)
+	}
+
+	return txs
+}
+
+// removeFromPool 从内存池中删除已经打包进区块的交易，以及与它们花费同一个输出的交易
+func (n *Node) removeFromPool(txs []*blockchain.Transaction) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, tx := range txs {
+		n.removeTxLocked(tx.ID, false)
+		for _, in := range tx.Inputs {
+			if other, ok := n.poolSpends[outpointKey(in.ID, in.Out)]; ok {
+				otherID, _ := hex.DecodeString(other)
+				n.removeTxLocked(otherID, true)
+			}
+		}
+	}
+}
+
+// updatePool 在主链 tip 变化后更新内存池（attached、detached 是 AddBlock 返回的主链变化，按高度从低到高排列）：
+// 删除连接到主链的区块中的交易和与它们冲突的交易，把被断开区块中的交易（coinbase 除外）通过 acceptTx 放回内存池，
+// 最后删除针对新的 tip 已经无效的交易
+func (n *Node) updatePool(attached, detached []*blockchain.Block) {
+	mined := make(map[string]bool)
+	for _, block := range attached {
+		n.removeFromPool(block.Transactions)
+		for _, tx := range block.Transactions {
+			mined[hex.EncodeToString(tx.ID)] = true
+		}
+	}
+
+	// 按高度从低到高放回，父交易总是在花费它的交易之前
+	for _, block := range detached {
+		for _, tx := range block.Transactions[1:] {
+			if mined[hex.EncodeToString(tx.ID)] {
+				continue
+			}
+			if err := n.acceptTx(nil, *tx); err != nil {
+				fmt.Printf("Dropping transaction %x from a disconnected block: %s\n", tx.ID, err)
+			}
+		}
+	}
+
+	n.revalidatePool()
+}
+
+// revalidatePool 针对当前 tip 重新检查内存池中的交易，删除已经无效的交易以及花费它们输出的交易，返回删除的交易数。
+// 挖矿失败或者主链 tip 变化后调用，否则无效的交易会一直留在内存池中，之后的每次挖矿都会失败。
+// 读取数据库失败等与交易无关的错误不删除交易
+func (n *Node) revalidatePool() int {
+	evicted := 0
+	for _, tx := range n.poolTxs() {
+		if _, ok := n.poolTx(tx.ID); !ok {
+			// 已经作为其他无效交易的后代被删除
+			continue
+		}
+		_, err := n.chain.CheckTransaction(tx, n.poolTx)
+		if err == nil || (!blockchain.IsRuleError(err) && !errors.Is(err, blockchain.ErrOrphanTx)) {
+			continue
+		}
+
+		// 已经打包进主链的交易的输出仍然存在，花费它们的交易不删除
+		_, findErr := n.chain.FindTransaction(tx.ID)
+		fmt.Printf("Evicting transaction %x: %s\n", tx.ID, err)
+		n.mu.Lock()
+		n.removeTxLocked(tx.ID, findErr != nil)
+		n.mu.Unlock()
+		evicted++
+	}
+
+	return evicted
+}
+
+// addOrphanTx 保存一笔孤立交易，超过 maxOrphanTxSize 的交易不保存
+func (n *Node) addOrphanTx(tx blockchain.Transaction) {
+	if len(tx.Serialize()) > maxOrphanTxSize {
+		fmt.Printf("Rejecting orphan transaction %x: too large\n", tx.ID)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := n.orphanTxs[id]; ok {
+		return
+	}
+
+	now := time.Now()
+	for key, orphan := range n.orphanTxs {
+		if now.After(orphan.expires) {
+			delete(n.orphanTxs, key)
+		}
+	}
+	if len(n.orphanTxs) >= maxOrphanTxs {
+		oldest := ""
+		for key, orphan := range n.orphanTxs {
+			if oldest == "" || orphan.expires.Before(n.orphanTxs[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(n.orphanTxs, oldest)
+	}
+
+	n.orphanTxs[id] = &orphanTx{tx, now.Add(orphanTxExpiry)}
+	fmt.Printf("Added orphan transaction %x, %d orphans\n", tx.ID, len(n.orphanTxs))
+}
+
+// takeOrphansOf 取出花费 parentID 的输出并且没有过期的孤立交易
+func (n *Node) takeOrphansOf(parentID []byte) []blockchain.Transaction {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	var txs []blockchain.Transaction
+	for key, orphan := range n.orphanTxs {
+		if now.After(orphan.expires) {
+			delete(n.orphanTxs, key)
+			continue
+		}
+		for _, in := range orphan.tx.Inputs {
+			if string(in.ID) == string(parentID) {
+				txs = append(txs, orphan.tx)
+				delete(n.orphanTxs, key)
+				break
+			}
+		}
+	}
+
+	return txs
+}
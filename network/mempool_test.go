@@ -0,0 +1,195 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"blockchain_go/blockchain"
+	"blockchain_go/config"
+	"blockchain_go/wallet"
+)
+
+// newPoolTestNode 创建一个没有启动的节点，返回钱包和 n 个已经成熟、可以花费的 coinbase 交易。
+// 节点的区块链数据库同时复制到 forkDirs 中的每个目录，用来构建与节点分叉的区块
+func newPoolTestNode(t *testing.T, n int, forkDirs ...string) (*Node, *wallet.Wallet, []*blockchain.Transaction) {
+	t.Helper()
+
+	cfg := config.Default(t.TempDir())
+	w := wallet.MakeWallet()
+	address := string(w.Address())
+
+	chain, err := blockchain.InitBlockChain(address, cfg.ChainDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coinbases []*blockchain.Transaction
+	for i := 0; i < n+blockchain.ChainParams.CoinbaseMaturity; i++ {
+		block, err := chain.MineBlock(context.Background(), address, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < n {
+			coinbases = append(coinbases, block.Transactions[0])
+		}
+	}
+	chain.Database.Close()
+	for _, dir := range forkDirs {
+		copyDir(t, cfg.ChainDir(), dir)
+	}
+
+	node, err := NewNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Stop)
+
+	return node, w, coinbases
+}
+
+// spendOutput 创建花费 prev 第一个输出、支付 1 个单位手续费的交易
+func spendOutput(t *testing.T, w *wallet.Wallet, prev *blockchain.Transaction) *blockchain.Transaction {
+	t.Helper()
+
+	out := prev.Outputs[0]
+	tx := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: prev.ID, Out: 0, Sequence: blockchain.SequenceFinal}},
+		Outputs: []blockchain.TxOutput{{Value: out.Value - 1, ScriptPubKey: out.ScriptPubKey}},
+	}
+	tx.ID = tx.Hash()
+	if err := tx.SignInput(&w.PrivateKey, 0, *prev, blockchain.SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func acceptTestTx(t *testing.T, n *Node, tx *blockchain.Transaction) {
+	t.Helper()
+
+	if err := n.acceptTx(nil, *tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.poolTx(tx.ID); !ok {
+		t.Fatalf("transaction %x was not added to the memory pool", tx.ID)
+	}
+}
+
+// 内存池中已经无效的交易曾经一直留在内存池中，之后每次挖矿都失败
+func TestMineTxEvictsInvalidTransactions(t *testing.T) {
+	n, w, coinbases := newPoolTestNode(t, 2)
+	address := string(w.Address())
+
+	stale := spendOutput(t, w, coinbases[0])
+	acceptTestTx(t, n, stale)
+	// 绕过节点直接打包 stale，内存池中的 stale 已经无效
+	if _, err := n.chain.MineBlock(context.Background(), address, []*blockchain.Transaction{stale}); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := spendOutput(t, w, coinbases[1])
+	acceptTestTx(t, n, valid)
+
+	n.minerAddr = address
+	n.MineTx()
+
+	if size := n.poolSize(); size != 0 {
+		t.Errorf("memory pool has %d transactions after mining, want 0", size)
+	}
+	if _, err := n.chain.FindTransaction(valid.ID); err != nil {
+		t.Errorf("valid transaction was not mined: %v", err)
+	}
+}
+
+func TestRevalidatePoolKeepsChildrenOfMinedTransactions(t *testing.T) {
+	n, w, coinbases := newPoolTestNode(t, 2)
+	address := string(w.Address())
+
+	parent := spendOutput(t, w, coinbases[0])
+	acceptTestTx(t, n, parent)
+	child := spendOutput(t, w, parent)
+	acceptTestTx(t, n, child)
+
+	// doubleSpend 的输入被另一笔交易花费，花费它输出的交易也一起删除
+	doubleSpend := spendOutput(t, w, coinbases[1])
+	acceptTestTx(t, n, doubleSpend)
+	doubleSpendChild := spendOutput(t, w, doubleSpend)
+	acceptTestTx(t, n, doubleSpendChild)
+	conflict := spendOutput(t, w, coinbases[1])
+	conflict.Outputs[0].Value--
+	conflict.ID = conflict.Hash()
+	if err := conflict.SignInput(&w.PrivateKey, 0, *coinbases[1], blockchain.SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := n.chain.MineBlock(context.Background(), address, []*blockchain.Transaction{parent, conflict}); err != nil {
+		t.Fatal(err)
+	}
+
+	if evicted := n.revalidatePool(); evicted != 2 {
+		t.Errorf("revalidatePool evicted %d transactions, want 2", evicted)
+	}
+	for _, tx := range []*blockchain.Transaction{parent, doubleSpend, doubleSpendChild} {
+		if _, ok := n.poolTx(tx.ID); ok {
+			t.Errorf("invalid transaction %x is still in the memory pool", tx.ID)
+		}
+	}
+	if _, ok := n.poolTx(child.ID); !ok {
+		t.Error("child of a mined transaction was evicted")
+	}
+}
+
+// 链重组后内存池曾经只删除收到的区块中的交易：新分支其他区块中的交易留在内存池中，被断开区块中的交易丢失
+func TestUpdatePoolAfterReorganize(t *testing.T) {
+	forkDir := t.TempDir()
+	n, w, coinbases := newPoolTestNode(t, 2, forkDir)
+	address := string(w.Address())
+
+	disconnectedTx := spendOutput(t, w, coinbases[0])
+	oldBlock, err := n.chain.MineBlock(context.Background(), address, []*blockchain.Transaction{disconnectedTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minedTx := spendOutput(t, w, coinbases[1])
+	acceptTestTx(t, n, minedTx)
+
+	fork, err := blockchain.ContinueBlockChain(forkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Database.Close()
+	var forkBlocks []*blockchain.Block
+	for _, txs := range [][]*blockchain.Transaction{{minedTx}, nil} {
+		block, err := fork.MineBlock(context.Background(), address, txs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forkBlocks = append(forkBlocks, block)
+	}
+
+	// 第一个区块的累计工作量与当前 tip 相同，只保存；第二个区块让新分支的工作量更大，触发链重组
+	attached, detached, err := n.chain.AddBlock(forkBlocks[0])
+	if err != nil || len(attached) != 0 || len(detached) != 0 {
+		t.Fatalf("AddBlock(side block) = %d attached, %d detached, %v", len(attached), len(detached), err)
+	}
+	attached, detached, err = n.chain.AddBlock(forkBlocks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detached) != 1 || !bytes.Equal(detached[0].Hash, oldBlock.Hash) {
+		t.Fatalf("detached %d blocks, want the old tip", len(detached))
+	}
+	if len(attached) != 2 || !bytes.Equal(attached[0].Hash, forkBlocks[0].Hash) || !bytes.Equal(attached[1].Hash, forkBlocks[1].Hash) {
+		t.Fatalf("attached %d blocks, want both fork blocks from low to high", len(attached))
+	}
+
+	n.updatePool(attached, detached)
+
+	if _, ok := n.poolTx(minedTx.ID); ok {
+		t.Error("transaction mined in the new branch is still in the memory pool")
+	}
+	if _, ok := n.poolTx(disconnectedTx.ID); !ok {
+		t.Error("transaction from the disconnected block was not put back into the memory pool")
+	}
+}
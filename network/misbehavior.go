@@ -0,0 +1,137 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"blockchain_go/blockchain"
+)
+
+/*
+不当行为检测。
+Handle 函数遇到无法解码的消息或者无效的数据时返回错误，而不是让整个节点 panic。handleMessage 根据错误给发送消息的连接
+增加分数（banScore）：
+  无效的区块或区块头（工作量证明、难度、默克尔根等违反共识规则）  banScoreInvalidBlock
+  超过 MaxPayloadSize 的消息                                    banScoreOversized
+  无法解码的消息、校验和错误                                    banScoreMalformed
+  条目过多的 inv/headers/addr 消息                              banScoreTooManyItems
+  无效的交易（签名、金额、交易 ID）                              banScoreInvalidTx
+  没有请求过的区块                                              banScoreUnsolicited
+分数达到 cfg.BanThreshold 时断开连接，并在 cfg.BanDuration 内拒绝来自同一个 IP 的连接（见 banlist.go）。
+同一台机器上的节点都从回环地址连接过来，只封禁 IP 会把它们全部封禁，所以回环地址上的节点按监听地址（IP:端口）封禁（见 banKey）。
+分数属于一个连接，断开后重新连接从 0 开始。
+与对方无关的错误（例如读取数据库失败）不增加分数，handleMessage 只断开连接，不会让整个节点 panic。
+*/
+
+const (
+	banScoreInvalidBlock = 100
+	banScoreOversized    = 100
+	banScoreMalformed    = 20
+	banScoreTooManyItems = 20
+	banScoreInvalidTx    = 10
+	banScoreUnsolicited  = 10
+
+	// maxInvPerMsg 是一条 inv 消息中最多的条目数
+	maxInvPerMsg = 50000
+)
+
+var (
+	ErrMalformedMessage = errors.New("malformed message")
+	ErrTooManyItems     = errors.New("too many items in message")
+	ErrUnsolicited      = errors.New("unsolicited message")
+	ErrInvalidBlock     = errors.New("invalid block")
+	ErrInvalidTx        = errors.New("invalid transaction")
+	ErrBanned           = errors.New("peer is banned")
+)
+
+// pendingTxErrors 说明交易现在不能进入内存池，但是以后可能有效（例如花费的输出已经被另一笔交易花费或者还没有成熟），
+// 拒绝这样的交易时不增加分数
+var pendingTxErrors = []error{
+	blockchain.ErrMissingInput, blockchain.ErrImmatureSpend, blockchain.ErrNonFinalTx, blockchain.ErrSequenceLock,
+}
+
+// banScore 返回 Handle 函数返回的错误对应的分数，与对方无关的错误（例如数据库错误）为 0
+func banScore(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidBlock):
+		return banScoreInvalidBlock
+	case errors.Is(err, ErrPayloadTooLarge):
+		return banScoreOversized
+	case errors.Is(err, ErrMalformedMessage), errors.Is(err, ErrBadChecksum), errors.Is(err, ErrBadMagic):
+		return banScoreMalformed
+	case errors.Is(err, ErrTooManyItems):
+		return banScoreTooManyItems
+	case errors.Is(err, ErrInvalidTx):
+		return banScoreInvalidTx
+	case errors.Is(err, ErrUnsolicited):
+		return banScoreUnsolicited
+	}
+
+	return 0
+}
+
+// isPendingTxError 判断交易被拒绝的原因是否可能在以后消失
+func isPendingTxError(err error) bool {
+	for _, pending := range pendingTxErrors {
+		if errors.Is(err, pending) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// misbehaving 按 err 增加 p 的分数，达到 banThreshold 时封禁对方的 IP 并断开连接
+func (n *Node) misbehaving(p *Peer, err error) {
+	score := banScore(err)
+	if score == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	p.banScore += score
+	total := p.banScore
+	p.mu.Unlock()
+
+	fmt.Printf("Misbehaving peer %s: %s (ban score %d)\n", p, err, total)
+	if total < n.banThreshold {
+		return
+	}
+
+	key := peerBanKey(p)
+	if err := n.bans.Ban(key, n.banDuration, err.Error()); err != nil {
+		fmt.Printf("Failed to save banlist: %s\n", err)
+	}
+	fmt.Printf("Banned %s for %s\n", key, n.banDuration)
+	p.Disconnect()
+}
+
+// banKey 返回封禁 addr（host:port）时使用的 key：通常是 IP；回环地址是 127.0.0.1:端口，
+// 只封禁本机上这一个端口的节点
+func banKey(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if isLocalHost(host) {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+
+	return host
+}
+
+// peerBanKey 返回封禁 p 时使用的 key。从回环地址连接过来的一方使用临时端口，按它的监听地址封禁
+func peerBanKey(p *Peer) string {
+	remote := p.conn.RemoteAddr().String()
+	if addr := p.Addr(); addr != "" && isLocalHost(hostOf(remote)) {
+		return banKey(addr)
+	}
+
+	return banKey(remote)
+}
+
+// isBanned 判断 addr（host:port）是否被封禁
+func (n *Node) isBanned(addr string) bool {
+	return n.bans.IsBanned(banKey(addr))
+}
@@ -2,44 +2,35 @@ package network
 
 /*
 为区块链项目创建一个网络模块，使得每个节点都能独立存储区块链数据，并能够与其他节点通信。这个过程涉及到构建网络逻辑，并将其整合到区块链系统中。
-中心节点（Central Node）：负责连接所有其他节点并在它们之间传递数据。
+种子节点（Seed Node）：新节点启动时首先连接的节点，之后节点通过 getaddr/addr 交换地址并互相连接（见 peermanager.go），
+每个节点把收到的新交易和新区块转发给它连接的其他节点。
 矿工节点（Minor Node）：存储交易并生成新区块。
 钱包节点（Wallet Node）：用于在钱包之间发送加密货币，且持有完整的区块链副本。
 */
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"runtime"
 	"syscall"
+	"time"
 
 	death "github.com/vrecan/death/v3"
 
 	"blockchain_go/blockchain"
-	"blockchain_go/common"
+	"blockchain_go/config"
 )
 
 const (
 	protocol      = "tcp"
-	version       = 1
 	commandLength = 12
 )
 
-var (
-	nodeAddress     string // 每个节点实例都会有一个唯一的地址，通常是通过端口号来区分。节点地址是唯一的，每个节点实例通过不同的端口号进行区分
-	mineAddress     string // 表示作为矿工的节点地址，矿工负责挖矿和验证交易。处理交易和验证区块
-	KnownNodes      = []string{"localhost:3000"} // 用来存储网络中已知的节点地址。这个数组将包含所有连接到该网络的本地主机地址（即，所有的节点地址）。
-	blocksInTransit = [][]byte{} // 创建一个二维的 bit slice（比特切片）来表示区块数据，可能用于存储区块链中的具体区块信息。
-	memoryPool      = make(map[string]blockchain.Transaction) // 为了存储交易数据，使用一个映射（map）来存储每一笔交易，map 的键是交易 ID，值是交易本身。
-)
-
 type Addr struct {
 	AddrList []string
 }
@@ -49,14 +40,11 @@ type Block struct {
 	Block    []byte
 }
 
-type GetBlocks struct {
-	AddrFrom string
-}
-
+// GetData 请求对方发送 Items 中的区块或交易，一条消息最多 maxInvPerMsg 项
 type GetData struct {
 	AddrFrom string
 	Type     string
-	ID       []byte
+	Items    [][]byte
 }
 
 type Inv struct {
@@ -65,25 +53,42 @@ type Inv struct {
 	Items    [][]byte
 }
 
+// GetHeaders 请求对方发送 Locator 之后的主链区块头
+type GetHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+type Headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
 type Tx struct {
 	AddrFrom    string
 	Transaction []byte
 }
 /*
-Version 用于区块链多节点之间的同步（sync）过程。
+Version 是握手时发送的第一条消息（见 handshake.go），也用于区块链多节点之间的同步（sync）过程。
 同步流程：
 1. 节点之间互相发送自身区块链版本（BestHeight）
-2. 比较区块高度（链长度）
+2. 握手完成后比较区块高度（链长度）
 3. 如果本地区块链落后，则向对方请求缺失的区块
 4. 直至所有节点区块高度一致
 
 说明：
+- Version 是协议版本，低于 MinProtocolVersion 的节点会被拒绝
+- Services 是节点提供的服务（完整节点、矿工、只发送交易的钱包）
+- Nonce 是节点启动时生成的随机数，用来发现连接到了自己
 - BestHeight 表示该节点当前区块链的高度（区块总数）
-- Version 可用于标识该节点的版本号（可与 BestHeight 相同或用于扩展）
-- AddrFrom 表示发送 version 消息的节点地址
+- AddrFrom 表示发送 version 消息的节点的监听地址，钱包没有监听地址，为空
 */
 type Version struct {
 	Version    int
+	Services   ServiceFlag
+	Timestamp  int64
+	Nonce      uint64
+	UserAgent  string
 	BestHeight int
 	AddrFrom   string
 }
@@ -110,258 +115,421 @@ func BytesToCmd(bytes []byte) string {
 	return fmt.Sprintf("%s", cmd)
 }
 
-func ExtractCmd(request []byte) []byte {
-	return request[:commandLength]
+// SendAddr 发送地址簿中随机的一部分地址和本节点的监听地址
+func (n *Node) SendAddr(p *Peer) {
+	nodes := Addr{n.book.Sample(maxAddrPerMsg - 1)}
+	nodes.AddrList = append(nodes.AddrList, n.addr)
+
+	SendData(p, "addr", GobEncode(nodes))
 }
 
-func RequestBlocks() {
-	for _, node := range KnownNodes {
-		SendGetBlocks(node)
-	}
+// SendGetAddr 请求对方发送它知道的节点地址
+func (n *Node) SendGetAddr(p *Peer) {
+	SendData(p, "getaddr", nil)
 }
 
-func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := GobEncode(nodes)
-	request := append(CmdToBytes("addr"), payload...)
+// SendBlock 回复 getdata 请求的区块，发送队列满时等待（见 Peer.queueReply）
+func (n *Node) SendBlock(p *Peer, b *blockchain.Block) {
+	data := Block{n.addr, b.Serialize()}
 
-	SendData(address, request)
+	p.queueReply("block", GobEncode(data))
 }
 
-func SendBlock(addr string, b *blockchain.Block) {
-	data := Block{nodeAddress, b.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("block"), payload...)
+// SendData 通过连接 p 发送一条消息，p 为 nil（连接失败）时什么也不做
+func SendData(p *Peer, command string, payload []byte) {
+	if p == nil {
+		return
+	}
 
-	SendData(addr, request)
+	p.QueueMessage(command, payload)
 }
 
-func SendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-
-	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
+func (n *Node) SendInv(p *Peer, kind string, items [][]byte) {
+	inventory := Inv{n.addr, kind, items}
 
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
+	SendData(p, "inv", GobEncode(inventory))
+}
 
-		KnownNodes = updatedNodes
+func (n *Node) SendGetHeaders(p *Peer, locator [][]byte) {
+	SendData(p, "getheaders", GobEncode(GetHeaders{n.addr, locator}))
+}
 
-		return
+// requestHeaders 用本地主链的 BlockLocator 向 p 发送 getheaders，from 中的区块哈希放在 locator 的最前面
+func (n *Node) requestHeaders(p *Peer, from ...[]byte) error {
+	locator, err := n.chain.BlockLocator()
+	if err != nil {
+		return err
 	}
+	n.SendGetHeaders(p, append(from, locator...))
 
-	defer conn.Close()
+	return nil
+}
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+func (n *Node) SendHeaders(p *Peer, headers []*blockchain.BlockHeader) {
+	data := Headers{AddrFrom: n.addr}
+	for _, header := range headers {
+		data.Headers = append(data.Headers, header.Serialize())
 	}
+
+	SendData(p, "headers", GobEncode(data))
 }
 
-func SendInv(address, kind string, items [][]byte) {
-	inventory := Inv{nodeAddress, kind, items}
-	payload := GobEncode(inventory)
-	request := append(CmdToBytes("inv"), payload...)
+// SendGetData 用一条 getdata 请求对方发送区块或交易，请求的区块记录在 p 中，收到没有请求过的区块时增加对方的分数
+func (n *Node) SendGetData(p *Peer, kind string, ids [][]byte) {
+	if p != nil && kind == "block" {
+		for _, id := range ids {
+			p.requestBlock(id)
+		}
+	}
 
-	SendData(address, request)
+	SendData(p, "getdata", GobEncode(GetData{n.addr, kind, ids}))
 }
 
-func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
-	request := append(CmdToBytes("getblocks"), payload...)
+// SendTx 回复 getdata 请求的交易，发送队列满时等待（见 Peer.queueReply）
+func (n *Node) SendTx(p *Peer, tnx *blockchain.Transaction) {
+	data := Tx{n.addr, tnx.Serialize()}
 
-	SendData(address, request)
+	p.queueReply("tx", GobEncode(data))
 }
 
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{nodeAddress, kind, id})
-	request := append(CmdToBytes("getdata"), payload...)
+// SubmitTx 把交易发送给地址为 addr 的节点，供不运行节点的命令行使用：建立连接，握手，发送 tx 消息后关闭连接
+func SubmitTx(addr string, tnx *blockchain.Transaction) error {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := clientHandshake(conn); err != nil {
+		return err
+	}
 
-	SendData(address, request)
+	return WriteMessage(conn, "tx", GobEncode(Tx{"", tnx.Serialize()}))
 }
 
-func SendTx(addr string, tnx *blockchain.Transaction) {
-	data := Tx{nodeAddress, tnx.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("tx"), payload...)
+// BroadcastTx 依次把交易发送给种子节点和地址簿中的其他节点，直到有一个节点收下
+func BroadcastTx(cfg *config.Config, tnx *blockchain.Transaction) error {
+	book := NewAddrBook(cfg.PeersFile(), cfg.ListenAddr, cfg.SeedPeers)
+	if err := book.Load(); err != nil {
+		return err
+	}
+
+	err := errors.New("no peers to send the transaction to")
+	tried := make(map[string]bool)
+	for _, addr := range append(append([]string{}, cfg.SeedPeers...), book.Addresses()...) {
+		if tried[addr] {
+			continue
+		}
+		tried[addr] = true
 
-	SendData(addr, request)
+		if err = SubmitTx(addr, tnx); err == nil {
+			return nil
+		}
+		fmt.Printf("Failed to send transaction to %s: %s\n", addr, err)
+	}
+
+	return err
 }
 
-func SendVersion(addr string, chain *blockchain.BlockChain) {
-	bestHeight, err := chain.GetBestHeight()
-	if err != nil{
-		common.HandlerError(err)
+// SendVersion 向 p 发送 version，读取本地区块高度失败时返回错误
+func (n *Node) SendVersion(p *Peer) error {
+	bestHeight, err := n.chain.GetBestHeight()
+	if err != nil {
+		return err
 	}
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
 
-	request := append(CmdToBytes("version"), payload...)
+	p.mu.Lock()
+	p.versionSent = true
+	p.mu.Unlock()
 
-	SendData(addr, request)
+	data := Version{ProtocolVersion, n.localServices(), time.Now().Unix(), n.nonce, UserAgent, bestHeight, n.addr}
+	SendData(p, "version", GobEncode(data))
+
+	return nil
 }
 
-func HandleAddr(request []byte) {
+func (n *Node) HandleAddr(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Addr
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if len(payload.AddrList) > maxAddrPerMsg {
+		return fmt.Errorf("%w: %d addresses", ErrTooManyItems, len(payload.AddrList))
+	}
 
+	// 连接管理会连接新的地址
+	source := hostOf(p.conn.RemoteAddr().String())
+	added := 0
+	for _, addr := range payload.AddrList {
+		if n.book.Add(addr, source) {
+			added++
+		}
 	}
+	fmt.Printf("Received %d addresses from %s, %d new, there are %d known nodes\n", len(payload.AddrList), p, added, n.book.Len())
+
+	return nil
+}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
-	RequestBlocks()
+// HandleGetAddr 用 addr 回复本节点知道的地址
+func (n *Node) HandleGetAddr(p *Peer, request []byte) error {
+	n.SendAddr(p)
+
+	return nil
 }
 // HandleBlock 处理来自其他节点发送的区块数据（block 命令）。
 //
 // 流程说明：
 // 1. 从收到的字节流中读取命令并提取 payload。
 // 2. 使用 gob 解码 payload 得到区块（Block）。
-// 3. 调用 DeserializeBlock 将字节转换为 Block 对象。
+// 3. 调用 DecodeBlock 将字节转换为 Block 对象，没有通过 getdata 请求过的区块不处理。
 // 4. 打印收到新区块的日志，便于调试和观察节点间同步。
-// 5. 调用 AddBlock 将该区块加入本地区块链。
-// 6. 若还有未下载的区块（blocksInTransit 列表中），则：
+// 5. 调用 AddBlock 将该区块加入本地区块链，违反共识规则的区块返回 ErrInvalidBlock（见 misbehavior.go）。
+//      - 如果 tip 发生变化，取消正在进行的挖矿（abortMining），按 AddBlock 返回的主链变化更新内存池（updatePool），
+//        并把新区块转发给其他连接的节点
+//      - 如果区块的父区块还没有收到（孤块），向对方发送 getheaders 补齐中间的区块
+// 6. 若还有要从这个连接下载的区块（Peer 的 blocksInTransit 队列中），则：
 //      - 取出下一个区块哈希
-//      - 发送 getblock 请求以获取该区块
-//      - blocksInTransit 向前移动（下标 0 的已被处理）
-// 7. 若没有更多区块需要下载，则：
-//      - 创建 UTXOSet
-//      - 重新索引 UTXO（Reindex），确保新链结构正确。
+//      - 向同一个连接发送 getdata 请求以获取该区块
 // 
+// UTXOSet 由 AddBlock 在连接和断开区块时增量更新（UTXOSet.Update / UTXOSet.Undo），不需要重新索引。
 // 该函数用于链同步流程：当节点收到一个区块后，会自动继续拉取剩余区块，直到全部同步。
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleBlock(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Block
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.DecodeBlock(blockData)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if !p.takeRequested(block.Hash) {
+		return fmt.Errorf("%w: block %x", ErrUnsolicited, block.Hash)
+	}
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
+	attached, detached, err := n.chain.AddBlock(block)
+	if blockchain.IsRuleError(err) {
+		return fmt.Errorf("%w: %x: %v", ErrInvalidBlock, block.Hash, err)
+	} else if err != nil {
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+	} else {
+		fmt.Printf("Added block %x\n", block.Hash)
+	}
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	if len(attached) > 0 || len(detached) > 0 {
+		n.abortMining()
+		n.updatePool(attached, detached)
+		n.broadcastInv("block", block.Hash, p)
+	} else if err == nil && !n.chain.HasBlock(block.Hash) {
+		// AddBlock 把孤块放在内存中，没有保存
+		if err := n.requestHeaders(p); err != nil {
+			return err
+		}
+	}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	n.requestNextBlock(p)
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{Blockchain:chain}
-		UTXOSet.Reindex()
-	}
+	return nil
 }
 
-func HandleInv(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleInv(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Inv
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	if len(payload.Items) == 0 {
+		return fmt.Errorf("%w: empty inventory", ErrMalformedMessage)
+	}
+	if len(payload.Items) > maxInvPerMsg {
+		return fmt.Errorf("%w: %d inventory items", ErrTooManyItems, len(payload.Items))
+	}
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	switch payload.Type {
+	case "block":
+		var missing [][]byte
+		for _, b := range payload.Items {
+			if !n.chain.HasBlock(b) {
+				missing = append(missing, b)
 			}
 		}
-		blocksInTransit = newInTransit
-	}
-
-	if payload.Type == "tx" {
-		txID := payload.Items[0]
+		if len(missing) == 0 {
+			return nil
+		}
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+		// 正在从 p 同步时新区块排在队列后面，不打断同步
+		n.downloadBlocks(p, missing)
+	case "tx":
+		// 所有还没有的交易用一条 getdata 请求，不会因为通告的交易很多而填满发给对方的发送队列
+		var missing [][]byte
+		for _, txID := range payload.Items {
+			if !n.haveTx(txID) {
+				missing = append(missing, txID)
+			}
+		}
+		if len(missing) > 0 {
+			n.SendGetData(p, "tx", missing)
 		}
+	default:
+		return fmt.Errorf("%w: unknown inventory type %q", ErrMalformedMessage, payload.Type)
 	}
+
+	return nil
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleGetHeaders(p *Peer, request []byte) error {
 	var buff bytes.Buffer
-	var payload GetBlocks
+	var payload GetHeaders
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	// HeadersAfter 为 locator 中的每个哈希查询一次数据库
+	if len(payload.Locator) > blockchain.MaxLocatorHashes {
+		return fmt.Errorf("%w: %d locator hashes", ErrTooManyItems, len(payload.Locator))
+	}
+
+	headers, err := n.chain.HeadersAfter(payload.Locator)
+	if err != nil {
+		return err
 	}
+	n.SendHeaders(p, headers)
 
-	blocks := chain.GetBlockHashes()
-	SendInv(payload.AddrFrom, "block", blocks)
+	return nil
 }
 
-func HandleGetData(request []byte, chain *blockchain.BlockChain) {
+// HandleHeaders 处理 headers 消息（headers-first 同步）。
+//
+// 流程说明：
+// 1. 逐个验证并保存收到的区块头（工作量证明、父区块、高度、时间戳），
+//    违反共识规则的区块头返回 ErrInvalidBlock，不再处理这条消息。
+// 2. 把本地还没有区块内容的区块哈希按高度顺序放进这个连接的下载队列（downloadBlocks），
+//    通过 getdata 从同一个连接逐个下载，这样区块总是在父区块之后到达。
+// 3. 如果收到的区块头数量达到上限，说明对方还有更多区块头，继续发送 getheaders。
+func (n *Node) HandleHeaders(p *Peer, request []byte) error {
 	var buff bytes.Buffer
-	var payload GetData
+	var payload Headers
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
-	if payload.Type == "block" {
-		block, err := chain.GetBlock([]byte(payload.ID))
+	if len(payload.Headers) > blockchain.MaxHeadersPerMsg {
+		return fmt.Errorf("%w: %d headers", ErrTooManyItems, len(payload.Headers))
+	}
+
+	var lastHash []byte
+	var missing [][]byte
+	for _, data := range payload.Headers {
+		header, err := blockchain.DecodeHeader(data)
 		if err != nil {
-			return
+			return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+		}
+		if err := n.chain.AddHeader(header); blockchain.IsRuleError(err) {
+			return fmt.Errorf("%w: header: %v", ErrInvalidBlock, err)
+		} else if err != nil {
+			fmt.Printf("Rejected header: %s\n", err)
+			break
 		}
 
-		SendBlock(payload.AddrFrom, &block)
+		lastHash = header.ComputeHash()
+		if !n.chain.HasBlock(lastHash) {
+			missing = append(missing, lastHash)
+		}
 	}
 
-	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+	fmt.Printf("Recevied %d headers, %d blocks to download\n", len(payload.Headers), len(missing))
+
+	n.downloadBlocks(p, missing)
 
-		SendTx(payload.AddrFrom, &tx)
+	if len(payload.Headers) == blockchain.MaxHeadersPerMsg && lastHash != nil {
+		return n.requestHeaders(p, lastHash)
 	}
+
+	return nil
+}
+
+func (n *Node) HandleGetData(p *Peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload GetData
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if len(payload.Items) == 0 {
+		return fmt.Errorf("%w: empty getdata", ErrMalformedMessage)
+	}
+	if len(payload.Items) > maxInvPerMsg {
+		return fmt.Errorf("%w: %d getdata items", ErrTooManyItems, len(payload.Items))
+	}
+
+	// 没有的区块和交易不回复
+	switch payload.Type {
+	case "block":
+		for _, id := range payload.Items {
+			if block, err := n.chain.GetBlock(id); err == nil {
+				n.SendBlock(p, &block)
+			}
+		}
+	case "tx":
+		for _, id := range payload.Items {
+			if tx, ok := n.poolTx(id); ok {
+				n.SendTx(p, tx)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unknown data type %q", ErrMalformedMessage, payload.Type)
+	}
+
+	return nil
 }
 // HandleTx 处理接收到的交易，并根据条件广播或挖矿。
 //
 // 流程说明：
 // 1. 接收来自网络的交易字节流。
-// 2. 将字节流解码为 Transaction 结构体。
-// 3. 将交易存入内存池（Memory Pool），
+// 2. 将字节流解码为 Transaction 结构体，由 acceptTx 用 CheckTransaction 检查交易（见 mempool.go）：
+//      - 签名、金额或交易 ID 无效的交易返回 ErrInvalidTx（见 misbehavior.go）
+//      - 输入已经被花费、还没有成熟或者锁定时间没有到期的交易以后可能有效，只拒绝
+//      - 父交易还没有收到的交易放入孤立交易，父交易进入内存池后再检查
+// 3. 将交易存入内存池（Memory Pool），内存池中已经有这笔交易时什么也不做
 //      - key 为交易 ID（string 编码）
-//      - value 为交易本身
-// 4. 如果当前节点是中心节点（Central Node）：
-//      - 遍历已知节点列表（knownNodes）
-//      - 将交易广播给除中心节点和矿工节点以外的其他节点
+//      - value 为交易本身和手续费，内存池满了时删除手续费率最低的交易
+// 4. 用 inv 把交易转发给除发送者以外的所有连接的完整节点
 // 5. 如果当前节点是矿工节点（Minor Node）：
 //      - 检查内存池中交易数量是否超过阈值（例如 > 2）
 //      - 检查是否存在矿工节点地址（minor address）
-//      - 如果条件满足，调用 MineTransaction() 生成新区块
+//      - 如果条件满足，通过 startMining 在单独的 goroutine 中调用 MineTx() 生成新区块
 //          - MineTransaction 会从内存池选择交易打包
 //          - 更新区块链（Blockchain）
 //          - 更新 UTXOSet
@@ -371,192 +539,259 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 // - Memory Pool 用于暂存未打包交易，为矿工挖矿提供数据。
 // - 广播机制确保交易能传播到网络中其他节点。
 // - 挖矿条件可根据实际需求调整阈值。
-func HandleTx(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleTx(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Tx
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
-
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
-
-	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				SendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
-	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-			MineTx(chain)
-		}
+	tx, err := blockchain.DecodeTransaction(txData)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
+
+	return n.acceptTx(p, tx)
 }
 // MineTx 处理内存池中的交易并生成新区块（挖矿流程）。
 //
 // 流程说明：
-// 1. 遍历内存池（Memory Pool）中的交易。
-//      - 对每笔交易进行验证（VerifyTransaction）
-//      - 将通过验证的交易加入临时交易列表
-//      - 若所有交易无效，则停止挖矿
-// 2. 创建 Coinbase 交易（奖励交易），矿工地址为 minor address
-//      - 将 Coinbase 交易加入临时交易列表
-// 3. 调用 MineBlock(transactions) 生成新区块，并添加到区块链
-// 4. 更新 UTXOSet（UTXOSet.Reindex()）
-// 5. 从内存池中删除已打包的交易
-// 6. 广播新区块给所有已知节点（knownNodes），更新它们的区块链
-// 7. 如果内存池中仍有交易，则递归调用 MineTransaction() 继续挖矿
+// 1. 取出内存池（Memory Pool）中的所有交易。
+// 2. 调用 MineBlock(minerAddr, transactions) 生成新区块，并添加到区块链
+//      - MineBlock 验证交易并按手续费率从高到低选择交易，若所有交易无效，则停止挖矿
+//      - 挖矿失败时针对当前 tip 重新检查内存池（revalidatePool），删除无效的交易后用剩下的交易重新挖矿
+//      - MineBlock 创建 Coinbase 交易（奖励交易），把区块奖励和手续费支付给 minor address
+//      - 挖矿过程中 HandleBlock 收到新的 tip 时会取消本次挖矿，然后在新的 tip 上重新开始
+// 3. 从内存池中删除已打包的交易（UTXOSet 已经由 AddBlock 增量更新）
+// 4. 广播新区块给所有连接的完整节点，更新它们的区块链
+// 5. 如果内存池中仍有交易，则递归调用 MineTransaction() 继续挖矿
 //
 // 注意：
 // - Memory Pool 存储所有未打包交易，是矿工挖矿的交易来源
-// - Coinbase 交易保证矿工获得区块奖励
+// - Coinbase 交易保证矿工获得区块奖励和手续费
 // - 广播机制确保新区块在网络中同步
-// 矿工挖矿流程 = 验证交易 → 添加奖励交易 → 生成新区块 → 更新 UTXO → 清理内存池 → 广播新区块 → 递归挖矿（如果内存池仍有交易）
-func MineTx(chain *blockchain.BlockChain) {
-	var txs []*blockchain.Transaction
-
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
+// 矿工挖矿流程 = 验证交易 → 添加奖励交易 → 生成新区块并更新 UTXO → 清理内存池 → 广播新区块 → 递归挖矿（如果内存池仍有交易）
+func (n *Node) MineTx() {
+	txs := n.poolTxs()
+	for _, tx := range txs {
+		fmt.Printf("tx: %x\n", tx.ID)
 	}
 
-	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
+	ctx, cancel := context.WithCancel(context.Background())
+	attempt := &miningAttempt{cancel}
+	n.miningMu.Lock()
+	// Stop 在取消挖矿之前关闭 quit，这里检查 quit 保证 Stop 之后不会开始新的挖矿
+	if n.isStopping() {
+		n.miningMu.Unlock()
+		cancel()
 		return
 	}
+	n.miningJob = attempt
+	n.miningMu.Unlock()
+	defer func() {
+		n.miningMu.Lock()
+		if n.miningJob == attempt {
+			n.miningJob = nil
+		}
+		n.miningMu.Unlock()
+		cancel()
+	}()
+
+	newBlock, err := n.chain.MineBlock(ctx, n.minerAddr, txs)
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Mining aborted: received a new tip")
+		if n.poolSize() > 0 {
+			n.MineTx()
+		}
+		return
+	}
+	if err != nil {
+		if errors.Is(err, blockchain.ErrNoTransactions) {
+			fmt.Println("All Transactions are invalid")
+		} else {
+			fmt.Printf("Failed to mine block: %s\n", err)
+		}
+		// 无效的交易留在内存池中会让之后的每次挖矿都失败，删除它们之后用剩下的交易重新挖矿
+		if n.revalidatePool() > 0 && n.poolSize() > 0 {
+			n.MineTx()
+		}
+		return
+	}
+	fmt.Println("New Block mined")
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
+	n.removeFromPool(newBlock.Transactions)
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet  := blockchain.UTXOSet{Blockchain:chain}
-	UTXOSet.Reindex()
+	n.broadcastInv("block", newBlock.Hash, nil)
 
-	fmt.Println("New Block mined")
-
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+	if n.poolSize() > 0 {
+		n.MineTx()
 	}
-
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, "block", [][]byte{newBlock.Hash})
-		}
+}
+// startMining 在单独的 goroutine 中运行 MineTx，不阻塞连接的读循环，否则读循环收不到让挖矿取消的新区块。
+// 已经在挖矿时什么也不做，MineTx 挖出区块后会继续打包内存池中剩下的交易
+func (n *Node) startMining() {
+	if !n.mining.CompareAndSwap(false, true) {
+		return
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		defer n.mining.Store(false)
+		n.MineTx()
+	}()
+}
+
+// abortMining 取消正在进行的挖矿，避免继续在已经过时的 tip 上计算
+func (n *Node) abortMining() {
+	n.miningMu.Lock()
+	defer n.miningMu.Unlock()
+
+	if n.miningJob != nil {
+		n.miningJob.cancel()
+		n.miningJob = nil
 	}
 }
-// HandleVersion 处理来自其他节点的 version 消息，用于区块链同步。
+
+// HandleVersion 处理来自其他节点的 version 消息，是握手的第一步（见 handshake.go）。
 // 
 // 流程说明：
 // 1. 接收并解码对方节点发送的 Version 消息。
-// 2. 获取本地区块链的高度（BestHeight）。
-// 3. 比较本地链高度与对方链高度：
-//      - 如果本地高度 < 对方高度：
-//            -> 本地缺少新区块，发送 getblocks 命令请求下载缺失区块。
-//      - 如果本地高度 > 对方高度：
-//            -> 本地区块链更长，调用 sendVersion(peer, blockchain) 将版本信息发送给对方，方便对方同步。
-// 4. 检查节点是否已经存在于已知节点列表（knownNodes）：
-//      - 如果节点不存在，则将其加入 knownNodes。
-// 5. 该函数同时为后续交易处理做准备，确保节点能够接收和广播交易。
+// 2. 检查协议版本和 nonce：
+//      - 协议版本低于 MinProtocolVersion，或者 nonce 是本节点的 nonce（连接到了自己）：
+//            -> 回复 reject 说明原因并断开连接。
+//      - 重复的 version：回复 reject，忽略这条消息。
+// 3. 对方连接过来时本节点还没有发送 version，先发送 version，然后回复 verack。
+//    收到对方的 verack 后（HandleVerack）比较区块高度，本地区块链落后时发送 getheaders。
+// 4. 对方是有监听地址的完整节点时，用监听地址登记这个连接，并把地址加入地址簿（book）。
 //
 // 注意：
 // - Version 结构体中 BestHeight 字段表示节点当前区块链高度。
-// - knownNodes 用于维护网络中已知节点列表，避免重复请求或广播。
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
+// - 地址簿用于维护网络中已知节点列表，连接管理从中选择要连接的节点。
+func (n *Node) HandleVersion(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Version
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
-	bestHeight ,_:= chain.GetBestHeight()
-	otherHeight := payload.BestHeight
+	if err := p.acceptVersion(&payload); errors.Is(err, ErrDuplicateVersion) {
+		SendReject(p, "version", err.Error())
+		return nil
+	} else if err != nil {
+		rejectAndDisconnect(p, "version", err)
+		return nil
+	}
 
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
-	} else if bestHeight > otherHeight {
-		SendVersion(payload.AddrFrom, chain)
+	if !p.sentVersion() {
+		if err := n.SendVersion(p); err != nil {
+			return err
+		}
 	}
+	p.sendVerack()
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	if payload.AddrFrom == "" || !payload.Services.Has(ServiceFullNode) {
+		return nil
+	}
+	// 从回环地址连接过来时 HandleConnection 只知道临时端口，现在才能检查监听地址是否被封禁
+	if p.Inbound && isLocalHost(hostOf(p.conn.RemoteAddr().String())) && n.isBanned(payload.AddrFrom) {
+		rejectAndDisconnect(p, "version", ErrBanned)
+		return nil
 	}
+	n.registerPeer(payload.AddrFrom, p)
+	n.book.Add(payload.AddrFrom, hostOf(p.conn.RemoteAddr().String()))
+
+	return nil
 }
 
-func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
-	req, err := ioutil.ReadAll(conn)
-	defer conn.Close()
-	
-	if err != nil {
-		log.Panic(err)
+// HandleConnection 为对方连接过来的长连接启动读循环和写循环。
+// 对方的 IP 被封禁，或者连接数已经达到 maxInbound 时关闭连接
+func (n *Node) HandleConnection(conn net.Conn) {
+	if n.isBanned(conn.RemoteAddr().String()) {
+		fmt.Printf("Rejecting connection from banned %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if _, inbound := n.peerCounts(); inbound >= n.maxInbound {
+		fmt.Printf("Too many inbound connections, closing connection from %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	n.startPeer(newPeer(conn, "", true, n))
+}
+
+// handleMessage 把连接 p 上收到的一条消息交给对应的 Handle 函数
+func (n *Node) handleMessage(p *Peer, command string, payload []byte) {
+	if !isHandshakeCommand(command) && !p.handshakeComplete() {
+		rejectAndDisconnect(p, command, ErrHandshakeIncomplete)
+		return
+	}
+	if addr := p.Addr(); addr != "" {
+		n.book.Seen(addr)
 	}
-	command := BytesToCmd(req[:commandLength])
-	fmt.Printf("Received %s command\n", command)
 
+	var err error
 	switch command {
 	case "addr":
-		HandleAddr(req)
+		err = n.HandleAddr(p, payload)
+	case "getaddr":
+		err = n.HandleGetAddr(p, payload)
 	case "block":
-		HandleBlock(req, chain)
+		err = n.HandleBlock(p, payload)
 	case "inv":
-		HandleInv(req, chain)
-	case "getblocks":
-		HandleGetBlocks(req, chain)
+		err = n.HandleInv(p, payload)
+	case "getheaders":
+		err = n.HandleGetHeaders(p, payload)
+	case "headers":
+		err = n.HandleHeaders(p, payload)
 	case "getdata":
-		HandleGetData(req, chain)
+		err = n.HandleGetData(p, payload)
 	case "tx":
-		HandleTx(req, chain)
+		err = n.HandleTx(p, payload)
 	case "version":
-		HandleVersion(req, chain)
+		err = n.HandleVersion(p, payload)
+	case "verack":
+		err = n.HandleVerack(p, payload)
+	case "reject":
+		err = HandleReject(p, payload)
 	default:
 		fmt.Println("Unknown command")
 	}
 
+	if err != nil {
+		fmt.Printf("Failed to handle %s from %s: %s\n", command, p, err)
+		if banScore(err) == 0 {
+			// 本地的错误（例如读取数据库失败），无法继续为对方服务
+			p.Disconnect()
+			return
+		}
+		n.misbehaving(p, err)
+	}
 }
 
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	mineAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
+// StartServer 按配置启动节点：打开数据目录中的区块链，监听 cfg.ListenAddr 并连接种子节点，
+// 收到退出信号后停止节点（见 CloseDB）
+func StartServer(cfg *config.Config) {
+	node, err := NewNode(cfg)
 	if err != nil {
 		log.Panic(err)
 	}
-	defer ln.Close()
-
-	chain,_ := blockchain.ContinueBlockChain(nodeID)
-	defer chain.Database.Close()
-	go CloseDB(chain)
-
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+	if err := node.Start(); err != nil {
+		node.Stop()
+		log.Panic(err)
 	}
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err)
-		}
-		go HandleConnection(conn, chain)
 
-	}
+	CloseDB(node)
 }
 
 func GobEncode(data interface{}) []byte {
@@ -571,17 +806,7 @@ func GobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
-}
-
-// CloseDB 监听系统退出信号并安全关闭区块链数据库。
+// CloseDB 监听系统退出信号并安全停止节点、关闭区块链数据库。
 // 
 // 区块链节点在运行期间会持有 BadgerDB，如果用户按下 Ctrl+C 或系统发送终止信号，
 // 必须优雅关闭数据库，否则可能造成数据损坏。
@@ -591,19 +816,15 @@ func NodeIsKnown(addr string) bool {
 //   - syscall.SIGTERM：系统终止信号（Linux / macOS）
 //   - Windows 使用 os.Interrupt 作为兼容信号
 // 
-// 捕获到退出信号后：
-//   1. 关闭 BadgerDB（chain.Database.Close()）
-//   2. 退出当前 goroutine（runtime.Goexit）
-//   3. 退出整个程序（os.Exit）
+// 捕获到退出信号后调用 node.Stop()：
+//   1. 停止监听，断开所有连接，取消正在进行的挖矿
+//   2. 等待处理消息和挖矿的 goroutine 全部退出
+//   3. 关闭 BadgerDB（chain.Database.Close()）
+// 然后函数返回，由调用者退出程序。
 // 
-// 这样可确保节点在关闭时不会损坏数据库文件。
-
-func CloseDB(chain *blockchain.BlockChain) {
+// 这样可确保节点在关闭时不会损坏数据库文件，也不会有 goroutine 在数据库关闭后继续使用它。
+func CloseDB(node *Node) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
-	d.WaitForDeathWithFunc(func() {
-		defer os.Exit(1)
-		defer runtime.Goexit()
-		chain.Database.Close()
-	})
-}
\ No newline at end of file
+	d.WaitForDeathWithFunc(node.Stop)
+}
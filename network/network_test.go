@@ -0,0 +1,48 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"blockchain_go/blockchain"
+)
+
+// getheaders 的 locator 曾经没有长度限制，一条消息可以让节点为每个哈希查询一次数据库
+func TestHandleGetHeadersLocatorLimit(t *testing.T) {
+	n, _, _ := newPoolTestNode(t, 0)
+	conn, other := net.Pipe()
+	defer other.Close()
+	p := newPeer(conn, "127.0.0.1:1", false, n)
+
+	locator, err := n.chain.BlockLocator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := func(count int) [][]byte {
+		hashes := make([][]byte, count-len(locator), count)
+		for i := range hashes {
+			hashes[i] = randomBytes(32)
+		}
+		return append(hashes, locator...)
+	}
+
+	tests := []struct {
+		name    string
+		locator [][]byte
+		want    error
+	}{
+		{"block locator", locator, nil},
+		{"maximum length", padded(blockchain.MaxLocatorHashes), nil},
+		{"too long", padded(blockchain.MaxLocatorHashes + 1), ErrTooManyItems},
+	}
+
+	for _, tt := range tests {
+		err := n.HandleGetHeaders(p, GobEncode(GetHeaders{"", tt.locator}))
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.want != nil && (!errors.Is(err, tt.want) || banScore(err) != banScoreTooManyItems) {
+			t.Errorf("%s: got %v with score %d, want %v", tt.name, err, banScore(err), tt.want)
+		}
+	}
+}
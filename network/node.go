@@ -0,0 +1,182 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blockchain_go/blockchain"
+	"blockchain_go/config"
+)
+
+/*
+Node 保存一个节点的全部状态。每个连接的读循环、写循环和挖矿都在各自的 goroutine 中运行，
+它们共享的状态由下面的锁保护：
+  mu       内存池（memoryPool）和孤立交易（orphanTxs），见 mempool.go
+  peersMu  连接（peers、conns）和每个连接的监听地址
+  miningMu 当前的挖矿（miningJob）
+区块链本身由 BlockChain 内部的锁保护，已知节点保存在地址簿（book）中，由 AddrBook 内部的锁保护。
+持有 mu 时不会调用其他加锁的函数，也不会发送消息。
+
+NewNode 打开区块链并读取地址簿，Start 开始监听并启动连接管理（见 peermanager.go），Stop 关闭监听、断开所有连接、取消挖矿，
+等待所有 goroutine 退出后保存地址簿并关闭数据库。
+*/
+
+var ErrNodeStopped = errors.New("node is stopped")
+
+type Node struct {
+	addr            string // 监听地址，每个节点实例通过不同的端口号进行区分
+	minerAddr       string // 不为空时挖矿，奖励发送到这个地址
+	miningThreshold int    // 内存池中至少有多少笔交易时矿工节点开始挖矿
+	maxOutbound     int    // 主动连接的目标数量
+	maxInbound      int    // 最多接受多少个对方连接过来的连接
+	chain           *blockchain.BlockChain
+	book            *AddrBook // 网络中已知的节点地址，保存在 peers.json 中
+	bans            *BanList  // 被封禁的 IP，保存在 banlist.json 中
+	banThreshold    int
+	banDuration     time.Duration
+	nonce           uint64 // 在 version 消息中发送，用来发现连接到了自己
+
+	mu         sync.Mutex
+	memoryPool map[string]*poolEntry // 还没有打包的交易，key 是交易 ID
+	poolBytes  int                   // 内存池中交易的总字节数
+	poolSpends map[string]string     // 内存池中的交易花费的输出（交易 ID:输出序号） -> 花费它的交易 ID
+	orphanTxs  map[string]*orphanTx  // 父交易还没有收到的交易，key 是交易 ID
+
+	peersMu sync.Mutex
+	peers   map[string]*Peer   // 监听地址 -> 连接
+	conns   map[*Peer]struct{} // 所有连接，包括还没有登记监听地址的连接
+	stopped bool
+
+	miningMu  sync.Mutex
+	miningJob *miningAttempt // 当前正在进行的挖矿，收到新的 tip 时取消
+	mining    atomic.Bool    // 是否有 goroutine 正在运行 MineTx
+
+	listener net.Listener
+	quit     chan struct{}
+	wg       sync.WaitGroup // 连接、挖矿、连接管理和 accept 的 goroutine
+	stopOnce sync.Once
+}
+
+// miningAttempt 表示一次挖矿尝试，用指针区分不同的尝试
+type miningAttempt struct {
+	cancel context.CancelFunc
+}
+
+// NewNode 按配置创建节点，打开数据目录中的区块链并读取地址簿和封禁列表
+func NewNode(cfg *config.Config) (*Node, error) {
+	chain, err := blockchain.ContinueBlockChain(cfg.ChainDir())
+	if err != nil {
+		return nil, err
+	}
+	bans, err := NewBanList(cfg.BanlistFile())
+	if err != nil {
+		chain.Database.Close()
+		return nil, err
+	}
+
+	n := &Node{
+		addr:            cfg.ListenAddr,
+		minerAddr:       cfg.MinerAddress,
+		miningThreshold: cfg.MiningThreshold,
+		maxOutbound:     cfg.MaxOutbound,
+		maxInbound:      cfg.MaxInbound,
+		chain:           chain,
+		book:            NewAddrBook(cfg.PeersFile(), cfg.ListenAddr, cfg.SeedPeers),
+		bans:            bans,
+		banThreshold:    cfg.BanThreshold,
+		banDuration:     time.Duration(cfg.BanDuration) * time.Second,
+		nonce:           newNonce(),
+		memoryPool:      make(map[string]*poolEntry),
+		poolSpends:      make(map[string]string),
+		orphanTxs:       make(map[string]*orphanTx),
+		peers:           make(map[string]*Peer),
+		conns:           make(map[*Peer]struct{}),
+		quit:            make(chan struct{}),
+	}
+	if err := n.book.Load(); err != nil {
+		fmt.Printf("Failed to load peers: %s\n", err)
+	}
+
+	return n, nil
+}
+
+// Start 开始监听 cfg.ListenAddr 并启动连接管理，由连接管理连接地址簿中的节点
+func (n *Node) Start() error {
+	if n.isStopping() {
+		return ErrNodeStopped
+	}
+
+	ln, err := net.Listen(protocol, n.addr)
+	if err != nil {
+		return err
+	}
+	n.listener = ln
+
+	n.wg.Add(2)
+	go n.acceptLoop()
+	go n.peerManager()
+
+	return nil
+}
+
+// Stop 停止节点并关闭数据库，可以重复调用
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+
+		n.peersMu.Lock()
+		n.stopped = true
+		var all []*Peer
+		for p := range n.conns {
+			all = append(all, p)
+		}
+		n.peersMu.Unlock()
+
+		for _, p := range all {
+			p.Disconnect()
+		}
+		n.abortMining()
+
+		n.wg.Wait()
+		n.saveAddrBook()
+		n.chain.Database.Close()
+	})
+}
+
+func (n *Node) isStopping() bool {
+	select {
+	case <-n.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if !n.isStopping() {
+				fmt.Printf("Failed to accept connection: %s\n", err)
+			}
+			return
+		}
+
+		n.HandleConnection(conn)
+	}
+}
+
+// KnownNodes 返回地址簿中的所有地址
+func (n *Node) KnownNodes() []string {
+	return n.book.Addresses()
+}
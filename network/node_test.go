@@ -0,0 +1,316 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"blockchain_go/blockchain"
+	"blockchain_go/config"
+	"blockchain_go/wallet"
+)
+
+// 在同一个进程中启动几个节点并互相连接，然后从多个连接同时发送 inv/tx/block/addr 等消息（包括无效的消息），
+// 同时在第一个节点上挖矿。用 go test -race ./network/... 运行可以发现节点共享状态上的数据竞争。
+// 最后检查所有节点仍然同步到同一个 tip，并且还能接受新的连接。
+
+const (
+	testNodes          = 3
+	testClientsPerNode = 4
+	testFloodDuration  = 2 * time.Second
+)
+
+// freeAddr 返回一个现在没有被使用的本机地址
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setupChains 在每个数据目录中创建同一个创世块，然后在第一个数据目录中多挖一些区块，
+// 其他节点启动后要通过 headers-first 同步它们。返回用成熟的 coinbase 输出创建的交易
+func setupChains(t *testing.T, cfgs []*config.Config, w *wallet.Wallet) []*blockchain.Transaction {
+	t.Helper()
+
+	address := string(w.Address())
+	chain, err := blockchain.InitBlockChain(address, cfgs[0].ChainDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Database.Close()
+	for _, cfg := range cfgs[1:] {
+		copyDir(t, cfgs[0].ChainDir(), cfg.ChainDir())
+	}
+
+	chain, err = blockchain.ContinueBlockChain(cfgs[0].ChainDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+
+	for i := 0; i <= blockchain.ChainParams.CoinbaseMaturity+3; i++ {
+		if _, err := chain.MineBlock(context.Background(), address, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 这些交易可能花费同一个输出，也覆盖内存池拒绝冲突交易的情况
+	var txs []*blockchain.Transaction
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	for i := 0; i < 4; i++ {
+		txs = append(txs, blockchain.NewTransaction(w, address, 1+i, 1, 0, &UTXOSet))
+	}
+
+	return txs
+}
+
+func startTestNodes(t *testing.T) ([]*Node, []*blockchain.Transaction) {
+	t.Helper()
+
+	var cfgs []*config.Config
+	var seeds []string
+	for i := 0; i < testNodes; i++ {
+		cfg := config.Default(t.TempDir())
+		cfg.ListenAddr = freeAddr(t)
+		cfg.SeedPeers = append([]string{}, seeds...)
+		seeds = append(seeds, cfg.ListenAddr)
+		cfgs = append(cfgs, cfg)
+	}
+
+	w := wallet.MakeWallet()
+	txs := setupChains(t, cfgs, w)
+	cfgs[0].MinerAddress = string(w.Address())
+	cfgs[0].MiningThreshold = 1
+
+	var nodes []*Node
+	for _, cfg := range cfgs {
+		n, err := NewNode(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Start(); err != nil {
+			n.Stop()
+			t.Fatal(err)
+		}
+		t.Cleanup(n.Stop)
+		nodes = append(nodes, n)
+	}
+
+	return nodes, txs
+}
+
+func randomBytes(size int) []byte {
+	buf := make([]byte, size)
+	rand.Read(buf)
+
+	return buf
+}
+
+func randomPort() int {
+	port, _ := rand.Int(rand.Reader, big.NewInt(20000))
+
+	return 40000 + int(port.Int64())
+}
+
+// floodMessages 返回一个客户端要发送的消息：有效的交易和区块、随机的 inv/getdata/addr、对方没有请求过的区块和无法解码的数据
+func floodMessages(tip []byte, txs []*blockchain.Transaction, block *blockchain.Block) map[string][][]byte {
+	var txPayloads [][]byte
+	for _, tx := range txs {
+		txPayloads = append(txPayloads, GobEncode(Tx{"", tx.Serialize()}))
+	}
+	txPayloads = append(txPayloads, GobEncode(Tx{"", randomBytes(64)}), randomBytes(32))
+
+	var addrs []string
+	for i := 0; i < 20; i++ {
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", randomPort()))
+	}
+	addrs = append(addrs, "not an address", "1.2.3.4:0", "0.0.0.0:8333")
+
+	return map[string][][]byte{
+		"tx": txPayloads,
+		"inv": {
+			GobEncode(Inv{"", "tx", [][]byte{randomBytes(32), randomBytes(32), txs[0].ID}}),
+			GobEncode(Inv{"", "block", [][]byte{randomBytes(32)}}),
+			GobEncode(Inv{"", "block", [][]byte{tip}}),
+		},
+		"getdata": {
+			GobEncode(GetData{"", "block", [][]byte{tip, randomBytes(32)}}),
+			GobEncode(GetData{"", "tx", [][]byte{txs[0].ID}}),
+		},
+		"getheaders": {GobEncode(GetHeaders{"", [][]byte{randomBytes(32)}})},
+		"block":      {GobEncode(Block{"", block.Serialize()}), GobEncode(Block{"", randomBytes(80)})},
+		"addr":       {GobEncode(Addr{addrs})},
+		"getaddr":    {nil},
+		"headers":    {GobEncode(Headers{"", [][]byte{randomBytes(40)}})},
+	}
+}
+
+// flood 不断连接 addr 并发送消息，直到 stop 关闭。连接因为分数过高被断开后重新连接
+func flood(t *testing.T, addr string, stop <-chan struct{}, messages map[string][][]byte) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+		if err != nil {
+			t.Errorf("dial %s: %v", addr, err)
+			return
+		}
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := clientHandshake(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		conn.SetDeadline(time.Time{})
+		go io.Copy(io.Discard, conn)
+
+	send:
+		for {
+			for command, payloads := range messages {
+				for _, payload := range payloads {
+					select {
+					case <-stop:
+						conn.Close()
+						return
+					default:
+					}
+					if WriteMessage(conn, command, payload) != nil {
+						break send
+					}
+				}
+			}
+		}
+		conn.Close()
+	}
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func sameTip(nodes []*Node) bool {
+	for _, n := range nodes[1:] {
+		if !bytes.Equal(n.chain.Tip(), nodes[0].chain.Tip()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestNodesUnderConcurrentTraffic(t *testing.T) {
+	nodes, txs := startTestNodes(t)
+	miner := nodes[0]
+
+	waitFor(t, 30*time.Second, "nodes to connect", func() bool {
+		for _, n := range nodes {
+			if len(n.connectedPeers()) < testNodes-1 {
+				return false
+			}
+		}
+		return true
+	})
+	waitFor(t, 30*time.Second, "initial sync", func() bool { return sameTip(nodes) })
+
+	tipBlock, err := miner.chain.GetBlock(miner.chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		for i := 0; i < testClientsPerNode; i++ {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				flood(t, addr, stop, floodMessages(tipBlock.Hash, txs, &tipBlock))
+			}(n.addr)
+		}
+	}
+
+	// 收到的交易会让矿工节点自动挖矿，这里同时直接挖矿并通告新区块
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			block, err := miner.chain.MineBlock(context.Background(), miner.minerAddr, nil)
+			if err != nil {
+				t.Errorf("mine block: %v", err)
+				return
+			}
+			miner.broadcastInv("block", block.Hash, nil)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	time.Sleep(testFloodDuration)
+	close(stop)
+	wg.Wait()
+
+	waitFor(t, 30*time.Second, "nodes to sync after the flood", func() bool { return sameTip(nodes) })
+
+	for _, n := range nodes {
+		conn, err := net.DialTimeout(protocol, n.addr, dialTimeout)
+		if err != nil {
+			t.Fatalf("dial %s after the flood: %v", n.addr, err)
+		}
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := clientHandshake(conn); err != nil {
+			t.Errorf("handshake with %s after the flood: %v", n.addr, err)
+		}
+		conn.Close()
+	}
+}
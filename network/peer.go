@@ -0,0 +1,422 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+与其他节点的长连接。
+每个连接是一个 Peer，有两个 goroutine：
+  读循环  依次读取消息（见 wire.go）并交给对应的 Handle 函数处理，处理完一条消息再读下一条
+  写循环  从发送队列中取出消息写入连接，发送消息的一方不会被网络阻塞
+Handle 函数通过收到消息的 Peer 回复对方，所以 version/getheaders/inv/getdata 等请求和回复都在同一个连接上进行。
+连接建立后先进行 version/verack 握手（见 handshake.go），握手完成之前要发送的其他消息先放在 pending 中，
+发送 verack 之后再按顺序放入发送队列。
+
+所有连接都记录在 Node.conns 中，Node.Stop 时关闭；主动连接的 Peer 还以对方的监听地址登记在 Node.peers 中，
+对方连接过来时只知道临时端口，收到 version 消息后才用其中的 AddrFrom 登记。连接管理（见 peermanager.go）不会连接已经登记的地址。
+任何一个循环出错（连接断开、消息格式错误、发送队列满）都会关闭连接并取消登记；主动连接在握手完成之前断开时在地址簿中记录一次失败。
+*/
+
+const (
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 30 * time.Second
+
+	// sendQueueSize 是发送队列的长度，对方长时间不读取导致队列满时断开连接
+	sendQueueSize = 256
+)
+
+type message struct {
+	command string
+	payload []byte
+}
+
+// Peer 是与另一个节点的一个连接
+type Peer struct {
+	Inbound bool
+
+	addr string // 对方的监听地址，对方连接过来时在收到 version 之前为空，由 Node.peersMu 保护
+	conn net.Conn
+	node *Node
+	send chan message
+	quit chan struct{}
+	once sync.Once
+
+	mu              sync.Mutex // 保护下面的握手状态、分数、区块下载和等待通告的交易
+	versionSent     bool
+	verackSent      bool
+	verackReceived  bool
+	remote          *Version        // 对方的 version 消息，收到之前为 nil
+	pending         []message       // 发送 verack 之前要发送的其他消息
+	closing         bool            // 发送完队列中的消息后关闭连接
+	banScore        int             // 不当行为的分数（见 misbehavior.go）
+	requested       map[string]bool // 通过 getdata 请求过、还没有收到的区块
+	blocksInTransit [][]byte        // 等待从对方下载的区块哈希，按高度顺序
+	queued          map[string]bool // blocksInTransit 中的区块
+	txInv           [][]byte        // 等待通告给对方的交易 ID
+}
+
+func newPeer(conn net.Conn, addr string, inbound bool, node *Node) *Peer {
+	return &Peer{
+		Inbound:   inbound,
+		addr:      addr,
+		conn:      conn,
+		node:      node,
+		send:      make(chan message, sendQueueSize),
+		quit:      make(chan struct{}),
+		requested: make(map[string]bool),
+		queued:    make(map[string]bool),
+	}
+}
+
+// requestBlock 记录向 p 请求了区块 hash
+func (p *Peer) requestBlock(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.requested[hex.EncodeToString(hash)] = true
+}
+
+// takeRequested 返回是否向 p 请求过区块 hash，并删除请求记录
+func (p *Peer) takeRequested(hash []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := hex.EncodeToString(hash)
+	if !p.requested[key] {
+		return false
+	}
+	delete(p.requested, key)
+
+	return true
+}
+
+// queueBlocks 把要从 p 下载的区块加入 p 的下载队列，已经在队列中或者已经请求过的区块不重复加入。
+// 返回 p 是否没有正在下载的区块，这时调用者要开始下载
+func (p *Peer) queueBlocks(hashes [][]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, hash := range hashes {
+		key := hex.EncodeToString(hash)
+		if p.queued[key] || p.requested[key] {
+			continue
+		}
+		p.queued[key] = true
+		p.blocksInTransit = append(p.blocksInTransit, hash)
+	}
+
+	return len(p.requested) == 0
+}
+
+// nextBlock 取出下一个要从 p 下载的区块哈希
+func (p *Peer) nextBlock() ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.blocksInTransit) == 0 {
+		return nil, false
+	}
+	hash := p.blocksInTransit[0]
+	p.blocksInTransit = p.blocksInTransit[1:]
+	delete(p.queued, hex.EncodeToString(hash))
+
+	return hash, true
+}
+
+// clearDownloads 清除 p 的下载队列和请求记录，连接断开时调用。
+// 没有下载完的区块在与其他节点握手时通过 getheaders 重新下载
+func (p *Peer) clearDownloads() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.blocksInTransit = nil
+	p.queued = make(map[string]bool)
+	p.requested = make(map[string]bool)
+}
+
+// downloadBlocks 按顺序从 p 下载 hashes 中的区块。每个连接同时只请求一个区块，
+// 收到后（HandleBlock）再从同一个连接请求下一个，不同连接的下载互不影响
+func (n *Node) downloadBlocks(p *Peer, hashes [][]byte) {
+	if len(hashes) > 0 && p.queueBlocks(hashes) {
+		n.requestNextBlock(p)
+	}
+}
+
+// requestNextBlock 从 p 的下载队列中取出下一个区块并请求它
+func (n *Node) requestNextBlock(p *Peer) {
+	if hash, ok := p.nextBlock(); ok {
+		n.SendGetData(p, "block", [][]byte{hash})
+	}
+}
+
+// Addr 返回对方的监听地址
+func (p *Peer) Addr() string {
+	p.node.peersMu.Lock()
+	defer p.node.peersMu.Unlock()
+
+	return p.addr
+}
+
+func (p *Peer) String() string {
+	if addr := p.Addr(); addr != "" {
+		return addr
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// QueueMessage 把消息放入发送队列；握手消息以外的消息在发送 verack 之前先放在 pending 中
+func (p *Peer) QueueMessage(command string, payload []byte) {
+	p.mu.Lock()
+	if !p.verackSent && !isHandshakeCommand(command) {
+		p.pending = append(p.pending, message{command, payload})
+		p.mu.Unlock()
+		return
+	}
+	ok := p.enqueue(message{command, payload})
+	p.mu.Unlock()
+
+	if !ok {
+		p.sendQueueFull()
+	}
+}
+
+// enqueue 把消息放入发送队列，连接已经关闭时丢弃消息。调用时持有 p.mu；
+// 队列满时返回 false，调用者释放 p.mu 之后调用 sendQueueFull 断开连接
+func (p *Peer) enqueue(msg message) bool {
+	select {
+	case <-p.quit:
+	case p.send <- msg:
+	default:
+		return false
+	}
+
+	return true
+}
+
+// sendQueueFull 在发送队列满时断开连接。Disconnect 要获取 p.mu，所以调用时不能持有 p.mu
+func (p *Peer) sendQueueFull() {
+	fmt.Printf("Send queue of %s is full, disconnecting\n", p)
+	p.Disconnect()
+}
+
+// queueReply 与 QueueMessage 相同，但发送队列满时等待写循环发送，而不是断开连接。
+// 用于回复 getdata：一个请求可能需要回复很多条消息，等待发生在处理请求的读循环中，只影响这一个连接；
+// 对方一直不读取时写循环在 writeTimeout 后断开连接，等待也随之结束
+func (p *Peer) queueReply(command string, payload []byte) {
+	select {
+	case <-p.quit:
+	case p.send <- message{command, payload}:
+	}
+}
+
+// queueTxInv 记录要通告给 p 的交易，连接管理每隔 txInvInterval 把它们合并成一条 inv 发送（见 peermanager.go）
+func (p *Peer) queueTxInv(id []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.txInv) < maxInvPerMsg {
+		p.txInv = append(p.txInv, id)
+	}
+}
+
+// takeTxInv 取出等待通告给 p 的交易
+func (p *Peer) takeTxInv() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := p.txInv
+	p.txInv = nil
+
+	return ids
+}
+
+// DisconnectAfterSend 发送完队列中已有的消息后关闭连接，之后收到的消息不再处理
+func (p *Peer) DisconnectAfterSend() {
+	p.mu.Lock()
+	p.closing = true
+	// 空消息告诉写循环关闭连接
+	ok := p.enqueue(message{})
+	p.mu.Unlock()
+
+	if !ok {
+		p.sendQueueFull()
+	}
+}
+
+func (p *Peer) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closing
+}
+
+// Disconnect 关闭连接，可以重复调用
+func (p *Peer) Disconnect() {
+	p.once.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+		p.node.unregisterPeer(p)
+		p.clearDownloads()
+	})
+}
+
+func (p *Peer) readLoop() {
+	defer p.Disconnect()
+	defer func() {
+		// 主动连接的 addr 不会改变，不需要加锁
+		if !p.Inbound && !p.handshakeComplete() && !p.node.isStopping() {
+			p.node.book.Failed(p.addr)
+		}
+	}()
+
+	for {
+		command, payload, err := ReadMessage(p.conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				fmt.Printf("Failed to read from %s: %s\n", p, err)
+				// 消息头错误（魔数、长度、校验和）增加对方的分数
+				p.node.misbehaving(p, err)
+			}
+			return
+		}
+
+		fmt.Printf("Received %s command from %s\n", command, p)
+		p.node.handleMessage(p, command, payload)
+
+		if p.isClosing() {
+			<-p.quit
+			return
+		}
+	}
+}
+
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case msg := <-p.send:
+			if msg.command == "" {
+				p.Disconnect()
+				return
+			}
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := WriteMessage(p.conn, msg.command, msg.payload); err != nil {
+				fmt.Printf("Failed to send %s to %s: %s\n", msg.command, p, err)
+				p.Disconnect()
+				return
+			}
+		}
+	}
+}
+
+// startPeer 记录连接 p 并启动它的读循环和写循环，握手需要在 handshakeTimeout 内完成。
+// 节点已经停止，或者已经有到 p 的监听地址的连接时关闭 p，返回 false
+func (n *Node) startPeer(p *Peer) bool {
+	n.peersMu.Lock()
+	_, duplicate := n.peers[p.addr]
+	if n.stopped || (p.addr != "" && duplicate) {
+		n.peersMu.Unlock()
+		p.conn.Close()
+		return false
+	}
+	n.conns[p] = struct{}{}
+	if p.addr != "" {
+		n.peers[p.addr] = p
+	}
+	n.peersMu.Unlock()
+
+	p.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	n.wg.Add(2)
+	go func() {
+		defer n.wg.Done()
+		p.writeLoop()
+	}()
+	go func() {
+		defer n.wg.Done()
+		p.readLoop()
+	}()
+
+	return true
+}
+
+// registerPeer 以监听地址 addr 登记连接 p，已经有到 addr 的连接时保留原来的连接
+func (n *Node) registerPeer(addr string, p *Peer) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	if p.addr == "" {
+		p.addr = addr
+	}
+	if _, ok := n.peers[addr]; !ok {
+		n.peers[addr] = p
+	}
+}
+
+func (n *Node) unregisterPeer(p *Peer) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	delete(n.conns, p)
+	if p.addr != "" && n.peers[p.addr] == p {
+		delete(n.peers, p.addr)
+	}
+}
+
+// peer 返回以监听地址 addr 登记的连接，没有时返回 nil
+func (n *Node) peer(addr string) *Peer {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	return n.peers[addr]
+}
+
+// connectPeer 返回到 addr 的连接，还没有连接时建立新的连接；连接失败或者节点已经停止时返回 nil。
+// 连接失败时在地址簿中记录，之后按 retryBackoff 等待再重试
+func (n *Node) connectPeer(addr string) *Peer {
+	if p := n.peer(addr); p != nil {
+		return p
+	}
+	if n.isStopping() {
+		return nil
+	}
+
+	n.book.Attempt(addr)
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		fmt.Printf("%s is not available\n", addr)
+		n.book.Failed(addr)
+		return nil
+	}
+	if n.isBanned(conn.RemoteAddr().String()) {
+		fmt.Printf("%s is banned\n", addr)
+		conn.Close()
+		n.book.Failed(addr)
+		return nil
+	}
+
+	p := newPeer(conn, addr, false, n)
+	// 主动连接的一方先发送 version
+	if err := n.SendVersion(p); err != nil {
+		fmt.Printf("Failed to connect to %s: %s\n", addr, err)
+		conn.Close()
+		return nil
+	}
+	if !n.startPeer(p) {
+		// 连接期间另一个 goroutine 已经建立了到 addr 的连接
+		return n.peer(addr)
+	}
+
+	return p
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// 发送队列满时断开连接曾经在持有 p.mu 的情况下再次获取 p.mu，调用者永远阻塞
+func TestSendQueueOverflowDisconnects(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow func(p *Peer)
+	}{
+		{"QueueMessage", func(p *Peer) {
+			p.verackSent = true
+			for i := 0; i <= sendQueueSize; i++ {
+				p.QueueMessage("inv", nil)
+			}
+		}},
+		{"DisconnectAfterSend", func(p *Peer) {
+			p.verackSent = true
+			for i := 0; i < sendQueueSize; i++ {
+				p.QueueMessage("inv", nil)
+			}
+			p.DisconnectAfterSend()
+		}},
+		{"sendVerack", func(p *Peer) {
+			for i := 0; i < sendQueueSize; i++ {
+				p.QueueMessage("inv", nil)
+			}
+			p.sendVerack()
+		}},
+	}
+
+	for _, tt := range tests {
+		n := &Node{peers: make(map[string]*Peer), conns: make(map[*Peer]struct{})}
+		// 没有写循环，对方也不读取，放入发送队列的消息不会被取走
+		conn, other := net.Pipe()
+		defer other.Close()
+		p := newPeer(conn, "127.0.0.1:1", false, n)
+		p.requestBlock([]byte{1})
+		n.conns[p] = struct{}{}
+		n.peers[p.addr] = p
+
+		done := make(chan struct{})
+		go func() {
+			tt.overflow(p)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: overflowing the send queue did not return", tt.name)
+		}
+
+		select {
+		case <-p.quit:
+		default:
+			t.Errorf("%s: peer was not disconnected", tt.name)
+		}
+		if n.peer(p.addr) != nil || len(n.conns) != 0 {
+			t.Errorf("%s: peer is still registered", tt.name)
+		}
+		if p.takeRequested([]byte{1}) {
+			t.Errorf("%s: downloads were not cleared", tt.name)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+连接管理。
+  peerManager 每隔 connectInterval 检查一次主动连接的数量，少于 maxOutbound 时按分数从地址簿中选择还没有连接的地址建立连接，
+  连接失败或者握手没有完成的地址按 retryBackoff 等待一段时间后再重试；同时把地址簿的修改写入 peers.json。
+  主动连接握手完成后发送 getaddr，之后每隔 addrGossipInterval 再向一个随机的节点发送 getaddr，对方用 addr 回复它知道的地址。
+  这样种子节点下线时，节点也可以通过其他节点知道的地址互相连接，交易和区块由每个节点转发给它连接的其他节点。
+  新区块立即通告；新交易先记录在每个连接中，每隔 txInvInterval 合并成一条 inv 发送，
+  一次收到很多交易时也不会为每笔交易向每个连接发送一条消息而填满发送队列。
+对方连接过来的连接数达到 maxInbound 时不再接受新的连接。
+*/
+
+const (
+	connectInterval    = 5 * time.Second
+	addrGossipInterval = 2 * time.Minute
+	txInvInterval      = 500 * time.Millisecond
+)
+
+func (n *Node) peerManager() {
+	defer n.wg.Done()
+
+	connectTicker := time.NewTicker(connectInterval)
+	defer connectTicker.Stop()
+	gossipTicker := time.NewTicker(addrGossipInterval)
+	defer gossipTicker.Stop()
+	txInvTicker := time.NewTicker(txInvInterval)
+	defer txInvTicker.Stop()
+
+	n.connectOutbound()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-connectTicker.C:
+			n.connectOutbound()
+			n.saveAddrBook()
+		case <-gossipTicker.C:
+			n.requestAddrs()
+		case <-txInvTicker.C:
+			n.flushTxInv()
+		}
+	}
+}
+
+// connectOutbound 建立新的主动连接，直到达到 maxOutbound 或者没有可以连接的地址
+func (n *Node) connectOutbound() {
+	outbound, _ := n.peerCounts()
+	if outbound >= n.maxOutbound {
+		return
+	}
+
+	for _, addr := range n.book.Candidates(n.connectedAddrs()) {
+		if outbound >= n.maxOutbound || n.isStopping() {
+			return
+		}
+		if n.connectPeer(addr) != nil {
+			outbound++
+		}
+	}
+}
+
+// requestAddrs 向一个随机的完整节点发送 getaddr
+func (n *Node) requestAddrs() {
+	peers := n.connectedPeers()
+	if len(peers) == 0 {
+		return
+	}
+
+	n.SendGetAddr(peers[rand.Intn(len(peers))])
+}
+
+func (n *Node) saveAddrBook() {
+	if err := n.book.Save(); err != nil {
+		fmt.Printf("Failed to save peers: %s\n", err)
+	}
+}
+
+// peerCounts 返回主动连接和对方连接过来的连接的数量
+func (n *Node) peerCounts() (outbound, inbound int) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	for p := range n.conns {
+		if p.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+
+	return outbound, inbound
+}
+
+// connectedAddrs 返回已经登记了连接的监听地址
+func (n *Node) connectedAddrs() map[string]bool {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	addrs := make(map[string]bool, len(n.peers))
+	for addr := range n.peers {
+		addrs[addr] = true
+	}
+
+	return addrs
+}
+
+// connectedPeers 返回已经完成握手的完整节点的连接，交易、区块和地址只发送给这些连接
+func (n *Node) connectedPeers() []*Peer {
+	n.peersMu.Lock()
+	all := make([]*Peer, 0, len(n.conns))
+	for p := range n.conns {
+		all = append(all, p)
+	}
+	n.peersMu.Unlock()
+
+	var peers []*Peer
+	for _, p := range all {
+		if p.isFullNode() {
+			peers = append(peers, p)
+		}
+	}
+
+	return peers
+}
+
+// broadcastInv 向 except 以外的所有完整节点通告区块或交易，交易由 flushTxInv 合并发送
+func (n *Node) broadcastInv(kind string, id []byte, except *Peer) {
+	for _, p := range n.connectedPeers() {
+		if p == except {
+			continue
+		}
+		if kind == "tx" {
+			p.queueTxInv(id)
+		} else {
+			n.SendInv(p, kind, [][]byte{id})
+		}
+	}
+}
+
+// flushTxInv 向每个连接发送一条 inv，通告上次之后记录的交易
+func (n *Node) flushTxInv() {
+	for _, p := range n.connectedPeers() {
+		if ids := p.takeTxInv(); len(ids) > 0 {
+			n.SendInv(p, "tx", ids)
+		}
+	}
+}
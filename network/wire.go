@@ -0,0 +1,126 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"blockchain_go/blockchain"
+	"blockchain_go/config"
+)
+
+/*
+消息封装（wire protocol）。
+节点之间的连接是长连接，一个连接上依次传输多条消息，每条消息是 24 字节的消息头加上 payload：
+  4 字节  network magic（小端），不同网络的节点不会互相处理对方的消息
+  12 字节 命令，ASCII，右侧用 0 补齐
+  4 字节  payload 长度（小端），不能超过 MaxPayloadSize
+  4 字节  校验和：payload 的双 SHA-256 的前 4 个字节
+读取消息时先检查消息头，长度超过上限时不读取 payload，避免对方耗尽内存。
+*/
+
+// NetworkMagic 标识消息属于哪个网络，启动时设置为配置中的 NetworkMagic（见 cli.go），不同网络的节点互相拒绝对方的消息
+var NetworkMagic = config.DefaultNetworkMagic
+
+const (
+	// MaxPayloadSize 是一条消息 payload 的最大字节数。
+	// 共识规则限制区块编码后不超过 MaxBlockSize，区块消息在此之外只有 gob 编码和发送方地址，留出足够的余量
+	MaxPayloadSize = 4 * blockchain.MaxBlockSize
+
+	messageHeaderSize = 4 + commandLength + 4 + 4
+)
+
+var (
+	ErrBadMagic        = errors.New("message has wrong network magic")
+	ErrPayloadTooLarge = errors.New("message payload is too large")
+	ErrBadChecksum     = errors.New("message checksum mismatch")
+)
+
+// messageHeader 是消息头
+type messageHeader struct {
+	Magic    uint32
+	Command  string
+	Length   uint32
+	Checksum [4]byte
+}
+
+func checksum(payload []byte) [4]byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	var sum [4]byte
+	copy(sum[:], second[:4])
+	return sum
+}
+
+// EncodeMessage 把命令和 payload 封装成一条完整的消息
+func EncodeMessage(command string, payload []byte) ([]byte, error) {
+	if len(command) > commandLength {
+		return nil, fmt.Errorf("command %q is longer than %d bytes", command, commandLength)
+	}
+	if len(payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(payload))
+	}
+
+	sum := checksum(payload)
+	msg := make([]byte, 0, messageHeaderSize+len(payload))
+	msg = binary.LittleEndian.AppendUint32(msg, NetworkMagic)
+	msg = append(msg, CmdToBytes(command)...)
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(len(payload)))
+	msg = append(msg, sum[:]...)
+
+	return append(msg, payload...), nil
+}
+
+// WriteMessage 把一条消息写入 w
+func WriteMessage(w io.Writer, command string, payload []byte) error {
+	msg, err := EncodeMessage(command, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(msg)
+	return err
+}
+
+func readHeader(r io.Reader) (messageHeader, error) {
+	var header messageHeader
+	var buf [messageHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return header, err
+	}
+
+	header.Magic = binary.LittleEndian.Uint32(buf[0:4])
+	header.Command = BytesToCmd(buf[4 : 4+commandLength])
+	header.Length = binary.LittleEndian.Uint32(buf[4+commandLength : 8+commandLength])
+	copy(header.Checksum[:], buf[8+commandLength:])
+
+	return header, nil
+}
+
+// ReadMessage 从 r 读取一条消息，返回命令和 payload
+func ReadMessage(r io.Reader) (string, []byte, error) {
+	header, err := readHeader(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if header.Magic != NetworkMagic {
+		return "", nil, fmt.Errorf("%w: %08x", ErrBadMagic, header.Magic)
+	}
+	if header.Length > MaxPayloadSize {
+		return "", nil, fmt.Errorf("%w: %s command has %d bytes", ErrPayloadTooLarge, header.Command, header.Length)
+	}
+
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if sum := checksum(payload); !bytes.Equal(sum[:], header.Checksum[:]) {
+		return "", nil, fmt.Errorf("%w: %s command", ErrBadChecksum, header.Command)
+	}
+
+	return header.Command, payload, nil
+}
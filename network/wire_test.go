@@ -0,0 +1,38 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// 消息头的格式与比特币相同，魔数曾经也与比特币主网相同，连接到比特币节点时会处理对方的消息
+func TestReadMessageRejectsOtherNetworks(t *testing.T) {
+	msg, err := EncodeMessage("version", []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		magic uint32
+		want  error
+	}{
+		{"our network", NetworkMagic, nil},
+		{"bitcoin mainnet", 0xd9b4bef9, ErrBadMagic},
+		{"bitcoin testnet3", 0x0709110b, ErrBadMagic},
+		{"bitcoin regtest", 0xdab5bffa, ErrBadMagic},
+	}
+
+	for _, tt := range tests {
+		framed := append([]byte{}, msg...)
+		binary.LittleEndian.PutUint32(framed, tt.magic)
+		command, payload, err := ReadMessage(bytes.NewReader(framed))
+		if tt.want == nil && (err != nil || command != "version" || string(payload) != "payload") {
+			t.Errorf("%s: got %q, %q, %v", tt.name, command, payload, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+)
+
+/*
+公钥使用 SEC1 编码，第一个字节说明格式：
+  0x02 / 0x03 + X（32 字节）：压缩格式，前缀表示 Y 的奇偶
+  0x04 + X + Y（各 32 字节）：未压缩格式
+钱包总是使用压缩格式，地址和 PublicKeyHash 都是对压缩格式的公钥计算的。
+*/
+
+const (
+	CompressedPubKeyLen   = 33
+	UncompressedPubKeyLen = 65
+)
+
+var ErrBadPublicKey = errors.New("invalid public key encoding")
+
+// SerializePublicKey 返回公钥的 SEC1 压缩格式，这是钱包使用的规范格式
+func SerializePublicKey(pub *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)
+}
+
+// ParsePublicKey 解析 SEC1 压缩或未压缩格式的 P-256 公钥，点不在曲线上时返回错误
+func ParsePublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+
+	switch {
+	case len(data) == CompressedPubKeyLen && (data[0] == 0x02 || data[0] == 0x03):
+		x, y := elliptic.UnmarshalCompressed(curve, data)
+		if x == nil {
+			return nil, ErrBadPublicKey
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case len(data) == UncompressedPubKeyLen && data[0] == 0x04:
+		x, y := elliptic.Unmarshal(curve, data)
+		if x == nil {
+			return nil, ErrBadPublicKey
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, ErrBadPublicKey
+}
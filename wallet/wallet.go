@@ -6,25 +6,84 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
 
+	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
 	checksumLength = 4
-	version        = byte(0x00)
+
+	// 地址的版本字节：PubKeyHashVersion 的地址锁定到公钥哈希（P2PKH），ScriptHashVersion 的地址锁定到赎回脚本的哈希（P2SH）
+	PubKeyHashVersion = byte(0x00)
+	ScriptHashVersion = byte(0x05)
+
+	addressHashLength = 20
 )
 
+var ErrBadAddress = errors.New("invalid address")
+
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
+	PublicKey  []byte // SEC1 压缩格式的公钥
+}
+
+// walletData 是钱包保存到文件中的格式。
+// ecdsa.PrivateKey 中的 elliptic.Curve 没有导出字段，不能直接用 gob 编码，所以私钥按 SEC1 DER 格式保存。
+type walletData struct {
+	PrivateKey []byte
 	PublicKey  []byte
 }
 
+func (w Wallet) GobEncode() ([]byte, error) {
+	privKey, err := x509.MarshalECPrivateKey(&w.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buff bytes.Buffer
+	err = gob.NewEncoder(&buff).Encode(walletData{privKey, w.PublicKey})
+
+	return buff.Bytes(), err
+}
+
+func (w *Wallet) GobDecode(data []byte) error {
+	var wd walletData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wd); err != nil {
+		return err
+	}
+
+	privKey, err := x509.ParseECPrivateKey(wd.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	// 公钥总是由私钥重新计算，旧格式（X||Y）的钱包文件读取后也使用规范的压缩格式
+	w.PrivateKey = *privKey
+	w.PublicKey = SerializePublicKey(&privKey.PublicKey)
+
+	return nil
+}
+
 func (w Wallet) Address() []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
 
-	versionedHash := append([]byte{version}, pubHash...)
+	return EncodeAddress(PubKeyHashVersion, pubHash)
+}
+
+// ScriptAddress 返回赎回脚本 redeemScript 的 P2SH 地址
+func ScriptAddress(redeemScript []byte) []byte {
+	return EncodeAddress(ScriptHashVersion, PublicKeyHash(redeemScript))
+}
+
+// EncodeAddress 返回 Base58(版本字节 + 哈希 + 4 字节校验和) 格式的地址
+func EncodeAddress(version byte, hash []byte) []byte {
+	versionedHash := append([]byte{version}, hash...)
 	checksum := Checksum(versionedHash)
 
 	fullHash := append(versionedHash, checksum...)
@@ -33,6 +92,27 @@ func (w Wallet) Address() []byte {
 	return address
 }
 
+// DecodeAddress 解析地址，返回版本字节和 20 字节的哈希（公钥哈希或脚本哈希）
+func DecodeAddress(address string) (byte, []byte, error) {
+	fullHash, err := base58.Decode(address)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", ErrBadAddress, err)
+	}
+	if len(fullHash) != 1+addressHashLength+checksumLength {
+		return 0, nil, fmt.Errorf("%w: wrong length", ErrBadAddress)
+	}
+
+	versionedHash := fullHash[:len(fullHash)-checksumLength]
+	if !bytes.Equal(fullHash[len(fullHash)-checksumLength:], Checksum(versionedHash)) {
+		return 0, nil, fmt.Errorf("%w: bad checksum", ErrBadAddress)
+	}
+	if versionedHash[0] != PubKeyHashVersion && versionedHash[0] != ScriptHashVersion {
+		return 0, nil, fmt.Errorf("%w: unknown version %#x", ErrBadAddress, versionedHash[0])
+	}
+
+	return versionedHash[0], versionedHash[1:], nil
+}
+
 func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 
@@ -41,8 +121,8 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic(err)
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	
+	pub := SerializePublicKey(&private.PublicKey)
+
 	return *private, pub
 }
 
@@ -75,12 +155,9 @@ func Checksum(payload []byte) []byte {
 	return secondHash[:checksumLength]
 }
 
+// ValidateAddress 判断 address 是否是有效的 P2PKH 或 P2SH 地址
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
-	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
+	_, _, err := DecodeAddress(address)
 
-	return bytes.Equal(actualChecksum, targetChecksum)
+	return err == nil
 }
\ No newline at end of file
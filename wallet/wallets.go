@@ -2,25 +2,26 @@ package wallet
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 )
 
-const walletFile = "./tmp/wallets_%s.data"
-
 type Wallets struct {
 	Wallets map[string]*Wallet
+	Scripts map[string][]byte // P2SH 地址 -> 赎回脚本
 }
 
-func CreateWallets(nodeId string) (*Wallets, error) {
+// CreateWallets 从钱包文件 walletFile 读取钱包，文件不存在时返回空的钱包集合和错误
+func CreateWallets(walletFile string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Scripts = make(map[string][]byte)
 
-	err := wallets.LoadFile(nodeId)
+	err := wallets.LoadFile(walletFile)
 
 	return &wallets, err
 }
@@ -34,12 +35,30 @@ func (ws *Wallets) AddWallet() string {
 	return address
 }
 
+// AddScript 保存赎回脚本，返回它的 P2SH 地址
+func (ws *Wallets) AddScript(redeemScript []byte) string {
+	address := string(ScriptAddress(redeemScript))
+	ws.Scripts[address] = redeemScript
+
+	return address
+}
+
+// GetScript 返回 P2SH 地址 address 的赎回脚本
+func (ws Wallets) GetScript(address string) ([]byte, bool) {
+	script, ok := ws.Scripts[address]
+
+	return script, ok
+}
+
 func (ws *Wallets) GetAllAddresses() []string {
 	var addresses []string
 
 	for address := range ws.Wallets {
 		addresses = append(addresses, address)
 	}
+	for address := range ws.Scripts {
+		addresses = append(addresses, address)
+	}
 
 	return addresses
 }
@@ -48,8 +67,7 @@ func (ws Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
-func (ws *Wallets) LoadFile(nodeId string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeId)
+func (ws *Wallets) LoadFile(walletFile string) error {
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -61,7 +79,6 @@ func (ws *Wallets) LoadFile(nodeId string) error {
 		return err
 	}
 
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
@@ -69,15 +86,15 @@ func (ws *Wallets) LoadFile(nodeId string) error {
 	}
 
 	ws.Wallets = wallets.Wallets
+	if wallets.Scripts != nil {
+		ws.Scripts = wallets.Scripts
+	}
 
 	return nil
 }
 
-func (ws *Wallets) SaveFile(nodeId string) {
+func (ws *Wallets) SaveFile(walletFile string) {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeId)
-
-	gob.Register(elliptic.P256())
 
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
@@ -85,7 +102,12 @@ func (ws *Wallets) SaveFile(nodeId string) {
 		log.Panic(err)
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = os.MkdirAll(filepath.Dir(walletFile), 0700)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(walletFile, content.Bytes(), 0600)
 	if err != nil {
 		log.Panic(err)
 	}